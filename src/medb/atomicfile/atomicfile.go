@@ -0,0 +1,30 @@
+package atomicfile
+
+import (
+	"os"
+	"path"
+)
+
+// WriteFile is like ioutil.WriteFile, except that the file is written next to
+// filePath then renamed over it. Readers see either the old file or the whole
+// new one, and a crash never leaves a partial file behind.
+func WriteFile(filePath string, data []byte, perm os.FileMode) error {
+	tmpPath := path.Join(path.Dir(filePath), "."+path.Base(filePath)+".tmp")
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
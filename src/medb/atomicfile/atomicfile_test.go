@@ -0,0 +1,51 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-atomicfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "state.json")
+
+	for _, content := range []string{"first", "second"} {
+		err = WriteFile(filePath, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(raw) != content {
+			t.Fatal(string(raw))
+		}
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatal(info.Mode())
+	}
+	// Nothing is left behind
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatal(entries)
+	}
+
+	// A directory that doesn't exist fails without creating anything
+	if WriteFile(path.Join(dir, "missing", "state.json"), []byte("x"), 0600) == nil {
+		t.Fatal("wrote into a missing directory")
+	}
+}
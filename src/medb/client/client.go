@@ -0,0 +1,415 @@
+// Package client talks to a medb server over its HTTP API, so tools don't
+// have to make the calls by hand.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	csrfCookieName = "medb_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+	totpLoginPage  = "/login-totp.html"
+)
+
+var (
+	ErrNotLoggedIn = errors.New("not logged in")
+	// Login returns this when the password was right, but the user also has
+	// to pass LoginTOTP.
+	ErrTOTPRequired = errors.New("a TOTP or recovery code is required")
+	// Changes returns this when the server doesn't know the cursor, the
+	// client has to sync everything again.
+	ErrUnknownCursor = errors.New("unknown cursor")
+)
+
+// Error is an error status the server answered with.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("medb: %d %s", e.StatusCode, e.Message)
+}
+
+// Client is logged in to a server with either a session, after Login, or a
+// personal access token.
+type Client struct {
+	baseURL *url.URL
+	http    *http.Client
+	token   string
+}
+
+// New returns a client for the server at baseURL that has to Login before
+// anything else.
+func New(baseURL string) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		baseURL: u,
+		http: &http.Client{
+			Jar: jar,
+			// The server redirects to say how a login went
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// NewWithToken returns a client that authenticates with a personal access
+// token. It can only do what the token's scope allows.
+func NewWithToken(baseURL string, token string) (*Client, error) {
+	c, err := New(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	c.token = token
+	return c, nil
+}
+
+// Entry is a folder or note in the tree of a DB.
+type Entry struct {
+	Name string `json:"name"`
+	// "file" for notes, anything else is a folder
+	State    string    `json:"state"`
+	ID       uuid.UUID `json:"id"`
+	Contents []*Entry  `json:"contents"`
+}
+
+func (e *Entry) IsNote() bool {
+	return e.State == "file"
+}
+
+type Note struct {
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+	// Relative to the DB root, only Create and Move fill it in
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// HistoryEntry is a commit in the DB's git history.
+type HistoryEntry struct {
+	Hash      string    `json:"hash"`
+	Author    string    `json:"author"`
+	Email     string    `json:"email"`
+	Time      time.Time `json:"time"`
+	Message   string    `json:"message"`
+	Signature string    `json:"signature"`
+	SignedBy  string    `json:"signedBy"`
+	// True if the commit isn't signed by a trusted key
+	Flagged bool `json:"flagged"`
+}
+
+// Change is what happened to a note since the last sync.
+type Change struct {
+	// "created", "updated" or "deleted"
+	Type string    `json:"type"`
+	ID   uuid.UUID `json:"id"`
+	// Relative to the DB root
+	Path string `json:"path"`
+	// The hash of the content, empty for deletes
+	Hash    string `json:"hash"`
+	Content string `json:"content"`
+}
+
+type ChangeSet struct {
+	// To pass to Changes next time
+	Cursor  string   `json:"cursor"`
+	Changes []Change `json:"changes"`
+}
+
+// Upload is a change made offline. Without an ID it creates a note at the
+// path, otherwise it changes the note whose content had BaseHash.
+type Upload struct {
+	ID       uuid.UUID
+	BaseHash string
+	Path     string
+	// Left alone if nil
+	Content *string
+	Deleted bool
+}
+
+// UploadResult says how an Upload went. Conflicts have the note as it is on
+// the server, if it still exists.
+type UploadResult struct {
+	// "applied", "conflict", "rejected" or "failed"
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+	ID      uuid.UUID `json:"id"`
+	Path    string    `json:"path"`
+	Hash    string    `json:"hash"`
+	Content string    `json:"content"`
+}
+
+type GitInfo struct {
+	LastCommit    string       `json:"lastCommit"`
+	LastPull      string       `json:"lastPull"`
+	RemoteAheadBy string       `json:"remoteAheadBy"`
+	LocalAheadBy  string       `json:"localAheadBy"`
+	Remotes       []RemoteInfo `json:"remotes"`
+}
+
+type RemoteInfo struct {
+	Remote string `json:"remote"`
+	// False if there's no tracking branch for the remote, the counts are
+	// meaningless then.
+	Tracked       bool  `json:"tracked"`
+	RemoteAheadBy int64 `json:"remoteAheadBy"`
+	LocalAheadBy  int64 `json:"localAheadBy"`
+	// Unix timestamps, 0 if it never happened
+	LastPushAttempt int64  `json:"lastPushAttempt"`
+	LastPushSuccess int64  `json:"lastPushSuccess"`
+	LastPushError   string `json:"lastPushError"`
+}
+
+// Login starts a session. If the user has a second factor, this returns
+// ErrTOTPRequired and LoginTOTP has to finish the login.
+func (c *Client) Login(username string, password string) error {
+	return c.login("/api/1/login", url.Values{"username": {username}, "password": {password}})
+}
+
+// LoginTOTP finishes a Login with a TOTP or recovery code.
+func (c *Client) LoginTOTP(code string) error {
+	return c.login("/api/1/login/totp", url.Values{"code": {code}})
+}
+
+func (c *Client) login(path string, form url.Values) error {
+	resp, _, err := c.do("POST", path, form)
+	if err != nil {
+		return err
+	}
+	switch resp.Header.Get("Location") {
+	case "/":
+		return nil
+	case totpLoginPage:
+		return ErrTOTPRequired
+	}
+	return ErrNotLoggedIn
+}
+
+func (c *Client) Logout() error {
+	_, _, err := c.do("POST", "/api/1/logout", nil)
+	return err
+}
+
+// List returns every note in the DB as a tree of folders.
+func (c *Client) List() ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	err := c.doJSON("GET", "/api/1/list", nil, &entries)
+	return entries, err
+}
+
+// Search returns the notes that best match the query.
+func (c *Client) Search(query string) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	err := c.doJSON("POST", "/api/1/search", url.Values{"query": {query}}, &entries)
+	return entries, err
+}
+
+func (c *Client) Load(id uuid.UUID) (Note, error) {
+	var note Note
+	err := c.doJSON("POST", "/api/1/load", url.Values{"fileID": {id.String()}}, &note)
+	return note, err
+}
+
+// Edit replaces the note's content and commits it.
+func (c *Client) Edit(id uuid.UUID, content string) error {
+	_, _, err := c.do("POST", "/api/1/edit", url.Values{"fileID": {id.String()}, "fileContent": {content}})
+	return err
+}
+
+// Create adds a note at the path, relative to the DB root, creating any
+// missing folders. It fails rather than overwrite a note.
+func (c *Client) Create(path string, content string) (Note, error) {
+	var note Note
+	err := c.doV2("POST", "/api/2/notes", map[string]string{"path": path, "content": content}, &note)
+	return note, err
+}
+
+// Move moves a note to the path, creating any missing folders.
+func (c *Client) Move(id uuid.UUID, path string) (Note, error) {
+	var note Note
+	err := c.doV2("PATCH", "/api/2/notes/"+id.String(), map[string]string{"path": path}, &note)
+	return note, err
+}
+
+func (c *Client) Delete(id uuid.UUID) error {
+	return c.doV2("DELETE", "/api/2/notes/"+id.String(), nil, nil)
+}
+
+// Changes returns the notes created, updated or deleted since the cursor
+// from the last ChangeSet, or every note without one.
+func (c *Client) Changes(cursor string) (ChangeSet, error) {
+	var changes ChangeSet
+	err := c.doV2("GET", "/api/2/changes?since="+url.QueryEscape(cursor), nil, &changes)
+	if clientErr, ok := err.(*Error); ok && clientErr.StatusCode == 410 {
+		return changes, ErrUnknownCursor
+	}
+	return changes, err
+}
+
+// UploadChanges applies the changes, each on its own, and returns a result
+// for each of them in the same order.
+func (c *Client) UploadChanges(uploads []Upload) ([]UploadResult, error) {
+	type uploadJSON struct {
+		ID       string  `json:"id,omitempty"`
+		BaseHash string  `json:"baseHash,omitempty"`
+		Path     string  `json:"path,omitempty"`
+		Content  *string `json:"content,omitempty"`
+		Deleted  bool    `json:"deleted,omitempty"`
+	}
+	request := struct {
+		Changes []uploadJSON `json:"changes"`
+	}{Changes: make([]uploadJSON, len(uploads))}
+	for i, upload := range uploads {
+		request.Changes[i] = uploadJSON{
+			BaseHash: upload.BaseHash,
+			Path:     upload.Path,
+			Content:  upload.Content,
+			Deleted:  upload.Deleted,
+		}
+		if upload.ID != uuid.Nil {
+			request.Changes[i].ID = upload.ID.String()
+		}
+	}
+	var response struct {
+		Results []UploadResult `json:"results"`
+	}
+	err := c.doV2("POST", "/api/2/changes", request, &response)
+	return response.Results, err
+}
+
+// History returns up to limit commits, newest first. The server picks the
+// limit if it's 0.
+func (c *Client) History(limit int) ([]HistoryEntry, error) {
+	p := "/api/1/history"
+	if limit > 0 {
+		p += "?limit=" + strconv.Itoa(limit)
+	}
+	entries := make([]HistoryEntry, 0)
+	err := c.doJSON("GET", p, nil, &entries)
+	return entries, err
+}
+
+func (c *Client) GitInfo() (GitInfo, error) {
+	var info GitInfo
+	err := c.doJSON("GET", "/api/1/git/info", nil, &info)
+	return info, err
+}
+
+func (c *Client) Push() error {
+	_, _, err := c.do("POST", "/api/1/push", nil)
+	return err
+}
+
+func (c *Client) Pull() error {
+	_, _, err := c.do("POST", "/api/1/pull", nil)
+	return err
+}
+
+func (c *Client) doJSON(method string, path string, form url.Values, value interface{}) error {
+	_, body, err := c.do(method, path, form)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, value)
+}
+
+// Sends a v2 request with the request as its JSON body and decodes the
+// response into response, either can be nil. v2 errors come in an envelope,
+// only their message ends up in the *Error.
+func (c *Client) doV2(method string, path string, request interface{}, response interface{}) error {
+	var body []byte
+	if request != nil {
+		var err error
+		body, err = json.Marshal(request)
+		if err != nil {
+			return err
+		}
+	}
+	_, respBody, err := c.send(method, path, "application/json", body)
+	if err == nil && response != nil {
+		return json.Unmarshal(respBody, response)
+	}
+	if clientErr, ok := err.(*Error); ok {
+		var envelope struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal([]byte(clientErr.Message), &envelope) == nil {
+			clientErr.Message = envelope.Error.Message
+		}
+	}
+	return err
+}
+
+// Sends the request, with the form as the body if there is one, and returns
+// the response along with its body. Error statuses are returned as an *Error.
+func (c *Client) do(method string, path string, form url.Values) (*http.Response, []byte, error) {
+	if form == nil {
+		return c.send(method, path, "", nil)
+	}
+	return c.send(method, path, "application/x-www-form-urlencoded", []byte(form.Encode()))
+}
+
+func (c *Client) send(method string, path string, contentType string, body []byte) (*http.Response, []byte, error) {
+	u, err := c.baseURL.Parse(c.baseURL.Path + path)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if method != "GET" {
+		// Sessions have to prove the request isn't forged
+		for _, cookie := range c.http.Jar.Cookies(c.baseURL) {
+			if cookie.Name == csrfCookieName {
+				req.Header.Set(csrfHeaderName, cookie.Value)
+			}
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == 302 && resp.Header.Get("Location") == "/login.html" {
+		return nil, nil, ErrNotLoggedIn
+	}
+	if resp.StatusCode >= 400 {
+		return nil, nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(respBody))}
+	}
+	return resp, respBody, nil
+}
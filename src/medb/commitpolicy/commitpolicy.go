@@ -0,0 +1,86 @@
+// Package commitpolicy decides how changes to a DB are committed, so that the
+// server and the tools that change a DB directly commit the same way.
+package commitpolicy
+
+import (
+	"bytes"
+	"medb/storage"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultMessageTemplate = "MeDB Sync - {{.Operation}} {{.Title}}"
+	DefaultCoalesceWindow  = 5 * time.Minute
+)
+
+// The operations that can show up in a commit message
+const (
+	OperationCreate = "create"
+	OperationEdit   = "edit"
+	OperationMove   = "move"
+	OperationDelete = "delete"
+	// Changes uploaded by an offline client
+	OperationSync = "sync"
+)
+
+// MessageInfo has the fields available to the message template.
+type MessageInfo struct {
+	Operation string
+	Title     string
+	Username  string
+}
+
+// Policy is the message template, coalescing and signing to commit with.
+type Policy struct {
+	messages       *template.Template
+	coalesceWindow time.Duration
+	signingKey     *storage.SigningKey
+}
+
+func New(messageTemplate string, coalesceWindow time.Duration, signingKey *storage.SigningKey) (Policy, error) {
+	t, err := template.New("commitMessage").Parse(messageTemplate)
+	if err != nil {
+		return Policy{}, err
+	}
+	return Policy{
+		messages:       t,
+		coalesceWindow: coalesceWindow,
+		signingKey:     signingKey,
+	}, nil
+}
+
+func (p Policy) message(info MessageInfo) (string, error) {
+	buf := &bytes.Buffer{}
+	err := p.messages.Execute(buf, info)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Commit commits everything in the db. It's attributed to author, or to git's
+// configured identity if that's nil, and username is what the message sees.
+// noteID should be uuid.Nil unless the change is to a single existing note,
+// since only those are coalesced.
+func (p Policy) Commit(
+	db storage.DB,
+	author *storage.Author,
+	username string,
+	operation string,
+	title string,
+	noteID uuid.UUID,
+) error {
+	message, err := p.message(MessageInfo{Operation: operation, Title: title, Username: username})
+	if err != nil {
+		return err
+	}
+	return db.CommitWithOptions(message, storage.CommitOptions{
+		Author:         author,
+		NoteID:         noteID,
+		CoalesceWindow: p.coalesceWindow,
+		SigningKey:     p.signingKey,
+	})
+}
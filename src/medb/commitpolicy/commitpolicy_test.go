@@ -0,0 +1,59 @@
+package commitpolicy
+
+import (
+	"medb/storage"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Records the commits instead of making them
+type recordingDB struct {
+	storage.DB
+	messages []string
+	options  []storage.CommitOptions
+}
+
+func (d *recordingDB) CommitWithOptions(message string, options storage.CommitOptions) error {
+	d.messages = append(d.messages, message)
+	d.options = append(d.options, options)
+	return nil
+}
+
+func TestCommit(t *testing.T) {
+	key := &storage.SigningKey{Format: storage.SigningFormatSSH, Path: "/keys/medb"}
+	p, err := New("{{.Username}}: {{.Operation}} {{.Title}}", time.Minute, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &recordingDB{}
+	alice := &storage.Author{Name: "Alice", Email: "alice@example.com"}
+	noteID := uuid.New()
+	err = p.Commit(db, alice, "alice", OperationEdit, "todo.md", noteID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Commit(db, nil, "", OperationSync, "3 notes", uuid.Nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.messages[0] != "alice: edit todo.md" || db.messages[1] != ": sync 3 notes" {
+		t.Fatal(db.messages)
+	}
+	expected := storage.CommitOptions{Author: alice, NoteID: noteID, CoalesceWindow: time.Minute, SigningKey: key}
+	if db.options[0] != expected {
+		t.Fatal(db.options[0])
+	}
+	if db.options[1].Author != nil || db.options[1].NoteID != uuid.Nil || db.options[1].SigningKey != key {
+		t.Fatal(db.options[1])
+	}
+}
+
+func TestNewRejectsBadTemplates(t *testing.T) {
+	_, err := New("{{.Operation", 0, nil)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+}
@@ -0,0 +1,55 @@
+package acl
+
+import (
+	"errors"
+	"sync"
+)
+
+// Role is what a member may do in a DB.
+type Role string
+
+const (
+	// Can do anything an editor can, and manage the DB's members
+	RoleOwner Role = "owner"
+	// Can read and change notes, and pull and push
+	RoleEditor Role = "editor"
+	// Can only read notes and the git state
+	RoleViewer Role = "viewer"
+)
+
+var roleRanks = map[Role]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+var ErrNotMember = errors.New("not a member of this DB")
+
+// Allows returns whether the role can do everything min can.
+func (r Role) Allows(min Role) bool {
+	return roleRanks[r] >= roleRanks[min]
+}
+
+func (r Role) Valid() bool {
+	return roleRanks[r] > 0
+}
+
+// Store keeps the members of shared DBs. The users file decides which DBs a
+// user can open, the members decide what they may do there. A DB without any
+// members isn't shared, so whoever can open it owns it.
+type Store interface {
+	// Returns the user's role in the DB, or ErrNotMember if it's shared
+	// without them.
+	Role(dbPath string, username string) (Role, error)
+	// Returns the DB's members by username, empty if it isn't shared
+	Members(dbPath string) (map[string]Role, error)
+	SetRole(dbPath string, username string, role Role) error
+	// Removes a member. A shared DB always keeps at least one owner.
+	Remove(dbPath string, username string) error
+}
+
+// NewStore returns a store that keeps members in a JSON file at filePath. If
+// filePath is empty, no DB can be shared.
+func NewStore(filePath string) Store {
+	return &storeImpl{filePath: filePath, lock: &sync.Mutex{}}
+}
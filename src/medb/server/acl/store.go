@@ -0,0 +1,140 @@
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"medb/atomicfile"
+	"os"
+	"path"
+	"sync"
+)
+
+type storeImpl struct {
+	// A JSON object of DB path to an object of username to role. It's read on
+	// every call so that it can be edited by hand while the server runs.
+	filePath string
+	// Serializes changes to the file from this process
+	lock *sync.Mutex
+}
+
+var _ Store = &storeImpl{}
+
+func (s *storeImpl) Role(dbPath string, username string) (Role, error) {
+	members, err := s.Members(dbPath)
+	if err != nil {
+		return "", err
+	}
+	if len(members) == 0 {
+		return RoleOwner, nil
+	}
+	role, ok := members[username]
+	if !ok {
+		return "", ErrNotMember
+	}
+	return role, nil
+}
+
+func (s *storeImpl) Members(dbPath string) (map[string]Role, error) {
+	dbs, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	members := dbs[path.Clean(dbPath)]
+	if members == nil {
+		members = make(map[string]Role)
+	}
+	return members, nil
+}
+
+func (s *storeImpl) SetRole(dbPath string, username string, role Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	if username == "" {
+		return errors.New("username can't be empty")
+	}
+	return s.update(dbPath, func(members map[string]Role) error {
+		members[username] = role
+		return nil
+	})
+}
+
+func (s *storeImpl) Remove(dbPath string, username string) error {
+	return s.update(dbPath, func(members map[string]Role) error {
+		if _, ok := members[username]; !ok {
+			return ErrNotMember
+		}
+		delete(members, username)
+		return nil
+	})
+}
+
+// Applies the change to the DB's members, making sure it's left with an owner
+// if it's still shared, and atomically replaces the file with the result.
+func (s *storeImpl) update(dbPath string, change func(members map[string]Role) error) error {
+	if s.filePath == "" {
+		return errors.New("sharing DBs isn't enabled on this server")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dbs, err := s.read()
+	if err != nil {
+		return err
+	}
+	dbPath = path.Clean(dbPath)
+	members := dbs[dbPath]
+	if members == nil {
+		members = make(map[string]Role)
+	}
+	err = change(members)
+	if err != nil {
+		return err
+	}
+	hasOwner := false
+	for _, role := range members {
+		hasOwner = hasOwner || role == RoleOwner
+	}
+	if len(members) > 0 && !hasOwner {
+		return errors.New("a shared DB must have an owner")
+	}
+	if len(members) == 0 {
+		delete(dbs, dbPath)
+	} else {
+		dbs[dbPath] = members
+	}
+
+	raw, err := json.MarshalIndent(dbs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.filePath, raw, 0600)
+}
+
+func (s *storeImpl) read() (map[string]map[string]Role, error) {
+	dbs := make(map[string]map[string]Role)
+	if s.filePath == "" {
+		return dbs, nil
+	}
+	raw, err := ioutil.ReadFile(s.filePath)
+	if os.IsNotExist(err) {
+		return dbs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &dbs)
+	if err != nil {
+		return nil, err
+	}
+	for dbPath, members := range dbs {
+		for username, role := range members {
+			if !role.Valid() {
+				return nil, fmt.Errorf("malformed members file, %s has unknown role %q in %s", username, role, dbPath)
+			}
+		}
+	}
+	return dbs, nil
+}
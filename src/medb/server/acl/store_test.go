@@ -0,0 +1,78 @@
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-acl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(path.Join(dir, "members.json"))
+
+	// DBs that aren't shared are owned by whoever can open them
+	role, err := store.Role("/notes", "alice")
+	if err != nil || role != RoleOwner {
+		t.Fatal(role, err)
+	}
+
+	if store.SetRole("/notes", "bob", RoleEditor) == nil {
+		t.Fatal("shared a DB without an owner")
+	}
+	err = store.SetRole("/notes", "alice", RoleOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetRole("/notes/", "bob", RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.SetRole("/notes", "carol", "admin") == nil {
+		t.Fatal("set an unknown role")
+	}
+
+	role, err = NewStore(path.Join(dir, "members.json")).Role("/notes", "bob")
+	if err != nil || role != RoleViewer {
+		t.Fatal(role, err)
+	}
+	if !role.Allows(RoleViewer) || role.Allows(RoleEditor) {
+		t.Fatal("viewers are only allowed to view")
+	}
+	if _, err = store.Role("/notes", "carol"); err != ErrNotMember {
+		t.Fatal(err)
+	}
+	if role, _ = store.Role("/other", "carol"); role != RoleOwner {
+		t.Fatal(role)
+	}
+
+	if store.Remove("/notes", "alice") == nil {
+		t.Fatal("removed the last owner")
+	}
+	err = store.Remove("/notes", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Remove("/notes", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := store.Members("/notes")
+	if err != nil || len(members) != 0 {
+		t.Fatal(members, err)
+	}
+}
+
+func TestSharingDisabled(t *testing.T) {
+	store := NewStore("")
+	if role, err := store.Role("/notes", "alice"); err != nil || role != RoleOwner {
+		t.Fatal(role, err)
+	}
+	if store.SetRole("/notes", "alice", RoleOwner) == nil {
+		t.Fatal("shared a DB without a members file")
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"medb/commitpolicy"
+	"medb/server/audit"
+	"medb/server/user"
+	"medb/storage"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// API v2 is resource oriented and speaks JSON both ways. Every error is
+// answered with an errorEnvelope.
+const (
+	apiV2Prefix = "/api/2/"
+	// The largest request body v2 reads
+	maxV2BodySize = 10 << 20
+)
+
+// The codes in the v2 error envelope
+const (
+	errorCodeBadRequest       = "bad_request"
+	errorCodeUnauthorized     = "unauthorized"
+	errorCodeForbidden        = "forbidden"
+	errorCodeNotFound         = "not_found"
+	errorCodeMethodNotAllowed = "method_not_allowed"
+	errorCodeConflict         = "conflict"
+	errorCodeGone             = "gone"
+	errorCodeTooManyRequests  = "too_many_requests"
+	errorCodeInternal         = "internal"
+)
+
+var statusErrorCodes = map[int]string{
+	400: errorCodeBadRequest,
+	401: errorCodeUnauthorized,
+	403: errorCodeForbidden,
+	404: errorCodeNotFound,
+	405: errorCodeMethodNotAllowed,
+	409: errorCodeConflict,
+	410: errorCodeGone,
+	429: errorCodeTooManyRequests,
+	500: errorCodeInternal,
+}
+
+type errorEnvelope struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type noteJSON struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Relative to the DB root
+	Path string `json:"path"`
+	// Left out of lists of notes
+	Content *string `json:"content,omitempty"`
+}
+
+type treeJSON struct {
+	Tree []*storage.JSONFile `json:"tree"`
+}
+
+type searchRequestJSON struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit"`
+}
+
+type notesJSON struct {
+	Notes []noteJSON `json:"notes"`
+}
+
+type createNoteJSON struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+type updateNoteJSON struct {
+	Content *string `json:"content"`
+}
+
+type moveNoteJSON struct {
+	Path string `json:"path"`
+}
+
+// Registers the v2 routes on mux.
+func registerAPIV2(mux *http.ServeMux, a *auth, commits commitPolicy) {
+	mux.HandleFunc("/api/2/openapi.json", handlerTimer("v2/openapi", v2Route(map[string]v2Handler{
+		"GET": openAPIHandler,
+	})))
+	mux.HandleFunc("/api/2/tree", handlerTimer("v2/tree", v2Route(map[string]v2Handler{
+		"GET": v2TreeHandler(a),
+	})))
+	mux.HandleFunc("/api/2/search", handlerTimer("v2/search", v2Route(map[string]v2Handler{
+		"POST": v2SearchHandler(a),
+	})))
+	mux.HandleFunc("/api/2/notes", handlerTimer("v2/notes", v2Route(map[string]v2Handler{
+		"POST": v2CreateNoteHandler(a, commits),
+	})))
+	mux.HandleFunc("/api/2/notes/", handlerTimer("v2/note", v2Route(map[string]v2Handler{
+		"GET":    v2GetNoteHandler(a),
+		"PUT":    v2UpdateNoteHandler(a, commits),
+		"PATCH":  v2MoveNoteHandler(a, commits),
+		"DELETE": v2DeleteNoteHandler(a, commits),
+	})))
+	mux.HandleFunc("/api/2/changes", handlerTimer("v2/changes", v2Route(map[string]v2Handler{
+		"GET":  v2ChangesHandler(a),
+		"POST": v2UploadHandler(a, commits),
+	})))
+	mux.HandleFunc(apiV2Prefix, func(w http.ResponseWriter, r *http.Request) {
+		writeV2Error(w, 404, fmt.Sprintf("No such resource %s", r.URL.Path))
+	})
+}
+
+type v2Handler func(w http.ResponseWriter, r *http.Request)
+
+// Dispatches to the handler for the request's method, anything else gets a
+// 405. GET also handles HEAD.
+func v2Route(handlers map[string]v2Handler) func(w http.ResponseWriter, r *http.Request) {
+	methods := make([]string, 0, len(handlers))
+	for method := range handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	allowHeader := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		method := r.Method
+		if method == "HEAD" {
+			method = "GET"
+		}
+		handler, ok := handlers[method]
+		if !ok {
+			w.Header().Set("Allow", allowHeader)
+			writeV2Error(w, 405, fmt.Sprintf("%s isn't allowed here", r.Method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeV2JSON(w http.ResponseWriter, status int, value interface{}) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		writeV2Error(w, 500, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(raw)
+}
+
+func writeV2Error(w http.ResponseWriter, status int, message string) {
+	code, ok := statusErrorCodes[status]
+	if !ok {
+		code = errorCodeInternal
+	}
+	raw, _ := json.Marshal(errorEnvelope{Error: apiError{Code: code, Message: message}})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(raw)
+}
+
+// Decodes the JSON request body into value, answering a 400 if that fails.
+func readV2JSON(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxV2BodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(value)
+	if err != nil {
+		writeV2Error(w, 400, "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// Like getMembership for v2, returning the user and their active DB.
+func (a *auth) getV2DB(w http.ResponseWriter, r *http.Request, need access) (user.User, user.DB, storage.DB) {
+	u, db, _, err := a.membership(r, need)
+	if err != nil {
+		writeV2Error(w, err.status, err.message)
+		return nil, user.DB{}, nil
+	}
+	return u, db, a.openDB(db.Path)
+}
+
+func newNoteJSON(db user.DB, f storage.File, withContent bool) noteJSON {
+	note := noteJSON{
+		ID:   f.ID().String(),
+		Name: f.Name(),
+		Path: strings.TrimPrefix(f.Path(), strings.TrimSuffix(db.Path, "/")+"/"),
+	}
+	if withContent {
+		content := f.Content()
+		note.Content = &content
+	}
+	return note
+}
+
+// Returns the note the URL points at, answering the error if there isn't one.
+func loadV2Note(w http.ResponseWriter, r *http.Request, db storage.DB) storage.File {
+	rawID := strings.TrimPrefix(r.URL.Path, "/api/2/notes/")
+	fileID, err := uuid.Parse(rawID)
+	if err != nil {
+		writeV2Error(w, 400, fmt.Sprintf("Invalid note ID %q", rawID))
+		return nil
+	}
+	f, err := db.LoadFile(fileID)
+	if err == storage.ErrFileNotFound {
+		writeV2Error(w, 404, fmt.Sprintf("No note with ID %s", fileID))
+		return nil
+	}
+	if err != nil {
+		writeV2Error(w, 500, err.Error())
+		return nil
+	}
+	return f
+}
+
+func v2TreeHandler(a *auth) v2Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, _, db := a.getV2DB(w, r, accessReadNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		tree, err := db.AsJSON()
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+		if tree == nil {
+			tree = []*storage.JSONFile{}
+		}
+		writeV2JSON(w, 200, treeJSON{Tree: tree})
+	}
+}
+
+func v2SearchHandler(a *auth) v2Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, dbInfo, db := a.getV2DB(w, r, accessReadNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		var request searchRequestJSON
+		if !readV2JSON(w, r, &request) {
+			return
+		}
+		if request.Query == "" {
+			writeV2Error(w, 400, "The query can't be empty")
+			return
+		}
+		if request.Limit <= 0 {
+			request.Limit = 5
+		}
+
+		results, err := db.Search(request.Query, storage.SearchOptions{Limit: request.Limit})
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+		notes := make([]noteJSON, len(results))
+		for i, result := range results {
+			notes[i] = newNoteJSON(dbInfo, result, false)
+		}
+		writeV2JSON(w, 200, notesJSON{Notes: notes})
+	}
+}
+
+func v2GetNoteHandler(a *auth) v2Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, dbInfo, db := a.getV2DB(w, r, accessReadNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		f := loadV2Note(w, r, db)
+		if f == nil {
+			return
+		}
+		a.recordAction(r, u, audit.ActionLoad, f.ID().String(), "")
+		writeV2JSON(w, 200, newNoteJSON(dbInfo, f, true))
+	}
+}
+
+func v2CreateNoteHandler(a *auth, commits commitPolicy) v2Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, dbInfo, db := a.getV2DB(w, r, accessWriteNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		var request createNoteJSON
+		if !readV2JSON(w, r, &request) {
+			return
+		}
+
+		f, err := db.CreateFile(request.Path, request.Content)
+		if _, ok := err.(*storage.InvalidPathError); ok {
+			writeV2Error(w, 400, err.Error())
+			return
+		}
+		if err == storage.ErrFileExists {
+			writeV2Error(w, 409, fmt.Sprintf("%s already exists", request.Path))
+			return
+		}
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+		err = commits.commitAsUser(db, u, commitpolicy.OperationCreate, path.Base(request.Path), uuid.Nil)
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+		a.recordAction(r, u, audit.ActionCreate, f.ID().String(), request.Path)
+
+		w.Header().Set("Location", "/api/2/notes/"+f.ID().String())
+		writeV2JSON(w, 201, newNoteJSON(dbInfo, f, true))
+	}
+}
+
+func v2UpdateNoteHandler(a *auth, commits commitPolicy) v2Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, dbInfo, db := a.getV2DB(w, r, accessWriteNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		f := loadV2Note(w, r, db)
+		if f == nil {
+			return
+		}
+		var request updateNoteJSON
+		if !readV2JSON(w, r, &request) {
+			return
+		}
+		if request.Content == nil {
+			writeV2Error(w, 400, "The content is required")
+			return
+		}
+
+		f.Update(*request.Content)
+		err := db.SaveFile(f)
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+		err = commits.commitAsUser(db, u, commitpolicy.OperationEdit, f.Name(), f.ID())
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+		a.recordAction(r, u, audit.ActionEdit, f.ID().String(), "")
+		writeV2JSON(w, 200, newNoteJSON(dbInfo, f, true))
+	}
+}
+
+func v2MoveNoteHandler(a *auth, commits commitPolicy) v2Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, dbInfo, db := a.getV2DB(w, r, accessWriteNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		f := loadV2Note(w, r, db)
+		if f == nil {
+			return
+		}
+		var request moveNoteJSON
+		if !readV2JSON(w, r, &request) {
+			return
+		}
+
+		moved, err := db.MoveFile(f.ID(), request.Path)
+		if _, ok := err.(*storage.InvalidPathError); ok {
+			writeV2Error(w, 400, err.Error())
+			return
+		}
+		if err == storage.ErrFileExists {
+			writeV2Error(w, 409, fmt.Sprintf("%s already exists", request.Path))
+			return
+		}
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+		err = commits.commitAsUser(db, u, commitpolicy.OperationMove, moved.Name(), uuid.Nil)
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+		a.recordAction(r, u, audit.ActionMove, moved.ID().String(), request.Path)
+		writeV2JSON(w, 200, newNoteJSON(dbInfo, moved, true))
+	}
+}
+
+func v2DeleteNoteHandler(a *auth, commits commitPolicy) v2Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, _, db := a.getV2DB(w, r, accessWriteNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		f := loadV2Note(w, r, db)
+		if f == nil {
+			return
+		}
+
+		err := db.DeleteFile(f.ID())
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+		err = commits.commitAsUser(db, u, commitpolicy.OperationDelete, f.Name(), uuid.Nil)
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+		a.recordAction(r, u, audit.ActionDelete, f.ID().String(), "")
+		w.WriteHeader(204)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"medb/commitpolicy"
+	"medb/server/acl"
+	"medb/server/audit"
+	"medb/server/events"
+	"medb/server/session"
+	"medb/server/share"
+	"medb/server/user"
+	"medb/storage"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	handler       http.Handler
+	dbPath        string
+	usersFilePath string
+	writeToken    string
+	readToken     string
+	cleanUp       func()
+}
+
+// A server with both APIs and one user, alice, whose DB is a new git repo
+// with a bare origin. Has tokens for her that can write and only read.
+func newTestServer(t *testing.T) testServer {
+	dir, err := ioutil.TempDir("", "medb-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := path.Join(dir, "db")
+	originPath := path.Join(dir, "origin.git")
+	for _, p := range []string{dbPath, originPath} {
+		err = os.MkdirAll(p, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(output), err)
+		}
+	}
+	git(originPath, "init", "-q", "--bare", "-b", "master")
+	git(dbPath, "init", "-q", "-b", "master")
+	git(dbPath, "config", "user.name", "MeDB Test")
+	git(dbPath, "config", "user.email", "test@medb.example")
+	git(dbPath, "remote", "add", "origin", originPath)
+	git(dbPath, "commit", "-q", "--allow-empty", "-m", "Start")
+	git(dbPath, "push", "-q", "-u", "origin", "master")
+
+	usersFilePath := path.Join(dir, "users.csv")
+	users := user.NewWritableStore(usersFilePath)
+	err = users.Add("alice", "hunter2", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeToken, _, err := users.CreateToken("alice", "write", user.ScopeReadWrite, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	readToken, _, err := users.CreateToken("alice", "read", user.ScopeReadOnly, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := session.NewStore("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := share.NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits, err := newCommitPolicy(commitpolicy.DefaultMessageTemplate, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newAuth(sessions, users, acl.NewStore(""), audit.NewLog(""), events.NewHub(), nil, nil)
+	mux := http.NewServeMux()
+	registerAPIV1(mux, a, shares, commits, newCollabManager(commits, users, time.Hour), nil, storage.HistoryOptions{})
+	registerAPIV2(mux, a, commits)
+	registerDAV(mux, a, commits)
+	return testServer{
+		handler:       csrfProtect(mux),
+		dbPath:        dbPath,
+		usersFilePath: usersFilePath,
+		writeToken:    writeToken,
+		readToken:     readToken,
+		cleanUp:       func() { os.RemoveAll(dir) },
+	}
+}
+
+func TestAPIV2(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	server, writeToken, readToken := ts.handler, ts.writeToken, ts.readToken
+
+	// Sends the request and decodes the response into value, if it isn't nil
+	call := func(method string, url string, token string, body string, expectedStatus int, value interface{}) {
+		r := httptest.NewRequest(method, "http://medb.example"+url, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != expectedStatus {
+			t.Fatalf("%s %s: expected %d, got %d: %s", method, url, expectedStatus, w.Code, w.Body.String())
+		}
+		if value != nil {
+			err := json.Unmarshal(w.Body.Bytes(), value)
+			if err != nil {
+				t.Fatalf("%s %s: %v: %s", method, url, err, w.Body.String())
+			}
+		}
+	}
+	// Every error has the same envelope
+	expectError := func(method string, url string, token string, body string, expectedStatus int, code string) {
+		var envelope errorEnvelope
+		call(method, url, token, body, expectedStatus, &envelope)
+		if envelope.Error.Code != code || envelope.Error.Message == "" {
+			t.Fatalf("%s %s: expected %s, got %+v", method, url, code, envelope)
+		}
+	}
+
+	expectError("GET", "/api/2/tree", "", "", 401, errorCodeUnauthorized)
+	expectError("GET", "/api/2/tree", "medb_wrong", "", 401, errorCodeUnauthorized)
+	expectError("GET", "/api/2/nothing", writeToken, "", 404, errorCodeNotFound)
+
+	var created noteJSON
+	call("POST", "/api/2/notes", writeToken, `{"path": "projects/ideas.md", "content": "one"}`, 201, &created)
+	if created.Path != "projects/ideas.md" || created.Name != "ideas.md" || *created.Content != "one" {
+		t.Fatal(created)
+	}
+	noteURL := "/api/2/notes/" + created.ID
+	expectError("POST", "/api/2/notes", writeToken, `{"path": "projects/ideas.md"}`, 409, errorCodeConflict)
+	expectError("POST", "/api/2/notes", writeToken, `{"path": "../escape.md"}`, 400, errorCodeBadRequest)
+	expectError("POST", "/api/2/notes", writeToken, `{"path": "a.md", "title": "a"}`, 400, errorCodeBadRequest)
+	expectError("POST", "/api/2/notes", writeToken, `path=a.md`, 400, errorCodeBadRequest)
+	expectError("POST", "/api/2/notes", readToken, `{"path": "a.md"}`, 403, errorCodeForbidden)
+
+	var note noteJSON
+	call("GET", noteURL, readToken, "", 200, &note)
+	if note.ID != created.ID || *note.Content != "one" {
+		t.Fatal(note)
+	}
+	call("PUT", noteURL, writeToken, `{"content": "two"}`, 200, &note)
+	call("GET", noteURL, readToken, "", 200, &note)
+	if *note.Content != "two" {
+		t.Fatal(note)
+	}
+	expectError("PUT", noteURL, writeToken, `{}`, 400, errorCodeBadRequest)
+	expectError("PUT", noteURL, readToken, `{"content": "three"}`, 403, errorCodeForbidden)
+	expectError("POST", noteURL, writeToken, `{"content": "three"}`, 405, errorCodeMethodNotAllowed)
+	expectError("GET", "/api/2/notes/not-a-uuid", readToken, "", 400, errorCodeBadRequest)
+
+	var tree treeJSON
+	call("GET", "/api/2/tree", readToken, "", 200, &tree)
+	if len(tree.Tree) != 1 || tree.Tree[0].Name != "projects" || tree.Tree[0].Contents[0].Id.String() != created.ID {
+		t.Fatal(tree)
+	}
+	var results notesJSON
+	call("POST", "/api/2/search", readToken, `{"query": "TWO"}`, 200, &results)
+	if len(results.Notes) != 1 || results.Notes[0].ID != created.ID || results.Notes[0].Content != nil {
+		t.Fatal(results)
+	}
+
+	call("PATCH", noteURL, writeToken, `{"path": "archive/ideas.md"}`, 200, &note)
+	if note.ID != created.ID || note.Path != "archive/ideas.md" || *note.Content != "two" {
+		t.Fatal(note)
+	}
+	expectError("PATCH", noteURL, writeToken, `{"path": "../ideas.md"}`, 400, errorCodeBadRequest)
+	expectError("PATCH", noteURL, readToken, `{"path": "ideas.md"}`, 403, errorCodeForbidden)
+
+	call("DELETE", noteURL, writeToken, "", 204, nil)
+	expectError("GET", noteURL, readToken, "", 404, errorCodeNotFound)
+	call("GET", "/api/2/tree", readToken, "", 200, &tree)
+	if len(tree.Tree) != 0 {
+		t.Fatal(tree)
+	}
+}
+
+func TestAPIV2CSRF(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	server := ts.handler
+
+	// Cookie sessions need the CSRF token, and are told so in the envelope
+	r := httptest.NewRequest("POST", "http://medb.example/api/2/notes", bytes.NewBufferString(`{"path": "a.md"}`))
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session"})
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	var envelope errorEnvelope
+	err := json.Unmarshal(w.Body.Bytes(), &envelope)
+	if err != nil || w.Code != 403 || envelope.Error.Code != errorCodeForbidden {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	err := json.Unmarshal([]byte(openAPIDocument), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, methods := range map[string][]string{
+		"/tree":       {"get"},
+		"/search":     {"post"},
+		"/notes":      {"post"},
+		"/notes/{id}": {"get", "put", "patch", "delete"},
+		"/changes":    {"get", "post"},
+	} {
+		for _, method := range methods {
+			if doc.Paths[p][method] == nil {
+				t.Fatalf("%s %s isn't documented", method, p)
+			}
+		}
+	}
+}
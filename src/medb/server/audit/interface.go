@@ -0,0 +1,62 @@
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+// The actions that are recorded
+const (
+	ActionLogin     = "login"
+	ActionLoginFail = "login-failed"
+	ActionAuthFail  = "auth-failed"
+	ActionLoad      = "load"
+	ActionEdit      = "edit"
+	ActionCreate    = "create"
+	ActionMove      = "move"
+	ActionDelete    = "delete"
+	ActionPush      = "push"
+	ActionPull      = "pull"
+	ActionShare     = "share"
+)
+
+// Log is an append-only record of who did what and when.
+type Log interface {
+	Record(event Event) error
+	// Returns the events matching the filter, newest first
+	Query(filter Filter) ([]Event, error)
+}
+
+// NewLog returns a log that appends JSON lines to filePath. If filePath is
+// empty, nothing is recorded.
+func NewLog(filePath string) Log {
+	return &logImpl{filePath: filePath, lock: &sync.Mutex{}}
+}
+
+type Event struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Username string    `json:"username,omitempty"`
+	RemoteIP string    `json:"remoteIP,omitempty"`
+	// The name of the user's DB the action was in
+	DB     string `json:"db,omitempty"`
+	FileID string `json:"fileID,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Filter selects events, empty fields match everything.
+type Filter struct {
+	Username string
+	Action   string
+	Since    time.Time
+	Until    time.Time
+	// The most events to return, 0 means no limit
+	Limit int
+}
+
+func (f Filter) matches(e Event) bool {
+	return (f.Username == "" || e.Username == f.Username) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "audit.jsonl")
+	log := NewLog(filePath)
+
+	start := time.Unix(1513066695, 0).UTC()
+	for i, event := range []Event{
+		{Action: ActionLogin, Username: "alice"},
+		{Action: ActionEdit, Username: "alice", FileID: "1"},
+		{Action: ActionLoginFail, Username: "bob", Detail: "wrong password"},
+		{Action: ActionEdit, Username: "bob", FileID: "2"},
+		{Action: ActionPush, Username: "alice"},
+	} {
+		event.Time = start.Add(time.Duration(i) * time.Minute)
+		err = log.Record(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// It's one JSON object per line
+	raw, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(raw)), "\n"); len(lines) != 5 {
+		t.Fatal(lines)
+	}
+
+	expectActions := func(filter Filter, expected ...string) {
+		events, err := log.Query(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions := make([]string, len(events))
+		for i, event := range events {
+			actions[i] = event.Action
+		}
+		if strings.Join(actions, ",") != strings.Join(expected, ",") {
+			t.Fatalf("%+v: expected %v, got %v", filter, expected, actions)
+		}
+	}
+	expectActions(Filter{}, ActionPush, ActionEdit, ActionLoginFail, ActionEdit, ActionLogin)
+	expectActions(Filter{Username: "alice"}, ActionPush, ActionEdit, ActionLogin)
+	expectActions(Filter{Action: ActionEdit, Limit: 1}, ActionEdit)
+	expectActions(Filter{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, ActionLoginFail, ActionEdit)
+
+	events, err := log.Query(Filter{Username: "bob", Action: ActionEdit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].FileID != "2" || !events[0].Time.Equal(start.Add(3*time.Minute)) {
+		t.Fatal(events)
+	}
+
+	// A line cut short by a crash is skipped
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"action":"pu`)
+	f.Close()
+	expectActions(Filter{Username: "alice", Limit: 1}, ActionPush)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"medb/server/acl"
+	"medb/server/audit"
+	"medb/server/events"
+	"medb/server/ratelimit"
+	"medb/server/session"
+	"medb/server/stopwatch"
+	"medb/server/user"
+	"medb/storage"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sessionCookieName = "medb_session"
+
+// auth resolves requests to the logged in user and their DB.
+type auth struct {
+	sessions session.Store
+	users    user.Store
+	members  acl.Store
+	audit    audit.Log
+	events   events.Hub
+	// Given to every DB that's opened, so that its commits are signed
+	signingKey *storage.SigningKey
+	// Usernames that can read the audit log
+	admins map[string]bool
+
+	challenges      *loginChallenges
+	usernameLimiter *ratelimit.Limiter
+	ipLimiter       *ratelimit.Limiter
+}
+
+func newAuth(
+	sessions session.Store,
+	users user.Store,
+	members acl.Store,
+	auditLog audit.Log,
+	hub events.Hub,
+	signingKey *storage.SigningKey,
+	admins []string,
+) *auth {
+	adminSet := make(map[string]bool)
+	for _, admin := range admins {
+		adminSet[admin] = true
+	}
+	return &auth{
+		sessions:        sessions,
+		users:           users,
+		members:         members,
+		audit:           auditLog,
+		events:          hub,
+		signingKey:      signingKey,
+		admins:          adminSet,
+		challenges:      newLoginChallenges(),
+		usernameLimiter: ratelimit.NewLimiter(usernameLimits),
+		ipLimiter:       ratelimit.NewLimiter(ipLimits),
+	}
+}
+
+// Starts a new session for the user and hands its ID to the client.
+func (a *auth) startSession(w http.ResponseWriter, r *http.Request, u user.User) error {
+	s, id, err := a.sessions.Create(u.Name(), r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Ends the request's session, if it has one.
+func (a *auth) endSession(w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		// No cookie means no session to end
+		return nil
+	}
+	err = a.sessions.Delete(cookie.Value)
+	if err == session.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Returns the request's session, or nil if there isn't a valid one.
+func (a *auth) getSession(r *http.Request) *session.Session {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	s, err := a.sessions.Get(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	return &s
+}
+
+// authError is why a request isn't allowed, and the status to answer it with.
+type authError struct {
+	status  int
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+var errNotLoggedIn = &authError{401, "Not logged in."}
+
+// v1 answers auth errors in plain text, and sends anyone who isn't logged in
+// to the login page.
+func writeAuthError(w http.ResponseWriter, r *http.Request, err *authError) {
+	if err == errNotLoggedIn {
+		// TODO: Consider returning something in JSON here anyway that indicates where to redirect to
+		// server-side rather than in the index file.
+		http.Redirect(w, r, "/login.html", 302)
+		return
+	}
+	http.Error(w, err.message, err.status)
+}
+
+// Returns the logged in user. If there isn't one, this redirects to the login
+// page and returns nil.
+func (a *auth) getUser(w http.ResponseWriter, r *http.Request) user.User {
+	u, _ := a.getUserAndSession(w, r)
+	return u
+}
+
+// Like getUser, but also returns the session.
+func (a *auth) getUserAndSession(w http.ResponseWriter, r *http.Request) (user.User, *session.Session) {
+	u, s, err := a.sessionUser(r)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return nil, nil
+	}
+	return u, s
+}
+
+// Returns the user of the request's session.
+func (a *auth) sessionUser(r *http.Request) (user.User, *session.Session, *authError) {
+	s := a.getSession(r)
+	if s == nil {
+		// User needs to login
+		return nil, nil, errNotLoggedIn
+	}
+	u, err := a.users.Lookup(s.Username)
+	if err != nil {
+		// The user was removed since they logged in
+		logger.Printf("Unable to look up user %s: %v", s.Username, err)
+		return nil, nil, errNotLoggedIn
+	}
+	return u, s, nil
+}
+
+// Returns the DB the session is working in. Tokens, and sessions that haven't
+// picked one or whose DB has since been removed, use the user's default.
+func activeDB(u user.User, s *session.Session) user.DB {
+	if s != nil {
+		db, ok := u.DB(s.ActiveDB)
+		if ok {
+			return db
+		}
+	}
+	return u.DBs()[0]
+}
+
+// What a request needs to be allowed to do. Browser sessions can do whatever
+// the user's role in the DB allows, personal access tokens only what their
+// scope allows on top of that.
+type access int
+
+const (
+	accessReadNotes access = iota
+	accessWriteNotes
+	accessReadGit
+	accessSync
+	accessManageMembers
+)
+
+var accessMinRole = map[access]acl.Role{
+	accessReadNotes:     acl.RoleViewer,
+	accessWriteNotes:    acl.RoleEditor,
+	accessReadGit:       acl.RoleViewer,
+	accessSync:          acl.RoleEditor,
+	accessManageMembers: acl.RoleOwner,
+}
+
+var tokenScopeAccess = map[string]map[access]bool{
+	user.ScopeReadOnly:  {accessReadNotes: true, accessReadGit: true},
+	user.ScopeReadWrite: {accessReadNotes: true, accessWriteNotes: true, accessReadGit: true},
+	user.ScopeGitSync:   {accessReadGit: true, accessSync: true},
+}
+
+// Returns the user making the request, from either a bearer token or the
+// session, as long as they're allowed the access. The session is nil for
+// tokens.
+func (a *auth) authenticate(r *http.Request, need access) (user.User, *session.Session, *authError) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return a.sessionUser(r)
+	}
+
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header {
+		return nil, nil, &authError{401, "Only bearer tokens are supported."}
+	}
+	u, t, err := a.users.LoginWithToken(strings.TrimSpace(token))
+	if err != nil {
+		logger.Printf("Failed token login from %s: %v", remoteIP(r), err)
+		a.record(r, audit.Event{Action: audit.ActionAuthFail, Detail: "invalid token"})
+		return nil, nil, &authError{401, "Invalid token."}
+	}
+	if !tokenScopeAccess[t.Scope][need] {
+		a.record(r, audit.Event{
+			Action:   audit.ActionAuthFail,
+			Username: u.Name(),
+			Detail:   fmt.Sprintf("%s token %s used for %s", t.Scope, t.ID, r.URL.Path),
+		})
+		return nil, nil, &authError{403, fmt.Sprintf("A %s token can't do this.", t.Scope)}
+	}
+	return u, nil, nil
+}
+
+// Returns the DB of the user making the request, as long as they're allowed
+// the access. If that isn't possible, this writes the response and returns nil.
+func (a *auth) getDB(w http.ResponseWriter, r *http.Request, need access) storage.DB {
+	_, db := a.getUserAndDB(w, r, need)
+	return db
+}
+
+// Like getDB, but also returns the user for handlers that need both.
+func (a *auth) getUserAndDB(w http.ResponseWriter, r *http.Request, need access) (user.User, storage.DB) {
+	u, db, _ := a.getMembership(w, r, need)
+	if u == nil {
+		return nil, nil
+	}
+	return u, a.openDB(db.Path)
+}
+
+// Opens the DB at the path so that subscribers hear about its changes.
+func (a *auth) openDB(dbPath string) storage.DB {
+	return events.NewNotifyingDB(a.events, dbPath, storage.NewSigningDB(dbPath, a.signingKey))
+}
+
+// Returns the user making the request, their active DB and their role in it,
+// as long as the role allows the access. Otherwise, this writes the response
+// and returns a nil user.
+func (a *auth) getMembership(w http.ResponseWriter, r *http.Request, need access) (user.User, user.DB, acl.Role) {
+	u, db, role, err := a.membership(r, need)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return nil, user.DB{}, ""
+	}
+	return u, db, role
+}
+
+// Like getMembership, but leaves answering errors to the caller.
+func (a *auth) membership(r *http.Request, need access) (user.User, user.DB, acl.Role, *authError) {
+	defer stopwatch.Start("getDB").Stop(logger)
+	u, s, authErr := a.authenticate(r, need)
+	if authErr != nil {
+		return nil, user.DB{}, "", authErr
+	}
+	db := activeDB(u, s)
+	role, authErr := a.checkRole(r, u, db, need)
+	if authErr != nil {
+		return nil, user.DB{}, "", authErr
+	}
+	return u, db, role, nil
+}
+
+// Returns the user's role in the DB, as long as it allows the access.
+func (a *auth) checkRole(r *http.Request, u user.User, db user.DB, need access) (acl.Role, *authError) {
+	role, err := a.members.Role(db.Path, u.Name())
+	if err == acl.ErrNotMember {
+		a.record(r, audit.Event{
+			Action:   audit.ActionAuthFail,
+			Username: u.Name(),
+			DB:       db.Name,
+			Detail:   "not a member, used for " + r.URL.Path,
+		})
+		return "", &authError{403, fmt.Sprintf("You aren't a member of %s.", db.Name)}
+	}
+	if err != nil {
+		return "", &authError{500, err.Error()}
+	}
+	if !role.Allows(accessMinRole[need]) {
+		a.record(r, audit.Event{
+			Action:   audit.ActionAuthFail,
+			Username: u.Name(),
+			DB:       db.Name,
+			Detail:   fmt.Sprintf("%s used for %s", role, r.URL.Path),
+		})
+		return "", &authError{403, fmt.Sprintf("A %s of %s can't do this.", role, db.Name)}
+	}
+	return role, nil
+}
+
+// Failed logins are limited per username, to protect each account, and more
+// loosely per IP, to slow down anyone trying many accounts.
+var (
+	usernameLimits = ratelimit.Config{
+		FreeFailures:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		ForgetAfter:     24 * time.Hour,
+	}
+	ipLimits = ratelimit.Config{
+		FreeFailures:    10,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    50,
+		LockoutDuration: time.Hour,
+		ForgetAfter:     24 * time.Hour,
+	}
+)
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Returns false, after writing a 429, if the request may not try a password
+// or code for username right now.
+func (a *auth) allowLoginAttempt(w http.ResponseWriter, r *http.Request, username string) bool {
+	for _, check := range []struct {
+		limiter *ratelimit.Limiter
+		key     string
+	}{
+		{a.usernameLimiter, username},
+		{a.ipLimiter, remoteIP(r)},
+	} {
+		allowed, wait := check.limiter.Allow(check.key)
+		if !allowed {
+			logger.Printf("Blocked login attempt for %q from %s, retry in %v", username, remoteIP(r), wait)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many failed attempts, try again later.", 429)
+			return false
+		}
+	}
+	return true
+}
+
+func (a *auth) loginFailed(r *http.Request, username string, reason string) {
+	logger.Printf("Failed login for %q from %s: %s", username, remoteIP(r), reason)
+	a.record(r, audit.Event{Action: audit.ActionLoginFail, Username: username, Detail: reason})
+	if a.usernameLimiter.Failure(username) {
+		logger.Printf("Locked out %q for %v", username, usernameLimits.LockoutDuration)
+	}
+	if a.ipLimiter.Failure(remoteIP(r)) {
+		logger.Printf("Locked out %s for %v", remoteIP(r), ipLimits.LockoutDuration)
+	}
+}
+
+func (a *auth) loginSucceeded(r *http.Request, username string) {
+	a.usernameLimiter.Success(username)
+	a.record(r, audit.Event{Action: audit.ActionLogin, Username: username})
+}
+
+// Adds the event to the audit log. Failing to is logged, but doesn't fail the
+// request.
+func (a *auth) record(r *http.Request, event audit.Event) {
+	event.Time = time.Now()
+	event.RemoteIP = remoteIP(r)
+	err := a.audit.Record(event)
+	if err != nil {
+		logger.Printf("Unable to record %s by %q in the audit log: %v", event.Action, event.Username, err)
+	}
+}
+
+// Records something the user did in their active DB. fileID may be empty.
+func (a *auth) recordAction(r *http.Request, u user.User, action string, fileID string, detail string) {
+	// Token requests always use the default DB, even if there's a cookie
+	var s *session.Session
+	if r.Header.Get("Authorization") == "" {
+		s = a.getSession(r)
+	}
+	a.record(r, audit.Event{
+		Action:   action,
+		Username: u.Name(),
+		DB:       activeDB(u, s).Name,
+		FileID:   fileID,
+		Detail:   detail,
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	loginChallengeCookieName = "medb_login_challenge"
+	loginChallengeLifetime   = 5 * time.Minute
+	maxLoginChallengeGuesses = 5
+)
+
+// loginChallenges tracks users that got their password right and still have
+// to enter their second factor. These only live in memory since they're short.
+type loginChallenges struct {
+	lock       sync.Mutex
+	challenges map[string]*loginChallenge
+}
+
+type loginChallenge struct {
+	username string
+	expires  time.Time
+	guesses  int
+}
+
+func newLoginChallenges() *loginChallenges {
+	return &loginChallenges{challenges: make(map[string]*loginChallenge)}
+}
+
+// Starts a challenge for the user and hands its ID to the client.
+func (c *loginChallenges) start(w http.ResponseWriter, r *http.Request, username string) error {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+	expires := time.Now().Add(loginChallengeLifetime)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, challenge := range c.challenges {
+		if time.Now().After(challenge.expires) {
+			delete(c.challenges, id)
+		}
+	}
+	c.challenges[id] = &loginChallenge{username: username, expires: expires}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookieName,
+		Value:    id,
+		Path:     "/api/1/login",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// Returns the username for the request's challenge, counting this as a guess.
+// Returns false if there's no challenge or it has run out of guesses.
+func (c *loginChallenges) guess(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(loginChallengeCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	challenge, ok := c.challenges[cookie.Value]
+	if !ok {
+		return "", false
+	}
+	challenge.guesses++
+	if time.Now().After(challenge.expires) || challenge.guesses > maxLoginChallengeGuesses {
+		delete(c.challenges, cookie.Value)
+		return "", false
+	}
+	return challenge.username, true
+}
+
+// Ends the request's challenge once it has been passed.
+func (c *loginChallenges) finish(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookieName,
+		Value:    "",
+		Path:     "/api/1/login",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	cookie, err := r.Cookie(loginChallengeCookieName)
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.challenges, cookie.Value)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"medb/client"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	server := httptest.NewServer(ts.handler)
+	defer server.Close()
+
+	c, err := client.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.List()
+	if err != client.ErrNotLoggedIn {
+		t.Fatal(err)
+	}
+	err = c.Login("alice", "wrong")
+	if clientErr, ok := err.(*client.Error); !ok || clientErr.StatusCode != 401 {
+		t.Fatal(err)
+	}
+	err = c.Login("alice", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	note, err := c.Create("projects/ideas.md", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Path != "projects/ideas.md" || note.Content != "one" {
+		t.Fatal(note)
+	}
+	entries, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "projects" || len(entries[0].Contents) != 1 {
+		t.Fatal(entries)
+	}
+	created := entries[0].Contents[0]
+	if !created.IsNote() || created.Name != "ideas.md" || created.ID != note.ID {
+		t.Fatal(created)
+	}
+
+	err = c.Edit(created.ID, "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err = c.Load(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.ID != created.ID || note.Content != "two" {
+		t.Fatal(note)
+	}
+	results, err := c.Search("two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != created.ID {
+		t.Fatal(results)
+	}
+
+	history, err := c.History(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Author != "alice" {
+		t.Fatal(history)
+	}
+	err = c.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.GitInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Remotes) != 1 || !info.Remotes[0].Tracked || info.Remotes[0].LocalAheadBy != 0 {
+		t.Fatal(info)
+	}
+
+	err = c.Logout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.List()
+	if err != client.ErrNotLoggedIn {
+		t.Fatal(err)
+	}
+}
+
+func TestClientWithToken(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	server := httptest.NewServer(ts.handler)
+	defer server.Close()
+
+	c, err := client.NewWithToken(server.URL, ts.writeToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := c.Create("ideas.md", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Create("ideas.md", "two")
+	if clientErr, ok := err.(*client.Error); !ok || clientErr.StatusCode != 409 || clientErr.Message != "ideas.md already exists" {
+		t.Fatal(err)
+	}
+	results, err := c.Search("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != created.ID {
+		t.Fatal(results)
+	}
+	moved, err := c.Move(created.ID, "archive/ideas.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Path != "archive/ideas.md" {
+		t.Fatal(moved)
+	}
+
+	// The token can't sync
+	err = c.Push()
+	if clientErr, ok := err.(*client.Error); !ok || clientErr.StatusCode != 403 {
+		t.Fatal(err)
+	}
+
+	c, err = client.NewWithToken(server.URL, ts.readToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Edit(results[0].ID, "two")
+	if clientErr, ok := err.(*client.Error); !ok || clientErr.StatusCode != 403 {
+		t.Fatal(err)
+	}
+	note, err := c.Load(results[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Content != "one" {
+		t.Fatal(note)
+	}
+	err = c.Delete(results[0].ID)
+	if clientErr, ok := err.(*client.Error); !ok || clientErr.StatusCode != 403 {
+		t.Fatal(err)
+	}
+}
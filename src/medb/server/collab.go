@@ -0,0 +1,127 @@
+package main
+
+import (
+	"medb/commitpolicy"
+	"medb/server/audit"
+	"medb/server/collab"
+	"medb/server/user"
+	"medb/storage"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultCollabSaveInterval = 10 * time.Second
+	// Ops carry whole inserts, so this is about the largest paste we take
+	collabMaxMessageSize = 1 << 20
+	collabWriteTimeout   = 10 * time.Second
+	// Clients that don't answer pings for longer than collabPongTimeout are
+	// gone
+	collabPingInterval = 30 * time.Second
+	collabPongTimeout  = 2 * collabPingInterval
+)
+
+// The default origin check only lets the UI's own pages connect, which keeps
+// other sites from using the session cookie.
+var collabUpgrader = websocket.Upgrader{}
+
+// Returns a manager whose sessions commit through the policy, as whoever
+// made the last change. That's what lets a run of saves coalesce.
+func newCollabManager(commits commitPolicy, users user.Store, saveInterval time.Duration) *collab.Manager {
+	return collab.NewManager(saveInterval, func(db storage.DB, f storage.File, editor string) error {
+		var u user.User
+		// They could have been removed since, then it's nobody in particular
+		if found, err := users.Lookup(editor); err == nil {
+			u = found
+		}
+		return commits.commitAsUser(db, u, commitpolicy.OperationEdit, f.Name(), f.ID())
+	})
+}
+
+// Joins the user to the editing session for the fileID in the query, over a
+// websocket that carries collab.Messages as JSON both ways.
+func collabHandler(a *auth, sessions *collab.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, dbInfo, _ := a.getMembership(w, r, accessWriteNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		fileID, err := uuid.Parse(r.URL.Query().Get("fileID"))
+		if err != nil {
+			http.Error(w, "unable to parse fileid", 400)
+			return
+		}
+		db := a.openDB(dbInfo.Path)
+		// Errors can't be answered like this once the connection is upgraded
+		_, err = db.LoadFile(fileID)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+
+		conn, err := collabUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader already answered the request
+			return
+		}
+		defer conn.Close()
+		p, err := sessions.Join(dbInfo.Path, db, fileID, collab.Presence{Username: u.Name(), Name: u.DisplayName()})
+		if err != nil {
+			conn.WriteJSON(collab.Message{Type: collab.MessageError, Error: err.Error()})
+			return
+		}
+		defer func() {
+			err := p.Leave()
+			if err != nil {
+				logger.Printf("Unable to save the collaborative edits to %s: %v", fileID, err)
+			}
+		}()
+		a.recordAction(r, u, audit.ActionEdit, fileID.String(), "collaborative")
+
+		go writeCollabMessages(conn, p)
+		conn.SetReadLimit(collabMaxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(collabPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(collabPongTimeout))
+		})
+		for {
+			var msg collab.Message
+			err = conn.ReadJSON(&msg)
+			if err != nil {
+				return
+			}
+			// Errors are sent back to the client, they don't end the session
+			p.Receive(msg)
+		}
+	}
+}
+
+// Sends the participant's messages until it leaves or is dropped, then closes
+// the connection so the reading stops too.
+func writeCollabMessages(conn *websocket.Conn, p *collab.Participant) {
+	defer conn.Close()
+	ping := time.NewTicker(collabPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case msg, ok := <-p.Messages():
+			conn.SetWriteDeadline(time.Now().Add(collabWriteTimeout))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if conn.WriteJSON(msg) != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(collabWriteTimeout))
+			if conn.WriteMessage(websocket.PingMessage, nil) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Operation is a change to a whole text, as a run of retains, inserts and
+// deletes that walk over it from the start. Lengths count runes. On the wire
+// it's an array where retains are positive numbers, deletes are negative and
+// inserts are strings.
+type Operation struct {
+	components []component
+	// The length of the text it applies to, and of the result
+	baseLen   int
+	targetLen int
+}
+
+// Exactly one of the fields is set.
+type component struct {
+	retain int
+	insert string
+	delete int
+}
+
+func (c component) isRetain() bool { return c.retain > 0 }
+func (c component) isInsert() bool { return c.insert != "" }
+func (c component) isDelete() bool { return c.delete > 0 }
+
+func (o *Operation) BaseLen() int   { return o.baseLen }
+func (o *Operation) TargetLen() int { return o.targetLen }
+
+// Skips over the next n runes.
+func (o *Operation) Retain(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+	o.baseLen += n
+	o.targetLen += n
+	if last := len(o.components) - 1; last >= 0 && o.components[last].isRetain() {
+		o.components[last].retain += n
+	} else {
+		o.components = append(o.components, component{retain: n})
+	}
+	return o
+}
+
+// Inserts s at the current position. Inserts always go before deletes at the
+// same position, so equal operations look the same.
+func (o *Operation) Insert(s string) *Operation {
+	if s == "" {
+		return o
+	}
+	o.targetLen += utf8.RuneCountInString(s)
+	last := len(o.components) - 1
+	switch {
+	case last >= 0 && o.components[last].isInsert():
+		o.components[last].insert += s
+	case last >= 0 && o.components[last].isDelete():
+		if last > 0 && o.components[last-1].isInsert() {
+			o.components[last-1].insert += s
+		} else {
+			o.components = append(o.components, o.components[last])
+			o.components[last] = component{insert: s}
+		}
+	default:
+		o.components = append(o.components, component{insert: s})
+	}
+	return o
+}
+
+// Deletes the next n runes.
+func (o *Operation) Delete(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+	o.baseLen += n
+	if last := len(o.components) - 1; last >= 0 && o.components[last].isDelete() {
+		o.components[last].delete += n
+	} else {
+		o.components = append(o.components, component{delete: n})
+	}
+	return o
+}
+
+// Returns true if applying the operation doesn't change anything.
+func (o *Operation) IsNoop() bool {
+	return len(o.components) == 0 || (len(o.components) == 1 && o.components[0].isRetain())
+}
+
+func (o *Operation) Apply(text string) (string, error) {
+	runes := []rune(text)
+	if len(runes) != o.baseLen {
+		return "", fmt.Errorf("the operation applies to %d runes, not %d", o.baseLen, len(runes))
+	}
+	result := make([]rune, 0, o.targetLen)
+	i := 0
+	for _, c := range o.components {
+		switch {
+		case c.isRetain():
+			result = append(result, runes[i:i+c.retain]...)
+			i += c.retain
+		case c.isInsert():
+			result = append(result, []rune(c.insert)...)
+		default:
+			i += c.delete
+		}
+	}
+	return string(result), nil
+}
+
+// Diff returns an operation that turns from into to, by replacing everything
+// between what they start and end with. That's enough for changes that
+// weren't made as operations.
+func Diff(from string, to string) *Operation {
+	a, b := []rune(from), []rune(to)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	return (&Operation{}).
+		Retain(prefix).
+		Delete(len(a) - prefix - suffix).
+		Insert(string(b[prefix : len(b)-suffix])).
+		Retain(suffix)
+}
+
+// Transform takes two operations made concurrently on the same text, and
+// returns a' and b' such that applying a then b' gives the same text as
+// applying b then a'. Where both insert at the same position, a goes first.
+func Transform(a *Operation, b *Operation) (*Operation, *Operation, error) {
+	if a.baseLen != b.baseLen {
+		return nil, nil, errors.New("the operations don't apply to the same text")
+	}
+	aPrime := &Operation{}
+	bPrime := &Operation{}
+	as, bs := a.components, b.components
+	var ac, bc *component
+	next := func(components *[]component) *component {
+		if len(*components) == 0 {
+			return nil
+		}
+		c := (*components)[0]
+		*components = (*components)[1:]
+		return &c
+	}
+	ac, bc = next(&as), next(&bs)
+
+	for ac != nil || bc != nil {
+		if ac != nil && ac.isInsert() {
+			aPrime.Insert(ac.insert)
+			bPrime.Retain(utf8.RuneCountInString(ac.insert))
+			ac = next(&as)
+			continue
+		}
+		if bc != nil && bc.isInsert() {
+			aPrime.Retain(utf8.RuneCountInString(bc.insert))
+			bPrime.Insert(bc.insert)
+			bc = next(&bs)
+			continue
+		}
+		if ac == nil || bc == nil {
+			return nil, nil, errors.New("the operations don't apply to the same text")
+		}
+
+		// Both are retains or deletes now, handle the overlap of the two
+		n := length(*ac)
+		if bn := length(*bc); bn < n {
+			n = bn
+		}
+		switch {
+		case ac.isRetain() && bc.isRetain():
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+		case ac.isDelete() && bc.isRetain():
+			aPrime.Delete(n)
+		case ac.isRetain() && bc.isDelete():
+			bPrime.Delete(n)
+		}
+		// Deleted by both, there's nothing left to do
+		if shorten(ac, n) {
+			ac = next(&as)
+		}
+		if shorten(bc, n) {
+			bc = next(&bs)
+		}
+	}
+	return aPrime, bPrime, nil
+}
+
+func length(c component) int {
+	if c.isRetain() {
+		return c.retain
+	}
+	return c.delete
+}
+
+// Takes n runes off the retain or delete, returning true if it's used up.
+func shorten(c *component, n int) bool {
+	if c.isRetain() {
+		c.retain -= n
+		return c.retain == 0
+	}
+	c.delete -= n
+	return c.delete == 0
+}
+
+// TransformIndex moves a position in the text the operation applies to, like
+// a cursor, to where it ends up after it.
+func TransformIndex(index int, o *Operation) int {
+	newIndex := index
+	for _, c := range o.components {
+		switch {
+		case c.isRetain():
+			index -= c.retain
+		case c.isInsert():
+			newIndex += utf8.RuneCountInString(c.insert)
+		default:
+			if index < c.delete {
+				newIndex -= index
+			} else {
+				newIndex -= c.delete
+			}
+			index -= c.delete
+		}
+		if index < 0 {
+			break
+		}
+	}
+	return newIndex
+}
+
+func (o *Operation) MarshalJSON() ([]byte, error) {
+	raw := make([]interface{}, len(o.components))
+	for i, c := range o.components {
+		switch {
+		case c.isRetain():
+			raw[i] = c.retain
+		case c.isInsert():
+			raw[i] = c.insert
+		default:
+			raw[i] = -c.delete
+		}
+	}
+	return json.Marshal(raw)
+}
+
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var raw []interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	*o = Operation{}
+	for _, value := range raw {
+		switch v := value.(type) {
+		case float64:
+			if v != float64(int(v)) || v == 0 {
+				return fmt.Errorf("invalid retain or delete %v", v)
+			}
+			if v > 0 {
+				o.Retain(int(v))
+			} else {
+				o.Delete(int(-v))
+			}
+		case string:
+			if v == "" {
+				return errors.New("empty insert")
+			}
+			o.Insert(v)
+		default:
+			return fmt.Errorf("invalid component %v", value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package collab
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"unicode/utf8"
+)
+
+var alphabet = []rune("abcé世 \n")
+
+func randomText(r *rand.Rand, maxLen int) string {
+	text := make([]rune, r.Intn(maxLen+1))
+	for i := range text {
+		text[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(text)
+}
+
+// Makes a random operation that applies to text.
+func randomOperation(r *rand.Rand, text string) *Operation {
+	o := &Operation{}
+	remaining := utf8.RuneCountInString(text)
+	for remaining > 0 || o.IsNoop() && r.Intn(3) > 0 {
+		n := 1
+		if remaining > 0 {
+			n = r.Intn(remaining) + 1
+		}
+		switch r.Intn(3) {
+		case 0:
+			if remaining > 0 {
+				o.Retain(n)
+				remaining -= n
+			}
+		case 1:
+			o.Insert(randomText(r, 3))
+		case 2:
+			if remaining > 0 {
+				o.Delete(n)
+				remaining -= n
+			}
+		}
+	}
+	return o
+}
+
+func TestApply(t *testing.T) {
+	o := (&Operation{}).Retain(2).Insert("世界").Delete(1).Retain(1)
+	result, err := o.Apply("héll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "hé世界l" || o.BaseLen() != 4 || o.TargetLen() != 5 {
+		t.Fatal(result, o.BaseLen(), o.TargetLen())
+	}
+	if _, err = o.Apply("hello"); err == nil {
+		t.Fatal("applied to the wrong length")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		text := randomText(r, 20)
+		a := randomOperation(r, text)
+		b := randomOperation(r, text)
+		aPrime, bPrime, err := Transform(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		afterA, err := a.Apply(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		afterB, err := b.Apply(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ab, err := bPrime.Apply(afterA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ba, err := aPrime.Apply(afterB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ab != ba {
+			t.Fatalf("%q: %q != %q", text, ab, ba)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		from, to := randomText(r, 12), randomText(r, 12)
+		if i%2 == 0 {
+			// Mostly the same, like an edit
+			runes := []rune(from)
+			to = string(runes[:len(runes)/2]) + to + string(runes[len(runes)/2:])
+		}
+		o := Diff(from, to)
+		applied, err := o.Apply(from)
+		if err != nil {
+			t.Fatal(from, to, err)
+		}
+		if applied != to {
+			t.Fatalf("%q to %q gave %q", from, to, applied)
+		}
+	}
+	if !Diff("same", "same").IsNoop() {
+		t.Fatal("Expected a noop")
+	}
+}
+
+func TestTransformIndex(t *testing.T) {
+	o := (&Operation{}).Retain(2).Insert("xy").Delete(2).Retain(2)
+	for index, expected := range []int{0, 1, 4, 4, 4, 5, 6} {
+		if moved := TransformIndex(index, o); moved != expected {
+			t.Fatalf("%d moved to %d, not %d", index, moved, expected)
+		}
+	}
+}
+
+func TestOperationJSON(t *testing.T) {
+	o := (&Operation{}).Retain(3).Insert("hi").Delete(2)
+	raw, err := json.Marshal(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `[3,"hi",-2]` {
+		t.Fatal(string(raw))
+	}
+	var decoded Operation
+	err = json.Unmarshal(raw, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.BaseLen() != 5 || decoded.TargetLen() != 5 {
+		t.Fatal(decoded)
+	}
+	for _, invalid := range []string{`[0]`, `[1.5]`, `[""]`, `[true]`, `{}`} {
+		if json.Unmarshal([]byte(invalid), &decoded) == nil {
+			t.Fatal("decoded", invalid)
+		}
+	}
+}
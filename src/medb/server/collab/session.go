@@ -0,0 +1,534 @@
+package collab
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"medb/storage"
+)
+
+// The types of messages
+const (
+	// To a client that just joined, with the content and who's there
+	MessageInit = "init"
+	// A change, both ways
+	MessageOp = "op"
+	// To a client, its change was applied as this revision
+	MessageAck = "ack"
+	// From a client, where its cursor is
+	MessageCursor = "cursor"
+	// To every client, when anyone joins, leaves or moves their cursor
+	MessagePresence = "presence"
+	// From a client, to save and commit what the session has right away
+	MessageSave = "save"
+	// To the client that asked for a save once it's done, with an error if
+	// it failed
+	MessageSaved = "saved"
+	MessageError = "error"
+)
+
+// How many messages a participant can fall behind by before it's dropped
+const participantBuffer = 512
+
+type Message struct {
+	Type string `json:"type"`
+	// The revision an op or cursor from a client applies to, otherwise the
+	// session's revision after the message
+	Revision     int        `json:"revision"`
+	Op           *Operation `json:"op,omitempty"`
+	Content      *string    `json:"content,omitempty"`
+	ClientID     string     `json:"clientID,omitempty"`
+	Cursor       *Cursor    `json:"cursor,omitempty"`
+	Participants []Presence `json:"participants,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// Cursor is a selection, in runes from the start of the text. Both ends are
+// the same without one.
+type Cursor struct {
+	Position     int `json:"position"`
+	SelectionEnd int `json:"selectionEnd"`
+}
+
+// Presence is who a participant is and where they are.
+type Presence struct {
+	ClientID string `json:"clientID"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	// Nil until they send one
+	Cursor *Cursor `json:"cursor,omitempty"`
+}
+
+// Manager keeps a session for every note that's being edited.
+type Manager struct {
+	lock     *sync.Mutex
+	sessions map[string]*Session
+	// How often sessions save their changes
+	saveInterval time.Duration
+	commit       func(db storage.DB, f storage.File, editor string) error
+}
+
+// NewManager returns a manager whose sessions save every saveInterval, and
+// then call commit with the note they saved and the username of whoever
+// made the last change to it.
+func NewManager(
+	saveInterval time.Duration,
+	commit func(db storage.DB, f storage.File, editor string) error,
+) *Manager {
+	return &Manager{
+		lock:         &sync.Mutex{},
+		sessions:     make(map[string]*Session),
+		saveInterval: saveInterval,
+		commit:       commit,
+	}
+}
+
+// Join adds someone to the session for the note, starting it if they're the
+// first. dbPath tells DBs apart, db is what the session saves through.
+func (m *Manager) Join(dbPath string, db storage.DB, fileID uuid.UUID, who Presence) (*Participant, error) {
+	key := sessionKey(dbPath, fileID)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.sessions[key]
+	for ok && s.closing {
+		// Wait for the last one out to save, otherwise we'd load the note
+		// from before that
+		m.lock.Unlock()
+		<-s.done
+		m.lock.Lock()
+		s, ok = m.sessions[key]
+	}
+	if !ok {
+		f, err := db.LoadFile(fileID)
+		if err != nil {
+			return nil, err
+		}
+		s = &Session{
+			manager:      m,
+			key:          key,
+			db:           db,
+			fileID:       fileID,
+			path:         strings.TrimPrefix(f.Path(), strings.TrimSuffix(dbPath, "/")+"/"),
+			lock:         &sync.Mutex{},
+			saveLock:     &sync.Mutex{},
+			content:      f.Content(),
+			savedContent: f.Content(),
+			participants: make(map[string]*Participant),
+			stop:         make(chan struct{}),
+			done:         make(chan struct{}),
+		}
+		m.sessions[key] = s
+		go s.saveRegularly(m.saveInterval)
+	}
+	return s.join(who), nil
+}
+
+// Editing returns true while there's a session for the note. Its text is
+// the session's then, the way to save it is to send MessageSave.
+func (m *Manager) Editing(dbPath string, fileID uuid.UUID) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.sessions[sessionKey(dbPath, fileID)]
+	return ok
+}
+
+func sessionKey(dbPath string, fileID uuid.UUID) string {
+	return dbPath + "\x00" + fileID.String()
+}
+
+// Session is everyone editing one note. Every op is applied in the order it
+// arrives, after being transformed past the ops its sender hadn't seen yet.
+type Session struct {
+	manager *Manager
+	key     string
+	db      storage.DB
+	fileID  uuid.UUID
+	// Relative to the root of the DB, where the note was when the session
+	// started
+	path string
+
+	lock         *sync.Mutex
+	content      string
+	history      []*Operation
+	participants map[string]*Participant
+	// The username of whoever made the last change
+	lastEditor string
+	// The revision that's on disk, and what its content is
+	savedRevision int
+	savedContent  string
+
+	// Only one save at a time
+	saveLock *sync.Mutex
+	stop     chan struct{}
+	// Set once the last participant left and the session is saving for the
+	// last time, guarded by the manager's lock. done is closed after that.
+	closing bool
+	done    chan struct{}
+}
+
+// Participant is one client in a session.
+type Participant struct {
+	session  *Session
+	presence Presence
+	outgoing chan Message
+	// Whether outgoing is closed, guarded by the session's lock
+	closed bool
+}
+
+func (s *Session) join(who Presence) *Participant {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	who.ClientID = uuid.New().String()
+	who.Cursor = nil
+	p := &Participant{
+		session:  s,
+		presence: who,
+		outgoing: make(chan Message, participantBuffer),
+	}
+	s.participants[who.ClientID] = p
+	content := s.content
+	p.send(Message{
+		Type:         MessageInit,
+		Revision:     len(s.history),
+		Content:      &content,
+		ClientID:     who.ClientID,
+		Participants: s.presence(),
+	})
+	s.broadcastPresence(p)
+	return p
+}
+
+// Messages are the ones to send to the client, it's closed once they've
+// left or fallen too far behind.
+func (p *Participant) Messages() <-chan Message {
+	return p.outgoing
+}
+
+func (p *Participant) ClientID() string {
+	return p.presence.ClientID
+}
+
+// Receive handles a message from the client. Errors are also sent back to it.
+func (p *Participant) Receive(msg Message) error {
+	s := p.session
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if p.closed {
+		return errors.New("no longer in the session")
+	}
+
+	var err error
+	switch msg.Type {
+	case MessageOp:
+		err = s.applyOp(p, msg.Revision, msg.Op)
+	case MessageCursor:
+		err = s.moveCursor(p, msg.Revision, msg.Cursor)
+	case MessageSave:
+		// Saving takes the lock, and a commit is too slow to hold it for
+		go s.saveFor(p)
+	default:
+		err = fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	if err != nil {
+		p.send(Message{Type: MessageError, Revision: len(s.history), Error: err.Error()})
+	}
+	return err
+}
+
+// Returns the ops since the revision, for transforming what the client sent
+// against. Must be called with the lock held.
+func (s *Session) opsSince(revision int) ([]*Operation, error) {
+	if revision < 0 || revision > len(s.history) {
+		return nil, fmt.Errorf("unknown revision %d", revision)
+	}
+	return s.history[revision:], nil
+}
+
+// Applies the op the participant made on the revision. A nil participant is
+// a change made outside the session. Must be called with the lock held.
+func (s *Session) applyOp(p *Participant, revision int, op *Operation) error {
+	if op == nil {
+		return errors.New("the op is missing")
+	}
+	concurrent, err := s.opsSince(revision)
+	if err != nil {
+		return err
+	}
+	for _, other := range concurrent {
+		op, _, err = Transform(op, other)
+		if err != nil {
+			return err
+		}
+	}
+	content, err := op.Apply(s.content)
+	if err != nil {
+		return err
+	}
+	s.content = content
+	s.history = append(s.history, op)
+	if p != nil {
+		s.lastEditor = p.presence.Username
+	}
+	for _, other := range s.participants {
+		if other.presence.Cursor != nil {
+			other.presence.Cursor.Position = TransformIndex(other.presence.Cursor.Position, op)
+			other.presence.Cursor.SelectionEnd = TransformIndex(other.presence.Cursor.SelectionEnd, op)
+		}
+	}
+
+	clientID := ""
+	if p != nil {
+		clientID = p.ClientID()
+		p.send(Message{Type: MessageAck, Revision: len(s.history)})
+	}
+	for _, other := range s.participants {
+		if other != p {
+			other.send(Message{Type: MessageOp, Revision: len(s.history), Op: op, ClientID: clientID})
+		}
+	}
+	return nil
+}
+
+func (s *Session) moveCursor(p *Participant, revision int, cursor *Cursor) error {
+	if cursor == nil {
+		return errors.New("the cursor is missing")
+	}
+	concurrent, err := s.opsSince(revision)
+	if err != nil {
+		return err
+	}
+	moved := *cursor
+	for _, other := range concurrent {
+		moved.Position = TransformIndex(moved.Position, other)
+		moved.SelectionEnd = TransformIndex(moved.SelectionEnd, other)
+	}
+	length := utf8.RuneCountInString(s.content)
+	moved.Position = clamp(moved.Position, 0, length)
+	moved.SelectionEnd = clamp(moved.SelectionEnd, 0, length)
+	p.presence.Cursor = &moved
+	s.broadcastPresence(nil)
+	return nil
+}
+
+func clamp(n int, min int, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// Must be called with the lock held.
+func (s *Session) presence() []Presence {
+	presence := make([]Presence, 0, len(s.participants))
+	for _, p := range s.participants {
+		who := p.presence
+		if who.Cursor != nil {
+			cursor := *who.Cursor
+			who.Cursor = &cursor
+		}
+		presence = append(presence, who)
+	}
+	return presence
+}
+
+// Tells everyone but skip who's there. Must be called with the lock held.
+func (s *Session) broadcastPresence(skip *Participant) {
+	presence := s.presence()
+	for _, p := range s.participants {
+		if p != skip {
+			p.send(Message{Type: MessagePresence, Revision: len(s.history), Participants: presence})
+		}
+	}
+}
+
+// Participants that fall too far behind are dropped, their client has to
+// join again. Must be called with the lock held.
+func (p *Participant) send(msg Message) {
+	if p.closed {
+		return
+	}
+	select {
+	case p.outgoing <- msg:
+	default:
+		p.drop()
+	}
+}
+
+// Must be called with the lock held.
+func (p *Participant) drop() {
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.outgoing)
+	delete(p.session.participants, p.ClientID())
+}
+
+// Leave takes the participant out of the session. The last one out saves
+// the note and ends the session.
+func (p *Participant) Leave() error {
+	s := p.session
+	m := s.manager
+	m.lock.Lock()
+	s.lock.Lock()
+	p.drop()
+	s.broadcastPresence(nil)
+	empty := len(s.participants) == 0
+	s.lock.Unlock()
+	if !empty || s.closing || m.sessions[s.key] != s {
+		m.lock.Unlock()
+		return nil
+	}
+	// Anyone joining waits for the save, without holding up other notes
+	s.closing = true
+	m.lock.Unlock()
+
+	close(s.stop)
+	err := s.save()
+	if err != nil {
+		err = s.saveCopy(err)
+	}
+
+	m.lock.Lock()
+	delete(m.sessions, s.key)
+	m.lock.Unlock()
+	close(s.done)
+	return err
+}
+
+func (s *Session) saveRegularly(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			// The next tick tries again
+			s.save()
+		}
+	}
+}
+
+// Writes the content to the note and commits it, if it changed since the
+// last save. A change made to the note outside the session since then is
+// taken in first, so that it isn't written over.
+func (s *Session) save() error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+
+	f, err := s.db.LoadFile(s.fileID)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	// The saved revision and content only change with the save lock held,
+	// which we have
+	edited := len(s.history) != s.savedRevision
+	if f.Content() != s.savedContent {
+		// Like an edit from someone who only had the saved revision
+		err = s.applyOp(nil, s.savedRevision, Diff(s.savedContent, f.Content()))
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+		if !edited {
+			// The note already has what the session has
+			s.savedRevision = len(s.history)
+			s.savedContent = s.content
+		}
+	}
+	content := s.content
+	revision := len(s.history)
+	editor := s.lastEditor
+	s.lock.Unlock()
+	if !edited {
+		return nil
+	}
+
+	f.Update(content)
+	err = s.db.SaveFile(f)
+	if err != nil {
+		return err
+	}
+	err = s.manager.commit(s.db, f, editor)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.savedRevision = revision
+	s.savedContent = content
+	s.lock.Unlock()
+	return nil
+}
+
+// Saves for the participant that asked, and tells them how it went.
+func (s *Session) saveFor(p *Participant) {
+	err := s.save()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	msg := Message{Type: MessageSaved, Revision: s.savedRevision}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	p.send(msg)
+}
+
+// When the last save fails, like when the note was deleted during the
+// session, the edits that weren't saved go to a new note next to it instead.
+// Returns saveErr, along with what happened to the edits.
+func (s *Session) saveCopy(saveErr error) error {
+	s.lock.Lock()
+	edited := len(s.history) != s.savedRevision
+	content := s.content
+	editor := s.lastEditor
+	s.lock.Unlock()
+	if !edited {
+		return saveErr
+	}
+
+	ext := path.Ext(s.path)
+	copyPath := fmt.Sprintf(
+		"%s (conflict %s)%s",
+		strings.TrimSuffix(s.path, ext),
+		time.Now().Format("2006-01-02 150405"),
+		ext,
+	)
+	f, err := s.db.CreateFile(copyPath, content)
+	if err == nil {
+		err = s.manager.commit(s.db, f, editor)
+	}
+	if err != nil {
+		return fmt.Errorf("%v, and unable to keep the edits in %s: %v", saveErr, copyPath, err)
+	}
+	return fmt.Errorf("%v, so the edits were kept in %s", saveErr, copyPath)
+}
+
+// Revision is how many ops the session has applied.
+func (s *Session) Revision() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.history)
+}
+
+func (s *Session) Content() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.content
+}
+
+func (p *Participant) Session() *Session {
+	return p.session
+}
@@ -0,0 +1,532 @@
+package collab
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"medb/storage"
+)
+
+// Creates a git repo with one note in it.
+func setUpNote(t *testing.T, content string) (storage.DB, string, uuid.UUID, func()) {
+	dir, err := ioutil.TempDir("", "medb-collab-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "master"},
+		{"config", "user.name", "MeDB Test"},
+		{"config", "user.email", "test@medb.example"},
+		{"commit", "-q", "--allow-empty", "-m", "Start"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(output), err)
+		}
+	}
+	db := storage.NewDB(dir)
+	f, err := db.CreateFile("notes/meeting.md", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, dir, f.ID(), func() { os.RemoveAll(dir) }
+}
+
+func commit(db storage.DB, f storage.File, editor string) error {
+	return db.CommitWithOptions("Collaborate on "+f.Name(), storage.CommitOptions{
+		Author: &storage.Author{Name: editor, Email: editor + "@medb.example"},
+	})
+}
+
+// A client that follows the protocol, but is driven by hand. It has one op
+// waiting for an ack at a time, and queues up the rest.
+type simulatedClient struct {
+	t           *testing.T
+	p           *Participant
+	content     string
+	revision    int
+	outstanding *Operation
+	buffer      []*Operation
+	others      []Presence
+	// How many saves it asked for were done
+	saved int
+}
+
+func newSimulatedClient(t *testing.T, p *Participant) *simulatedClient {
+	c := &simulatedClient{t: t, p: p}
+	c.receive(<-p.Messages())
+	return c
+}
+
+func (c *simulatedClient) receive(msg Message) {
+	switch msg.Type {
+	case MessageInit:
+		c.content = *msg.Content
+		c.revision = msg.Revision
+		c.others = msg.Participants
+	case MessageAck:
+		c.revision = msg.Revision
+		c.outstanding = nil
+		if len(c.buffer) > 0 {
+			c.outstanding = c.buffer[0]
+			c.buffer = c.buffer[1:]
+			c.send(c.outstanding)
+		}
+	case MessageOp:
+		c.revision = msg.Revision
+		op := msg.Op
+		var err error
+		if c.outstanding != nil {
+			c.outstanding, op, err = Transform(c.outstanding, op)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		for i := range c.buffer {
+			c.buffer[i], op, err = Transform(c.buffer[i], op)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		c.content, err = op.Apply(c.content)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	case MessagePresence:
+		c.others = msg.Participants
+	case MessageSaved:
+		if msg.Error != "" {
+			c.t.Fatal(msg.Error)
+		}
+		c.saved++
+	case MessageError:
+		c.t.Fatal(msg.Error)
+	}
+}
+
+func (c *simulatedClient) send(op *Operation) {
+	err := c.p.Receive(Message{Type: MessageOp, Revision: c.revision, Op: op})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *simulatedClient) edit(op *Operation) {
+	var err error
+	c.content, err = op.Apply(c.content)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if c.outstanding == nil {
+		c.outstanding = op
+		c.send(op)
+	} else {
+		c.buffer = append(c.buffer, op)
+	}
+}
+
+// Handles one message if there is one, returning false if there isn't.
+func (c *simulatedClient) deliverOne() bool {
+	select {
+	case msg, ok := <-c.p.Messages():
+		if !ok {
+			c.t.Fatal("dropped from the session")
+		}
+		c.receive(msg)
+		return true
+	default:
+		return false
+	}
+}
+
+// Edits from several clients are delivered in random orders, and everyone has
+// to end up with the same text.
+func TestConcurrentEditsConverge(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		db, dir, fileID, cleanUp := setUpNote(t, "The agenda\n")
+		m := NewManager(time.Hour, commit)
+		r := rand.New(rand.NewSource(seed))
+
+		clients := make([]*simulatedClient, 4)
+		for i := range clients {
+			p, err := m.Join(dir, db, fileID, Presence{Username: "user"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			clients[i] = newSimulatedClient(t, p)
+		}
+		for step := 0; step < 200; step++ {
+			c := clients[r.Intn(len(clients))]
+			if r.Intn(2) == 0 {
+				c.edit(randomOperation(r, c.content))
+			} else {
+				c.deliverOne()
+			}
+		}
+		// Let everything arrive
+		for delivered := true; delivered; {
+			delivered = false
+			for _, c := range clients {
+				for c.deliverOne() {
+					delivered = true
+				}
+			}
+		}
+
+		session := clients[0].p.Session()
+		for i, c := range clients {
+			if c.outstanding != nil || len(c.buffer) > 0 || c.revision != session.Revision() {
+				t.Fatalf("seed %d: client %d didn't catch up", seed, i)
+			}
+			if c.content != session.Content() {
+				t.Fatalf("seed %d: client %d has %q, not %q", seed, i, c.content, session.Content())
+			}
+		}
+		for _, c := range clients {
+			if err := c.p.Leave(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cleanUp()
+	}
+}
+
+func TestPresence(t *testing.T) {
+	db, dir, fileID, cleanUp := setUpNote(t, "0123456789")
+	defer cleanUp()
+	m := NewManager(time.Hour, commit)
+
+	pa, err := m.Join(dir, db, fileID, Presence{Username: "alice", Name: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newSimulatedClient(t, pa)
+	pb, err := m.Join(dir, db, fileID, Presence{Username: "bob", Name: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newSimulatedClient(t, pb)
+	a.deliverOne()
+	if len(a.others) != 2 || len(b.others) != 2 {
+		t.Fatal(a.others, b.others)
+	}
+
+	// Bob's cursor moves along with Alice's edit before it
+	err = pb.Receive(Message{Type: MessageCursor, Revision: b.revision, Cursor: &Cursor{Position: 5, SelectionEnd: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.deliverOne()
+	a.edit((&Operation{}).Insert("ab").Retain(10))
+	b.deliverOne()
+	b.deliverOne()
+	for _, who := range pb.Session().presence() {
+		if who.Username == "bob" && (who.Cursor == nil || who.Cursor.Position != 7 || who.Cursor.SelectionEnd != 9) {
+			t.Fatal(who.Cursor)
+		}
+	}
+
+	err = pa.Leave()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for b.deliverOne() {
+	}
+	if len(b.others) != 1 || b.others[0].Username != "bob" {
+		t.Fatal(b.others)
+	}
+	// What was already sent to Alice can still be read, then it ends
+	timeout := time.After(5 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-pa.Messages():
+		case <-timeout:
+			t.Fatal("alice still gets messages")
+		}
+	}
+	if err = pa.Receive(Message{Type: MessageCursor, Cursor: &Cursor{}}); err == nil {
+		t.Fatal("alice can still send")
+	}
+	pb.Leave()
+}
+
+func TestSaves(t *testing.T) {
+	db, dir, fileID, cleanUp := setUpNote(t, "one")
+	defer cleanUp()
+	m := NewManager(50*time.Millisecond, commit)
+
+	p, err := m.Join(dir, db, fileID, Presence{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newSimulatedClient(t, p)
+	c.edit((&Operation{}).Retain(3).Insert(" two"))
+	c.deliverOne()
+
+	// Saved while the session is still going, it might be mid-write
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f, err := db.LoadFile(fileID)
+		if err == nil && f.Content() == "one two" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not saved", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The last one out saves right away
+	c.edit((&Operation{}).Retain(7).Insert(" three"))
+	err = p.Leave()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := db.LoadFile(fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Content() != "one two three" {
+		t.Fatal(f.Content())
+	}
+	// By whoever made the last change
+	cmd := exec.Command("git", "log", "-1", "--format=%s by %an")
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil || strings.TrimSpace(string(output)) != "Collaborate on meeting.md by alice" {
+		t.Fatal(string(output), err)
+	}
+
+	// A new session starts from what was saved
+	p, err = m.Join(dir, db, fileID, Presence{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Leave()
+	if c = newSimulatedClient(t, p); c.content != "one two three" || c.revision != 0 {
+		t.Fatal(c.content, c.revision)
+	}
+}
+
+func TestSaveTakesInOutsideChanges(t *testing.T) {
+	db, dir, fileID, cleanUp := setUpNote(t, "one")
+	defer cleanUp()
+	m := NewManager(time.Hour, commit)
+
+	p, err := m.Join(dir, db, fileID, Presence{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newSimulatedClient(t, p)
+	c.edit((&Operation{}).Retain(3).Insert(" two"))
+	c.deliverOne()
+	// Someone saves the note through the API while it's being edited
+	saveOutside := func(content string) {
+		f, err := db.LoadFile(fileID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Update(content)
+		if err = db.SaveFile(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveOutside("zero one")
+
+	// Both changes are kept, and the participants get the outside one
+	err = p.Session().save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.deliverOne()
+	f, err := db.LoadFile(fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Content() != "zero one two" || c.content != "zero one two" {
+		t.Fatal(f.Content(), c.content)
+	}
+
+	// Also when the session has nothing new to save
+	saveOutside("zero one two three")
+	err = p.Session().save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.deliverOne()
+	if c.content != "zero one two three" || c.revision != p.Session().Revision() {
+		t.Fatal(c.content, c.revision)
+	}
+	if err = p.Leave(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveMessage(t *testing.T) {
+	db, dir, fileID, cleanUp := setUpNote(t, "one")
+	defer cleanUp()
+	m := NewManager(time.Hour, commit)
+
+	p, err := m.Join(dir, db, fileID, Presence{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Leave()
+	if !m.Editing(dir, fileID) || m.Editing(dir, uuid.New()) {
+		t.Fatal("wrong notes being edited")
+	}
+	c := newSimulatedClient(t, p)
+	c.edit((&Operation{}).Retain(3).Insert(" two"))
+	err = p.Receive(Message{Type: MessageSave, Revision: c.revision})
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for c.saved == 0 {
+		select {
+		case msg := <-p.Messages():
+			c.receive(msg)
+		case <-timeout:
+			t.Fatal("not saved")
+		}
+	}
+	f, err := db.LoadFile(fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Content() != "one two" {
+		t.Fatal(f.Content())
+	}
+}
+
+func TestLeaveKeepsEditsToADeletedNote(t *testing.T) {
+	db, dir, fileID, cleanUp := setUpNote(t, "one")
+	defer cleanUp()
+	m := NewManager(time.Hour, commit)
+
+	p, err := m.Join(dir, db, fileID, Presence{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSimulatedClient(t, p).edit((&Operation{}).Retain(3).Insert(" two"))
+	err = db.DeleteFile(fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Leave(); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	files, err := db.AllFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.HasPrefix(files[0].Name(), "meeting (conflict ") || files[0].Content() != "one two" {
+		t.Fatal(files)
+	}
+}
+
+// The last one out saves without holding up sessions for other notes, and
+// anyone joining the same note waits to get what was saved.
+func TestLeaveSavesOutsideTheManagerLock(t *testing.T) {
+	db, dir, fileID, cleanUp := setUpNote(t, "one")
+	defer cleanUp()
+	otherDB, otherDir, otherFileID, otherCleanUp := setUpNote(t, "other")
+	defer otherCleanUp()
+	saving := make(chan struct{})
+	release := make(chan struct{})
+	m := NewManager(time.Hour, func(db storage.DB, f storage.File, editor string) error {
+		if f.ID() == fileID {
+			close(saving)
+			<-release
+		}
+		return commit(db, f, editor)
+	})
+
+	p, err := m.Join(dir, db, fileID, Presence{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSimulatedClient(t, p).edit((&Operation{}).Retain(3).Insert(" two"))
+	left := make(chan error)
+	go func() {
+		left <- p.Leave()
+	}()
+	<-saving
+
+	joined := make(chan *Participant)
+	go func() {
+		other, err := m.Join(otherDir, otherDB, otherFileID, Presence{Username: "bob"})
+		if err != nil {
+			t.Error(err)
+		}
+		joined <- other
+	}()
+	select {
+	case other := <-joined:
+		other.Leave()
+	case <-time.After(5 * time.Second):
+		t.Fatal("joining another note waited for the save")
+	}
+
+	go func() {
+		again, err := m.Join(dir, db, fileID, Presence{Username: "alice"})
+		if err != nil {
+			t.Error(err)
+		}
+		joined <- again
+	}()
+	select {
+	case <-joined:
+		t.Fatal("joined before the note was saved")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err = <-left; err != nil {
+		t.Fatal(err)
+	}
+	again := <-joined
+	defer again.Leave()
+	if c := newSimulatedClient(t, again); c.content != "one two" {
+		t.Fatal(c.content)
+	}
+}
+
+func TestInvalidMessages(t *testing.T) {
+	db, dir, fileID, cleanUp := setUpNote(t, "one")
+	defer cleanUp()
+	m := NewManager(time.Hour, commit)
+	if _, err := m.Join(dir, db, uuid.New(), Presence{}); err != storage.ErrFileNotFound {
+		t.Fatal(err)
+	}
+	p, err := m.Join(dir, db, fileID, Presence{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Leave()
+	<-p.Messages()
+
+	for _, msg := range []Message{
+		{Type: "shout"},
+		{Type: MessageOp, Revision: 0},
+		{Type: MessageOp, Revision: 1, Op: (&Operation{}).Retain(3)},
+		{Type: MessageOp, Revision: 0, Op: (&Operation{}).Retain(utf8.RuneCountInString("one") + 1)},
+		{Type: MessageCursor, Revision: 0},
+	} {
+		if p.Receive(msg) == nil {
+			t.Fatal("accepted", msg)
+		}
+		if reply := <-p.Messages(); reply.Type != MessageError || reply.Error == "" {
+			t.Fatal(reply)
+		}
+	}
+}
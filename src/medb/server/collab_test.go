@@ -0,0 +1,148 @@
+package main
+
+import (
+	"medb/server/collab"
+	"medb/storage"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCollab(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	server := httptest.NewServer(ts.handler)
+	defer server.Close()
+	f, err := storage.NewDB(ts.dbPath).CreateFile("notes/meeting.md", "agenda")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/1/collab?fileID=" + f.ID().String()
+	dial := func(token string) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		header.Set("Authorization", "Bearer "+token)
+		return websocket.DefaultDialer.Dial(url, header)
+	}
+	read := func(conn *websocket.Conn, messageType string) collab.Message {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var msg collab.Message
+			err := conn.ReadJSON(&msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type == messageType {
+				return msg
+			}
+		}
+	}
+
+	// Only editors can join
+	_, resp, err := dial(ts.readToken)
+	if err == nil || resp.StatusCode != 403 {
+		t.Fatal("joined with a read only token", err)
+	}
+
+	alice, _, err := dial(ts.writeToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := read(alice, collab.MessageInit)
+	if joined.Content == nil || *joined.Content != "agenda" || len(joined.Participants) != 1 {
+		t.Fatal(joined)
+	}
+	if joined.Participants[0].Username != "alice" {
+		t.Fatal(joined.Participants)
+	}
+	other, _, err := dial(ts.writeToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read(other, collab.MessageInit)
+
+	err = alice.WriteJSON(collab.Message{
+		Type:     collab.MessageOp,
+		Revision: joined.Revision,
+		Op:       (&collab.Operation{}).Retain(6).Insert(" and minutes"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack := read(alice, collab.MessageAck); ack.Revision != 1 {
+		t.Fatal(ack)
+	}
+	op := read(other, collab.MessageOp)
+	if content, err := op.Op.Apply("agenda"); err != nil || content != "agenda and minutes" {
+		t.Fatal(content, err)
+	}
+
+	// Mistakes are answered without ending the session
+	err = alice.WriteJSON(collab.Message{Type: collab.MessageOp, Revision: 7, Op: &collab.Operation{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read(alice, collab.MessageError)
+
+	// Saving the whole note over the session is refused, it's saved through
+	// the session instead
+	edit, err := http.NewRequest(
+		"POST",
+		server.URL+"/api/1/edit",
+		strings.NewReader("fileID="+f.ID().String()+"&fileContent=agenda"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	edit.Header.Set("Authorization", "Bearer "+ts.writeToken)
+	resp, err = http.DefaultClient.Do(edit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 409 {
+		t.Fatal(resp.Status)
+	}
+	err = alice.WriteJSON(collab.Message{Type: collab.MessageSave, Revision: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved := read(alice, collab.MessageSaved); saved.Error != "" || saved.Revision != 1 {
+		t.Fatal(saved)
+	}
+
+	// The note is saved and committed once everyone is gone
+	alice.Close()
+	read(other, collab.MessagePresence)
+	other.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f, err = storage.NewDB(ts.dbPath).LoadFile(f.ID())
+		if err == nil && f.Content() == "agenda and minutes" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not saved", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The commit might still be running. It's by alice, who made the change.
+	for {
+		cmd := exec.Command("git", "log", "-1", "--format=%s by %an")
+		cmd.Dir = ts.dbPath
+		output, err := cmd.Output()
+		if err == nil && strings.TrimSpace(string(output)) == "MeDB Sync - edit meeting.md by alice" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(string(output), err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"medb/commitpolicy"
+	"medb/server/user"
+	"medb/storage"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// commitPolicy decides how the server commits changes made through the API.
+type commitPolicy struct {
+	commitpolicy.Policy
+}
+
+func newCommitPolicy(
+	messageTemplate string,
+	coalesceWindow time.Duration,
+	signingKey *storage.SigningKey,
+) (commitPolicy, error) {
+	p, err := commitpolicy.New(messageTemplate, coalesceWindow, signingKey)
+	if err != nil {
+		return commitPolicy{}, err
+	}
+	return commitPolicy{p}, nil
+}
+
+// Commits everything in the db on behalf of the user, if we know who they are.
+// noteID should be uuid.Nil unless the change is to a single existing note.
+func (c commitPolicy) commitAsUser(
+	db storage.DB,
+	u user.User,
+	operation string,
+	title string,
+	noteID uuid.UUID,
+) error {
+	if u == nil {
+		return c.Commit(db, nil, "", operation, title, noteID)
+	}
+	author := &storage.Author{Name: u.DisplayName(), Email: u.Email()}
+	return c.Commit(db, author, u.Name(), operation, title, noteID)
+}
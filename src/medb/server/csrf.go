@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	csrfCookieName = "medb_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// The login forms are plain HTML and can't send the header. Cross-site posts
+// to them are still stopped by the origin check.
+var csrfFormPaths = map[string]bool{
+	"/api/1/login":      true,
+	"/api/1/login/totp": true,
+}
+
+// csrfProtect makes sure every client has a CSRF cookie, and that every
+// request that can change state came from our own pages. Those have to send
+// the cookie's value back in the X-CSRF-Token header, which other sites can't
+// read, and mustn't come from another origin.
+func csrfProtect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(csrfCookieName)
+		if err != nil || cookie.Value == "" {
+			cookie, err = issueCSRFCookie(w, r)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+
+		if !isSafeMethod(r.Method) {
+			if !sameOrigin(r) {
+				logger.Printf(
+					"Rejected cross-site %s to %s with origin %q and referer %q",
+					r.Method,
+					r.URL.Path,
+					r.Header.Get("Origin"),
+					r.Header.Get("Referer"),
+				)
+				rejectRequest(w, r, "Cross-site requests aren't allowed.")
+				return
+			}
+			if !csrfFormPaths[r.URL.Path] && !isTokenRequest(r) && !isDAVRequest(r) {
+				header := r.Header.Get(csrfHeaderName)
+				if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+					rejectRequest(w, r, "Missing or invalid CSRF token.")
+					return
+				}
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Answers a 403 in whichever format the API version uses.
+func rejectRequest(w http.ResponseWriter, r *http.Request, message string) {
+	if strings.HasPrefix(r.URL.Path, apiV2Prefix) {
+		writeV2Error(w, 403, message)
+		return
+	}
+	http.Error(w, message, 403)
+}
+
+func issueCSRFCookie(w http.ResponseWriter, r *http.Request) (*http.Cookie, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+	cookie := &http.Cookie{
+		Name:  csrfCookieName,
+		Value: base64.RawURLEncoding.EncodeToString(raw),
+		Path:  "/",
+		// Our pages have to read this to send it back
+		HttpOnly: false,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, cookie)
+	return cookie, nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// Requests authenticated by a personal access token instead of a session
+// cookie can't be forged by another site, browsers won't add the header.
+func isTokenRequest(r *http.Request) bool {
+	if r.Header.Get("Authorization") == "" {
+		return false
+	}
+	_, err := r.Cookie(sessionCookieName)
+	return err != nil
+}
+
+// WebDAV clients never have the cookie, and are answered with a 401 that asks
+// them to log in. Only basic auth is taken there, not the session cookie.
+func isDAVRequest(r *http.Request) bool {
+	return r.URL.Path == davPrefix || strings.HasPrefix(r.URL.Path, davPrefix+"/")
+}
+
+// Returns false if the browser says the request came from another origin. Not
+// every client sends Origin or Referer, those are left to the token check.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Only lets the handler see requests with one of the methods, anything else
+// gets a 405. GET also allows HEAD.
+func allowMethods(
+	handler func(w http.ResponseWriter, r *http.Request),
+	methods ...string,
+) func(w http.ResponseWriter, r *http.Request) {
+	allowed := make(map[string]bool)
+	for _, method := range methods {
+		allowed[method] = true
+		if method == "GET" {
+			allowed["HEAD"] = true
+		}
+	}
+	allowHeader := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowed[r.Method] {
+			w.Header().Set("Allow", allowHeader)
+			http.Error(w, "Method not allowed.", 405)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// The common cases of allowMethods
+func get(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return allowMethods(handler, "GET")
+}
+
+func post(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return allowMethods(handler, "POST")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Serves a protected mux like main does, recording whether the handler ran.
+func newCSRFTestServer(handled *bool) http.Handler {
+	mux := http.NewServeMux()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		*handled = true
+	}
+	mux.HandleFunc("/api/1/list", get(handler))
+	mux.HandleFunc("/api/1/edit", post(handler))
+	mux.HandleFunc("/api/1/login", post(handler))
+	return csrfProtect(mux)
+}
+
+func csrfCookieFrom(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == csrfCookieName {
+			return cookie
+		}
+	}
+	t.Fatal("no CSRF cookie was issued")
+	return nil
+}
+
+func TestCSRFProtection(t *testing.T) {
+	var handled bool
+	server := newCSRFTestServer(&handled)
+	serve := func(r *http.Request, expectedCode int) *httptest.ResponseRecorder {
+		handled = false
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != expectedCode || handled != (expectedCode == 200) {
+			t.Fatalf("%s %s: expected %d, got %d, handled %v", r.Method, r.URL, expectedCode, w.Code, handled)
+		}
+		return w
+	}
+	sessionCookie := &http.Cookie{Name: sessionCookieName, Value: "session"}
+
+	// Loading a page hands out the token
+	w := serve(httptest.NewRequest("GET", "http://medb.example/api/1/list", nil), 200)
+	csrfCookie := csrfCookieFrom(t, w)
+
+	newEdit := func() *http.Request {
+		r := httptest.NewRequest("POST", "http://medb.example/api/1/edit", strings.NewReader("fileContent=pwned"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(sessionCookie)
+		r.AddCookie(csrfCookie)
+		return r
+	}
+
+	// A form on another site can send the cookies, but can't read the token
+	r := newEdit()
+	r.Header.Set("Origin", "http://evil.example")
+	serve(r, 403)
+	r = newEdit()
+	serve(r, 403)
+	r = newEdit()
+	r.Header.Set(csrfHeaderName, "guessed")
+	serve(r, 403)
+
+	// Even with the token, another origin is rejected
+	r = newEdit()
+	r.Header.Set(csrfHeaderName, csrfCookie.Value)
+	r.Header.Set("Origin", "http://evil.example")
+	serve(r, 403)
+	r = newEdit()
+	r.Header.Set(csrfHeaderName, csrfCookie.Value)
+	r.Header.Set("Referer", "http://evil.example/page")
+	serve(r, 403)
+
+	// Our own pages send it back
+	r = newEdit()
+	r.Header.Set(csrfHeaderName, csrfCookie.Value)
+	r.Header.Set("Origin", "http://medb.example")
+	serve(r, 200)
+
+	// Token clients don't have a session cookie to abuse
+	r = httptest.NewRequest("POST", "http://medb.example/api/1/edit", nil)
+	r.Header.Set("Authorization", "Bearer medb_token")
+	serve(r, 200)
+	r = newEdit()
+	r.Header.Set("Authorization", "Bearer medb_token")
+	serve(r, 403)
+
+	// The login form can't send the header, but is still limited to our origin
+	r = httptest.NewRequest("POST", "http://medb.example/api/1/login", nil)
+	r.Header.Set("Origin", "http://medb.example")
+	serve(r, 200)
+	r = httptest.NewRequest("POST", "http://medb.example/api/1/login", nil)
+	r.Header.Set("Origin", "http://evil.example")
+	serve(r, 403)
+}
+
+func TestMethodRestrictions(t *testing.T) {
+	var handled bool
+	server := newCSRFTestServer(&handled)
+
+	for _, test := range []struct {
+		method       string
+		path         string
+		expectedCode int
+	}{
+		// State is never changed by a GET, so a link or image can't do it
+		{"GET", "/api/1/edit", 405},
+		{"POST", "/api/1/list", 405},
+		{"HEAD", "/api/1/list", 200},
+		{"DELETE", "/api/1/edit", 405},
+	} {
+		handled = false
+		r := httptest.NewRequest(test.method, "http://medb.example"+test.path, nil)
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "token"})
+		r.Header.Set(csrfHeaderName, "token")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.expectedCode || handled != (test.expectedCode == 200) {
+			t.Fatalf("%s %s: expected %d, got %d", test.method, test.path, test.expectedCode, w.Code)
+		}
+		if w.Code == 405 && w.Header().Get("Allow") == "" {
+			t.Fatal("405 without an Allow header")
+		}
+	}
+}
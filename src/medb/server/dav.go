@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"medb/commitpolicy"
+	"medb/server/audit"
+	"medb/server/dav"
+	"medb/server/user"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/webdav"
+)
+
+const davPrefix = "/dav"
+
+// The operations each WebDAV method that changes files is committed as
+var davOperations = map[string]string{
+	"PUT":    commitpolicy.OperationEdit,
+	"DELETE": commitpolicy.OperationDelete,
+	"MKCOL":  commitpolicy.OperationCreate,
+	"COPY":   commitpolicy.OperationCreate,
+	"MOVE":   commitpolicy.OperationMove,
+}
+
+// The audit actions for the same methods
+var davActions = map[string]string{
+	"PUT":    audit.ActionEdit,
+	"DELETE": audit.ActionDelete,
+	"MKCOL":  audit.ActionCreate,
+	"COPY":   audit.ActionCreate,
+	"MOVE":   audit.ActionMove,
+}
+
+// Locks only need to last as long as the server, so each DB keeps its own in
+// memory.
+type davLocks struct {
+	mutex sync.Mutex
+	locks map[string]webdav.LockSystem
+}
+
+func (l *davLocks) get(dbPath string) webdav.LockSystem {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	ls, ok := l.locks[dbPath]
+	if !ok {
+		ls = webdav.NewMemLS()
+		l.locks[dbPath] = ls
+	}
+	return ls
+}
+
+// Records the status the WebDAV handler answered with.
+type davResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *davResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Registers the WebDAV routes on mux.
+func registerDAV(mux *http.ServeMux, a *auth, commits commitPolicy) {
+	mux.HandleFunc(davPrefix+"/", handlerTimer("dav", davHandler(a, commits)))
+}
+
+// Serves the user's default DB over WebDAV. File managers can't log in
+// through a form, so this takes basic auth, with either the password or, for
+// users with two-factor auth, a personal access token.
+func davHandler(a *auth, commits commitPolicy) func(w http.ResponseWriter, r *http.Request) {
+	locks := &davLocks{locks: make(map[string]webdav.LockSystem)}
+	logins := newDAVLogins()
+	return func(w http.ResponseWriter, r *http.Request) {
+		need := accessWriteNotes
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "PROPFIND":
+			need = accessReadNotes
+		}
+		u := davUser(w, r, a, logins, need)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		dbInfo := activeDB(u, nil)
+		_, authErr := a.checkRole(r, u, dbInfo, need)
+		if authErr != nil {
+			http.Error(w, authErr.message, authErr.status)
+			return
+		}
+
+		db := a.openDB(dbInfo.Path)
+		handler := &webdav.Handler{
+			Prefix:     davPrefix,
+			FileSystem: dav.NewFileSystem(dbInfo.Path, db),
+			LockSystem: locks.get(dbInfo.Path),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					logger.Printf("WebDAV %s %s failed: %v", r.Method, r.URL.Path, err)
+				}
+			},
+		}
+		recorder := &davResponseWriter{ResponseWriter: w, status: 200}
+		handler.ServeHTTP(recorder, r)
+
+		operation, changes := davOperations[r.Method]
+		if !changes || recorder.status >= 300 {
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, davPrefix)
+		err := commits.commitAsUser(db, u, operation, path.Base(name), uuid.Nil)
+		if err != nil {
+			// The response was already written
+			logger.Printf("Unable to commit WebDAV %s of %s: %v", r.Method, name, err)
+		}
+		a.recordAction(r, u, davActions[r.Method], "", "webdav "+name)
+	}
+}
+
+// Returns the user the request's basic auth is for, as long as they're
+// allowed the access. If they aren't, this writes the response and returns
+// nil.
+func davUser(w http.ResponseWriter, r *http.Request, a *auth, logins *davLogins, need access) user.User {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="MeDB", charset="UTF-8"`)
+		http.Error(w, "Not logged in.", 401)
+		return nil
+	}
+
+	var u user.User
+	token, cached := logins.get(username, password)
+	if cached {
+		var err error
+		u, err = a.users.Lookup(username)
+		if err != nil {
+			// They're gone since, so this has to log in again and fail
+			cached = false
+		}
+	}
+	if !cached {
+		if !a.allowLoginAttempt(w, r, username) {
+			return nil
+		}
+		var err error
+		u, err = a.users.Login(username, password)
+		if err == nil && u.HasTOTP() {
+			// The password alone isn't enough for them. It fails like a wrong one
+			// does, so that it can't be used to tell whether the password is right.
+			err = errors.New("two-factor auth needs a token for WebDAV")
+		}
+		token = nil
+		if err != nil {
+			tokenUser, t, tokenErr := a.users.LoginWithToken(password)
+			if tokenErr != nil || tokenUser.Name() != username {
+				// Every request logs in again, so only failures are audited and
+				// counted
+				a.loginFailed(r, username, err.Error())
+				w.Header().Set("WWW-Authenticate", `Basic realm="MeDB", charset="UTF-8"`)
+				http.Error(w, "Failed to login.", 401)
+				return nil
+			}
+			u = tokenUser
+			token = &t
+		}
+		logins.add(username, password, token)
+	}
+
+	if token != nil && !tokenScopeAccess[token.Scope][need] {
+		a.record(r, audit.Event{
+			Action:   audit.ActionAuthFail,
+			Username: username,
+			Detail:   fmt.Sprintf("%s token %s used for %s", token.Scope, token.ID, r.URL.Path),
+		})
+		http.Error(w, fmt.Sprintf("A %s token can't do this.", token.Scope), 403)
+		return nil
+	}
+	return u
+}
+
+// davLogins remembers basic auth credentials that were right for a little
+// while. File managers send them with every request, often many at once, and
+// checking a password hash each time is slow on purpose. Only a hash of the
+// credentials is kept, and changing a password or revoking a token takes up to
+// davLoginLifetime to apply here.
+type davLogins struct {
+	lock   sync.Mutex
+	logins map[string]*davLogin
+}
+
+type davLogin struct {
+	// Nil if it was the password
+	token   *user.Token
+	expires time.Time
+}
+
+const davLoginLifetime = time.Minute
+
+func newDAVLogins() *davLogins {
+	return &davLogins{logins: make(map[string]*davLogin)}
+}
+
+func davLoginKey(username string, password string) string {
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns whether the credentials were right recently, and the token they
+// were if they weren't the password.
+func (l *davLogins) get(username string, password string) (*user.Token, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	login, ok := l.logins[davLoginKey(username, password)]
+	if !ok || time.Now().After(login.expires) {
+		return nil, false
+	}
+	return login.token, true
+}
+
+func (l *davLogins) add(username string, password string, token *user.Token) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for key, login := range l.logins {
+		if time.Now().After(login.expires) {
+			delete(l.logins, key)
+		}
+	}
+	l.logins[davLoginKey(username, password)] = &davLogin{token: token, expires: time.Now().Add(davLoginLifetime)}
+}
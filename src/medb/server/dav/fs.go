@@ -0,0 +1,410 @@
+// Package dav lets a DB be mounted over WebDAV. Notes are served without
+// their medb headers, and keep them when they're written back. New files get
+// a header, like tool/sync gives them. Files and folders medb and git manage,
+// like .git, can't be seen or touched.
+package dav
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"medb/storage"
+)
+
+type fileSystem struct {
+	rootPath string
+	db       storage.DB
+}
+
+// NewFileSystem returns the DB at rootPath as a webdav.FileSystem. Every
+// write goes through db.
+func NewFileSystem(rootPath string, db storage.DB) webdav.FileSystem {
+	return &fileSystem{rootPath: rootPath, db: db}
+}
+
+// Returns the name relative to the root, which is empty for the root itself.
+// Hidden files don't exist.
+func relativeName(name string) (string, error) {
+	relative := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if relative == "" {
+		return "", nil
+	}
+	for _, component := range strings.Split(relative, "/") {
+		if storage.IsHiddenName(component) {
+			return "", os.ErrNotExist
+		}
+	}
+	return relative, nil
+}
+
+// Returns where the name is on disk, and the name relative to the root.
+func (fs *fileSystem) resolve(name string) (string, string, error) {
+	relative, err := relativeName(name)
+	if err != nil {
+		return "", "", err
+	}
+	if relative == "" {
+		return fs.rootPath, "", nil
+	}
+	fullPath, err := fs.db.ResolvePath(relative)
+	if err != nil {
+		return "", "", &os.PathError{Op: "resolve", Path: name, Err: os.ErrPermission}
+	}
+	return fullPath, relative, nil
+}
+
+func (fs *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	fullPath, relative, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if relative == "" {
+		return os.ErrExist
+	}
+	return os.Mkdir(fullPath, perm)
+}
+
+func (fs *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	fullPath, relative, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	info, statErr := os.Stat(fullPath)
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if relative == "" || statErr == nil && info.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		if statErr == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, os.ErrExist
+		}
+		if os.IsNotExist(statErr) && flag&os.O_CREATE == 0 {
+			return nil, statErr
+		}
+		// Files can only be made in folders that exist
+		parent, err := os.Stat(path.Dir(fullPath))
+		if err != nil {
+			return nil, err
+		}
+		if !parent.IsDir() {
+			return nil, os.ErrNotExist
+		}
+		f := &writtenFile{fs: fs, relative: relative, name: path.Base(fullPath)}
+		if flag&os.O_TRUNC == 0 && statErr == nil {
+			existing, err := fs.db.ReadFileAt(relative)
+			if err != nil {
+				return nil, err
+			}
+			f.content = []byte(existing.Content())
+			if flag&os.O_APPEND != 0 {
+				f.offset = int64(len(f.content))
+			}
+		}
+		return f, nil
+	}
+
+	if statErr != nil {
+		return nil, statErr
+	}
+	if info.IsDir() {
+		dir, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{File: dir, fs: fs, relative: relative}, nil
+	}
+	f, err := fs.db.ReadFileAt(relative)
+	if err != nil {
+		return nil, err
+	}
+	content := []byte(f.Content())
+	return &readFile{
+		Reader: bytes.NewReader(content),
+		info:   noteInfo{FileInfo: info, size: int64(len(content))},
+	}, nil
+}
+
+// Returns the note at the path, or nil if it isn't one the DB can find by its
+// ID.
+func (fs *fileSystem) noteAt(relative string, fullPath string) storage.File {
+	f, err := fs.db.ReadFileAt(relative)
+	if err != nil || !f.HasHeader() {
+		return nil
+	}
+	// Copying a file by hand copies its ID too, so make sure it's this one
+	loaded, err := fs.db.LoadFile(f.ID())
+	if err != nil || path.Clean(loaded.Path()) != path.Clean(fullPath) {
+		return nil
+	}
+	return f
+}
+
+// Notes are deleted through the DB, then whatever's left, like folders and
+// files without a header, is removed.
+func (fs *fileSystem) RemoveAll(ctx context.Context, name string) error {
+	fullPath, relative, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if relative == "" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	err = filepath.Walk(fullPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		f := fs.noteAt(path.Join(relative, strings.TrimPrefix(p, fullPath)), p)
+		if f == nil {
+			return nil
+		}
+		return fs.db.DeleteFile(f.ID())
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(fullPath)
+}
+
+// Notes are moved through the DB. A folder is moved one file at a time, then
+// what's left of it is removed.
+func (fs *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, oldRelative, err := fs.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, newRelative, err := fs.resolve(newName)
+	if err != nil {
+		return err
+	}
+	if oldRelative == "" || newRelative == "" {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrPermission}
+	}
+	if strings.HasPrefix(newRelative+"/", oldRelative+"/") {
+		// Into itself
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrInvalid}
+	}
+	if _, err = os.Lstat(newPath); err == nil {
+		return os.ErrExist
+	}
+	// Like os.Rename, and unlike MoveFile, the folder has to be there already
+	parent, err := os.Stat(path.Dir(newPath))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir() {
+		return os.ErrNotExist
+	}
+	info, err := os.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fs.move(oldRelative, oldPath, newRelative, newPath)
+	}
+
+	err = filepath.Walk(oldPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		suffix := strings.TrimPrefix(p, oldPath)
+		if info.IsDir() {
+			return os.MkdirAll(newPath+suffix, info.Mode().Perm())
+		}
+		return fs.move(path.Join(oldRelative, suffix), p, path.Join(newRelative, suffix), newPath+suffix)
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(oldPath)
+}
+
+// Moves one file, through the DB if it's a note.
+func (fs *fileSystem) move(oldRelative string, oldPath string, newRelative string, newPath string) error {
+	if f := fs.noteAt(oldRelative, oldPath); f != nil {
+		_, err := fs.db.MoveFile(f.ID(), newRelative)
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (fs *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fullPath, relative, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return fs.noteInfo(relative, info)
+}
+
+// Files are as big as their content, without the header. Folders, and files
+// whose header can't be read, are left as they are.
+func (fs *fileSystem) noteInfo(relative string, info os.FileInfo) (os.FileInfo, error) {
+	if info.IsDir() {
+		return info, nil
+	}
+	f, err := fs.db.ReadFileAt(relative)
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	if err != nil {
+		return info, nil
+	}
+	return noteInfo{FileInfo: info, size: int64(len(f.Content()))}, nil
+}
+
+type noteInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i noteInfo) Size() int64 {
+	return i.size
+}
+
+// A note being read.
+type readFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *readFile) Close() error {
+	return nil
+}
+
+func (f *readFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// A folder, which doesn't list hidden files.
+type dirFile struct {
+	*os.File
+	fs       *fileSystem
+	relative string
+	// Read all at once, and handed out by Readdir
+	infos []os.FileInfo
+	read  bool
+}
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.read {
+		infos, err := f.File.Readdir(0)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if storage.IsHiddenName(info.Name()) {
+				continue
+			}
+			info, err = f.fs.noteInfo(path.Join(f.relative, info.Name()), info)
+			if err != nil {
+				return nil, err
+			}
+			f.infos = append(f.infos, info)
+		}
+		f.read = true
+	}
+	if count <= 0 {
+		infos := f.infos
+		f.infos = nil
+		return infos, nil
+	}
+	if len(f.infos) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.infos) {
+		count = len(f.infos)
+	}
+	infos := f.infos[:count]
+	f.infos = f.infos[count:]
+	return infos, nil
+}
+
+func (f *dirFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// A note being written. It's only saved, with its header, once it's closed.
+type writtenFile struct {
+	fs       *fileSystem
+	relative string
+	name     string
+	content  []byte
+	offset   int64
+}
+
+func (f *writtenFile) Write(p []byte) (int, error) {
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.content)) {
+		f.content = append(f.content, make([]byte, end-int64(len(f.content)))...)
+	}
+	copy(f.content[f.offset:], p)
+	f.offset = end
+	return len(p), nil
+}
+
+func (f *writtenFile) Read(p []byte) (int, error) {
+	if f.offset >= int64(len(f.content)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.content[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *writtenFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.content))
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *writtenFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *writtenFile) Stat() (os.FileInfo, error) {
+	return writtenInfo{name: f.name, size: int64(len(f.content))}, nil
+}
+
+func (f *writtenFile) Close() error {
+	_, err := f.fs.db.WriteFileAt(f.relative, string(f.content))
+	return err
+}
+
+type writtenInfo struct {
+	name string
+	size int64
+}
+
+func (i writtenInfo) Name() string       { return i.name }
+func (i writtenInfo) Size() int64        { return i.size }
+func (i writtenInfo) Mode() os.FileMode  { return 0644 }
+func (i writtenInfo) ModTime() time.Time { return time.Now() }
+func (i writtenInfo) IsDir() bool        { return false }
+func (i writtenInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,105 @@
+package dav
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"medb/storage"
+)
+
+// Remembers which notes were deleted and moved through it.
+type recordingDB struct {
+	storage.DB
+	deleted []uuid.UUID
+	moved   []string
+}
+
+func (d *recordingDB) DeleteFile(fileID uuid.UUID) error {
+	d.deleted = append(d.deleted, fileID)
+	return d.DB.DeleteFile(fileID)
+}
+
+func (d *recordingDB) MoveFile(fileID uuid.UUID, newPath string) (storage.File, error) {
+	d.moved = append(d.moved, newPath)
+	return d.DB.MoveFile(fileID, newPath)
+}
+
+func TestChangesGoThroughTheDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-dav-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output, err := exec.Command("git", "init", "-q", "-b", "master", dir).CombinedOutput()
+	if err != nil {
+		t.Fatal(string(output), err)
+	}
+	db := &recordingDB{DB: storage.NewDB(dir)}
+	fs := NewFileSystem(dir, db)
+	ctx := context.Background()
+	ideas, err := db.CreateFile("ideas.md", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	todo, err := db.CreateFile("projects/todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not a note, and an empty folder
+	err = ioutil.WriteFile(path.Join(dir, "projects", "README"), []byte("plain"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(dir, "projects", "empty"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Rename(ctx, "/ideas.md", "/later.md"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Rename(ctx, "/projects", "/archive/projects"); err == nil {
+		t.Fatal("moved into a folder that doesn't exist")
+	}
+	if err = fs.Rename(ctx, "/projects", "/projects/inside"); err == nil {
+		t.Fatal("moved a folder into itself")
+	}
+	if err = fs.Rename(ctx, "/projects", "/old"); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(db.moved)
+	if len(db.moved) != 2 || db.moved[0] != "later.md" || db.moved[1] != "old/todo.md" {
+		t.Fatal(db.moved)
+	}
+	for _, p := range []string{"old/README", "old/empty"} {
+		if _, err = os.Stat(path.Join(dir, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = os.Stat(path.Join(dir, "projects")); !os.IsNotExist(err) {
+		t.Fatal("the old folder is still there", err)
+	}
+
+	if err = fs.RemoveAll(ctx, "/later.md"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.RemoveAll(ctx, "/old"); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.deleted) != 2 || db.deleted[0] != ideas.ID() || db.deleted[1] != todo.ID() {
+		t.Fatal(db.deleted)
+	}
+	if _, err = os.Stat(path.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Fatal("the folder is still there", err)
+	}
+	if err = fs.RemoveAll(ctx, "/"); err == nil {
+		t.Fatal("removed the root")
+	}
+}
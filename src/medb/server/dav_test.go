@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"medb/server/audit"
+	"medb/server/user"
+	"medb/storage"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDAV(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+
+	// Sends the request as alice with the password, and returns the body
+	call := func(method string, url string, password string, body string, expectedStatus int) string {
+		r := httptest.NewRequest(method, "http://medb.example"+url, strings.NewReader(body))
+		r.SetBasicAuth("alice", password)
+		if method == "PROPFIND" {
+			r.Header.Set("Depth", "1")
+		}
+		w := httptest.NewRecorder()
+		ts.handler.ServeHTTP(w, r)
+		if w.Code != expectedStatus {
+			t.Fatalf("%s %s: expected %d, got %d: %s", method, url, expectedStatus, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	lastCommit := func() string {
+		output, err := exec.Command("git", "-C", ts.dbPath, "log", "-1", "--format=%s").CombinedOutput()
+		if err != nil {
+			t.Fatal(string(output), err)
+		}
+		return strings.TrimSpace(string(output))
+	}
+
+	// New files get a header and are committed
+	call("PUT", "/dav/ideas.md", "hunter2", "one", 201)
+	db := storage.NewDB(ts.dbPath)
+	f, err := db.ReadFileAt("ideas.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.HasHeader() || f.Content() != "one" {
+		t.Fatal(f)
+	}
+	if commit := lastCommit(); !strings.Contains(commit, "ideas.md") {
+		t.Fatal(commit)
+	}
+	if body := call("GET", "/dav/ideas.md", "hunter2", "", 200); body != "one" {
+		t.Fatal(body)
+	}
+
+	// Writing over a note keeps it the same note
+	call("PUT", "/dav/ideas.md", ts.writeToken, "two", 201)
+	edited, err := db.ReadFileAt("ideas.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.ID() != f.ID() || edited.Content() != "two" {
+		t.Fatal(edited)
+	}
+
+	call("MKCOL", "/dav/archive", "hunter2", "", 201)
+	call("PUT", "/dav/missing/todo.md", "hunter2", "milk", 409)
+	listing := call("PROPFIND", "/dav/", "hunter2", "", 207)
+	if !strings.Contains(listing, "ideas.md") || !strings.Contains(listing, "archive") ||
+		strings.Contains(listing, ".git") {
+		t.Fatal(listing)
+	}
+	call("GET", "/dav/.git/config", "hunter2", "", 404)
+	call("PUT", "/dav/.git/config", "hunter2", "", 409)
+
+	// Read tokens can only read
+	call("GET", "/dav/ideas.md", ts.readToken, "", 200)
+	call("PUT", "/dav/ideas.md", ts.readToken, "three", 403)
+	call("GET", "/dav/ideas.md", "wrong", "", 401)
+
+	call("DELETE", "/dav/ideas.md", "hunter2", "", 204)
+	content, err := ioutil.ReadDir(ts.dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range content {
+		if info.Name() == "ideas.md" {
+			t.Fatal("ideas.md wasn't deleted")
+		}
+	}
+	if commit := lastCommit(); !strings.Contains(commit, "ideas.md") {
+		t.Fatal(commit)
+	}
+	if _, err = db.ReadFileAt(path.Join("archive", "ideas.md")); err == nil {
+		t.Fatal("Expected no archived note")
+	}
+
+	// Moves keep the note, folders and all
+	call("PUT", "/dav/archive/todo.md", "hunter2", "milk", 201)
+	todo, err := db.ReadFileAt("archive/todo.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	move := func(from string, to string) {
+		r := httptest.NewRequest("MOVE", "http://medb.example"+from, nil)
+		r.SetBasicAuth("alice", "hunter2")
+		r.Header.Set("Destination", "http://medb.example"+to)
+		w := httptest.NewRecorder()
+		ts.handler.ServeHTTP(w, r)
+		if w.Code != 201 {
+			t.Fatalf("MOVE %s: %d %s", from, w.Code, w.Body.String())
+		}
+	}
+	move("/dav/archive/todo.md", "/dav/archive/shopping.md")
+	move("/dav/archive", "/dav/old")
+	moved, err := db.LoadFile(todo.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Path() != path.Join(ts.dbPath, "old", "shopping.md") || moved.Content() != "milk" {
+		t.Fatal(moved.Path(), moved.Content())
+	}
+	if commit := lastCommit(); !strings.Contains(commit, "move archive") {
+		t.Fatal(commit)
+	}
+	call("DELETE", "/dav/old", "hunter2", "", 204)
+	if _, err = db.LoadFile(todo.ID()); err != storage.ErrFileNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestDAVWithTOTP(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	// bob's password is hunter2 too, and he has two-factor auth
+	users, err := os.OpenFile(ts.usersFilePath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fmt.Fprintf(
+		users,
+		"bob,$2a$10$J1g0q3sq8PQX30Z6PcgKKukrBP4N/cFhXr2UOiDDhBk2A298lynXi,%s,,,JBSWY3DPEHPK3PXP\n",
+		ts.dbPath,
+	)
+	users.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://medb.example/dav/", nil)
+		r.SetBasicAuth("bob", password)
+		w := httptest.NewRecorder()
+		ts.handler.ServeHTTP(w, r)
+		return w
+	}
+	// The right password alone fails just like a wrong one, so it can't be
+	// guessed through WebDAV
+	right, wrong := get("hunter2"), get("hunter3")
+	if right.Code != 401 || right.Code != wrong.Code || right.Body.String() != wrong.Body.String() ||
+		right.Header().Get("WWW-Authenticate") != wrong.Header().Get("WWW-Authenticate") {
+		t.Fatal(right.Code, right.Body.String(), wrong.Code, wrong.Body.String())
+	}
+}
+
+func TestDAVWithoutCredentials(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+
+	// Clients only send their credentials once they're asked for them
+	for _, method := range []string{"PROPFIND", "PUT", "MOVE"} {
+		r := httptest.NewRequest(method, "http://medb.example/dav/", nil)
+		w := httptest.NewRecorder()
+		ts.handler.ServeHTTP(w, r)
+		if w.Code != 401 || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Fatal(method, w.Code, w.Header())
+		}
+	}
+
+	// Other sites still can't make changes
+	r := httptest.NewRequest("PUT", "http://medb.example/dav/ideas.md", strings.NewReader("one"))
+	r.SetBasicAuth("alice", "hunter2")
+	r.Header.Set("Origin", "https://evil.example")
+	w := httptest.NewRecorder()
+	ts.handler.ServeHTTP(w, r)
+	if w.Code != 403 {
+		t.Fatal(w.Code)
+	}
+}
+
+// Counts how often passwords and tokens are checked
+type countingUsers struct {
+	user.Store
+	logins int
+}
+
+func (c *countingUsers) Login(username string, password string) (user.User, error) {
+	c.logins++
+	return c.Store.Login(username, password)
+}
+
+func (c *countingUsers) LoginWithToken(token string) (user.User, user.Token, error) {
+	c.logins++
+	return c.Store.LoginWithToken(token)
+}
+
+func TestDAVRemembersLogins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-dav-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output, err := exec.Command("git", "init", "-q", dir).CombinedOutput()
+	if err != nil {
+		t.Fatal(string(output), err)
+	}
+	users := user.NewWritableStore(path.Join(dir, "users.csv"))
+	err = users.Add("alice", "hunter2", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readToken, _, err := users.CreateToken("alice", "read", user.ScopeReadOnly, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingUsers{Store: users}
+	a := newAuth(nil, counting, nil, audit.NewLog(""), nil, nil, nil)
+	logins := newDAVLogins()
+
+	login := func(password string, need access, expectedStatus int) {
+		r := httptest.NewRequest("PROPFIND", "http://medb.example/dav/", nil)
+		r.SetBasicAuth("alice", password)
+		w := httptest.NewRecorder()
+		u := davUser(w, r, a, logins, need)
+		if (u != nil) != (expectedStatus == 200) || w.Code != expectedStatus {
+			t.Fatal(password, w.Code, u)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		login("hunter2", accessWriteNotes, 200)
+	}
+	if counting.logins != 1 {
+		t.Fatal(counting.logins)
+	}
+
+	// Wrong ones are checked every time
+	counting.logins = 0
+	for i := 0; i < 2; i++ {
+		login("hunter3", accessReadNotes, 401)
+	}
+	if counting.logins != 4 {
+		t.Fatal(counting.logins)
+	}
+
+	// A remembered token still can't do more than its scope
+	counting.logins = 0
+	login(readToken, accessReadNotes, 200)
+	login(readToken, accessWriteNotes, 403)
+	if counting.logins != 2 {
+		t.Fatal(counting.logins)
+	}
+}
@@ -0,0 +1,71 @@
+package events
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+
+	"medb/storage"
+)
+
+// Tells the hub about every write, so subscribers don't have to wait for
+// the watcher to notice.
+type notifyingDB struct {
+	storage.DB
+	hub      Hub
+	rootPath string
+}
+
+func (d notifyingDB) changed(err error) error {
+	d.hub.Changed(d.rootPath)
+	return err
+}
+
+func (d notifyingDB) SaveFile(f storage.File) error {
+	return d.changed(d.DB.SaveFile(f))
+}
+
+func (d notifyingDB) NewFile(path string, content string) error {
+	return d.changed(d.DB.NewFile(path, content))
+}
+
+func (d notifyingDB) CreateFile(path string, content string) (storage.File, error) {
+	f, err := d.DB.CreateFile(path, content)
+	return f, d.changed(err)
+}
+
+func (d notifyingDB) DeleteFile(fileID uuid.UUID) error {
+	return d.changed(d.DB.DeleteFile(fileID))
+}
+
+func (d notifyingDB) MoveFile(fileID uuid.UUID, newPath string) (storage.File, error) {
+	f, err := d.DB.MoveFile(fileID, newPath)
+	return f, d.changed(err)
+}
+
+func (d notifyingDB) WriteFileAt(path string, content string) (storage.File, error) {
+	f, err := d.DB.WriteFileAt(path, content)
+	return f, d.changed(err)
+}
+
+func (d notifyingDB) CommitToGIT(message string) error {
+	return d.changed(d.DB.CommitToGIT(message))
+}
+
+func (d notifyingDB) CommitWithOptions(message string, options storage.CommitOptions) error {
+	return d.changed(d.DB.CommitWithOptions(message, options))
+}
+
+func (d notifyingDB) SquashAutoCommits(window time.Duration, signingKey *storage.SigningKey) (int, error) {
+	squashed, err := d.DB.SquashAutoCommits(window, signingKey)
+	return squashed, d.changed(err)
+}
+
+// A failed pull can still have left conflicts behind.
+func (d notifyingDB) Pull() error {
+	err := d.DB.Pull()
+	if err == nil {
+		d.hub.Publish(d.rootPath, Event{Type: TypePull})
+	}
+	return d.changed(err)
+}
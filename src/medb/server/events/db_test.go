@@ -0,0 +1,80 @@
+package events
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"medb/storage"
+)
+
+func TestPullIsPublished(t *testing.T) {
+	root, cleanUp := setUpDB(t)
+	defer cleanUp()
+	dir := path.Dir(root)
+	originPath := root + "-origin.git"
+	clonePath := root + "-clone"
+	defer os.RemoveAll(originPath)
+	defer os.RemoveAll(clonePath)
+	git(t, dir, "clone", "-q", "--bare", root, originPath)
+	git(t, root, "remote", "add", "origin", originPath)
+	git(t, root, "fetch", "-q", "origin")
+	git(t, root, "branch", "-q", "-u", "origin/master")
+
+	// Someone else pushes a note while we commit one of our own, so the
+	// pull has to merge
+	git(t, dir, "clone", "-q", originPath, clonePath)
+	git(t, clonePath, "config", "user.name", "MeDB Test")
+	git(t, clonePath, "config", "user.email", "test@medb.example")
+	_, err := storage.NewDB(clonePath).CreateFile("theirs.md", "from elsewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git(t, clonePath, "add", "-A")
+	git(t, clonePath, "commit", "-q", "-m", "Theirs")
+	git(t, clonePath, "push", "-q", "origin", "master")
+
+	hub := NewHub()
+	db := NewNotifyingDB(hub, root, storage.NewDB(root))
+	if _, err = db.CreateFile("ours.md", "from here"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CommitWithOptions("Ours", storage.CommitOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, cancel, err := hub.Subscribe(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	err = db.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, stream, TypePull)
+
+	files, err := db.AllFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name()
+	}
+	if len(files) != 2 {
+		t.Fatal(names)
+	}
+	// A merge, with both our commit and theirs as parents
+	cmd := exec.Command("git", "log", "-1", "--format=%P")
+	cmd.Dir = root
+	parents, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strings.Fields(string(parents))) != 2 {
+		t.Fatal(string(parents))
+	}
+}
@@ -0,0 +1,198 @@
+package events
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How many events a subscriber can fall behind by before it's dropped
+const subscriberBuffer = 64
+
+type hubImpl struct {
+	lock *sync.Mutex
+	dbs  map[string]*watchedDB
+	// How long the filesystem has to be quiet before a rescan
+	settle time.Duration
+}
+
+var _ Hub = &hubImpl{}
+
+type watchedDB struct {
+	rootPath    string
+	subscribers map[chan Event]struct{}
+	changed     chan struct{}
+	stop        chan struct{}
+}
+
+func (h *hubImpl) Subscribe(rootPath string) (<-chan Event, func(), error) {
+	rootPath = filepath.Clean(rootPath)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	w, ok := h.dbs[rootPath]
+	if !ok {
+		var err error
+		w, err = h.watch(rootPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.dbs[rootPath] = w
+	}
+	ch := make(chan Event, subscriberBuffer)
+	w.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		h.unsubscribe(w, ch)
+	}
+	return ch, cancel, nil
+}
+
+// Must be called with the lock held.
+func (h *hubImpl) unsubscribe(w *watchedDB, ch chan Event) {
+	if _, ok := w.subscribers[ch]; !ok {
+		return
+	}
+	delete(w.subscribers, ch)
+	close(ch)
+	if len(w.subscribers) == 0 {
+		close(w.stop)
+		delete(h.dbs, w.rootPath)
+	}
+}
+
+func (h *hubImpl) Changed(rootPath string) {
+	h.lock.Lock()
+	w, ok := h.dbs[filepath.Clean(rootPath)]
+	h.lock.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case w.changed <- struct{}{}:
+	default:
+		// A rescan is already coming
+	}
+}
+
+func (h *hubImpl) Publish(rootPath string, event Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	w, ok := h.dbs[filepath.Clean(rootPath)]
+	if !ok {
+		return
+	}
+	h.publish(w, event)
+}
+
+// Must be called with the lock held.
+func (h *hubImpl) publish(w *watchedDB, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for ch := range w.subscribers {
+		select {
+		case ch <- event:
+		default:
+			h.unsubscribe(w, ch)
+		}
+	}
+}
+
+// Starts watching the DB, it already has a snapshot to compare changes to
+// when this returns.
+func (h *hubImpl) watch(rootPath string) (*watchedDB, error) {
+	last, err := takeSnapshot(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = addFolders(watcher, rootPath)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	w := &watchedDB{
+		rootPath:    rootPath,
+		subscribers: make(map[chan Event]struct{}),
+		changed:     make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	go h.run(w, watcher, last)
+	return w, nil
+}
+
+func (h *hubImpl) run(w *watchedDB, watcher *fsnotify.Watcher, last snapshot) {
+	defer watcher.Close()
+	var settled <-chan time.Time
+	rescan := func() {
+		settled = nil
+		next, err := takeSnapshot(w.rootPath)
+		if err != nil {
+			// Most likely a write in progress, the next one will catch up
+			return
+		}
+		h.lock.Lock()
+		for _, event := range last.diff(next) {
+			h.publish(w, event)
+		}
+		h.lock.Unlock()
+		last = next
+	}
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Create != 0 {
+				// New folders need watching too, errors mean it's already gone
+				addFolders(watcher, event.Name)
+			}
+			if settled == nil {
+				settled = time.After(h.settle)
+			}
+		case <-watcher.Errors:
+			// The next rescan still catches whatever we missed
+		case <-w.changed:
+			rescan()
+		case <-settled:
+			rescan()
+		}
+	}
+}
+
+// Watches the folder and every one under it. Only the top of .git is watched,
+// that's enough to see HEAD move, and .medb is skipped.
+func addFolders(watcher *fsnotify.Watcher, folderPath string) error {
+	return filepath.Walk(folderPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		switch info.Name() {
+		case ".medb":
+			return filepath.SkipDir
+		case ".git":
+			err = watcher.Add(p)
+			if err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		return watcher.Add(p)
+	})
+}
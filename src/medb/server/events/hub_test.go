@@ -0,0 +1,184 @@
+package events
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"medb/storage"
+)
+
+// Creates a git repo with one commit to watch.
+func setUpDB(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "medb-events-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "master"},
+		{"config", "user.name", "MeDB Test"},
+		{"config", "user.email", "test@medb.example"},
+		{"commit", "-q", "--allow-empty", "-m", "Start"},
+	} {
+		git(t, dir, args...)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func git(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(string(output), err)
+	}
+}
+
+// Waits for the next event of the type, skipping any others.
+func expectEvent(t *testing.T, stream <-chan Event, eventType string) Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-stream:
+			if !ok {
+				t.Fatal("stream closed")
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", eventType)
+		}
+	}
+}
+
+func TestHub(t *testing.T) {
+	root, cleanUp := setUpDB(t)
+	defer cleanUp()
+	hub := NewHub()
+	stream, cancel, err := hub.Subscribe(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes nobody tells the hub about are seen by the watcher
+	f, err := storage.NewDB(root).CreateFile("projects/ideas.md", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := expectEvent(t, stream, TypeCreated)
+	if event.FileID != f.ID().String() || event.Path != "projects/ideas.md" || event.Time.IsZero() {
+		t.Fatal(event)
+	}
+
+	db := NewNotifyingDB(hub, root, storage.NewDB(root))
+	f.Update("two")
+	err = db.SaveFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event = expectEvent(t, stream, TypeUpdated)
+	if event.FileID != f.ID().String() {
+		t.Fatal(event)
+	}
+	_, err = db.MoveFile(f.ID(), "archive/ideas.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event = expectEvent(t, stream, TypeMoved)
+	if event.Path != "archive/ideas.md" || event.OldPath != "projects/ideas.md" {
+		t.Fatal(event)
+	}
+	err = db.CommitToGIT("Move ideas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event = expectEvent(t, stream, TypeCommit); len(event.Commit) != 40 {
+		t.Fatal(event)
+	}
+	err = db.DeleteFile(f.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event = expectEvent(t, stream, TypeDeleted); event.Path != "archive/ideas.md" {
+		t.Fatal(event)
+	}
+	hub.Publish(root, Event{Type: TypePull})
+	expectEvent(t, stream, TypePull)
+
+	cancel()
+	if _, ok := <-stream; ok {
+		t.Fatal("stream is still open")
+	}
+	// Nobody is listening anymore
+	hub.Publish(root, Event{Type: TypePull})
+}
+
+func TestHubConflicts(t *testing.T) {
+	root, cleanUp := setUpDB(t)
+	defer cleanUp()
+	db := storage.NewDB(root)
+	f, err := db.CreateFile("ideas.md", "one\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git(t, root, "add", "-A")
+	git(t, root, "commit", "-q", "-m", "Add ideas")
+	git(t, root, "checkout", "-q", "-b", "other")
+	f.Update("two\n")
+	if err = db.SaveFile(f); err != nil {
+		t.Fatal(err)
+	}
+	git(t, root, "commit", "-q", "-am", "Two")
+	git(t, root, "checkout", "-q", "master")
+	f.Update("three\n")
+	if err = db.SaveFile(f); err != nil {
+		t.Fatal(err)
+	}
+	git(t, root, "commit", "-q", "-am", "Three")
+
+	hub := NewHub()
+	stream, cancel, err := hub.Subscribe(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	cmd := exec.Command("git", "merge", "-q", "other")
+	cmd.Dir = root
+	if cmd.Run() == nil {
+		t.Fatal("the merge didn't conflict")
+	}
+	hub.Changed(root)
+	event := expectEvent(t, stream, TypeConflict)
+	if len(event.Conflicts) != 1 || event.Conflicts[0] != "ideas.md" {
+		t.Fatal(event)
+	}
+
+	git(t, root, "merge", "--abort")
+	hub.Changed(root)
+	if event = expectEvent(t, stream, TypeConflict); len(event.Conflicts) != 0 {
+		t.Fatal(event)
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	root, cleanUp := setUpDB(t)
+	defer cleanUp()
+	hub := NewHub()
+	stream, cancel, err := hub.Subscribe(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	for i := 0; i <= subscriberBuffer; i++ {
+		hub.Publish(root, Event{Type: TypePull})
+	}
+	for i := 0; i < subscriberBuffer; i++ {
+		<-stream
+	}
+	if _, ok := <-stream; ok {
+		t.Fatal("stream is still open")
+	}
+}
@@ -0,0 +1,62 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"medb/storage"
+)
+
+// The types of events
+const (
+	TypeCreated = "created"
+	TypeUpdated = "updated"
+	TypeMoved   = "moved"
+	TypeDeleted = "deleted"
+	// HEAD moved to a new commit
+	TypeCommit = "commit"
+	TypePull   = "pull"
+	// The set of conflicted notes changed, it's empty once they're resolved
+	TypeConflict = "conflict"
+)
+
+type Event struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	FileID string    `json:"fileID,omitempty"`
+	// Relative to the DB root
+	Path string `json:"path,omitempty"`
+	// Where a moved note was
+	OldPath string `json:"oldPath,omitempty"`
+	// The new HEAD for commits
+	Commit string `json:"commit,omitempty"`
+	// The conflicted paths
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// Hub tells everyone subscribed to a DB what changes in it. A DB is watched
+// for as long as it has subscribers.
+type Hub interface {
+	// The channel is closed if the subscriber falls too far behind. Call the
+	// func once done with it.
+	Subscribe(rootPath string) (<-chan Event, func(), error)
+	// Says the DB changed, so the hub looks for what did now rather than
+	// waiting for the filesystem to settle.
+	Changed(rootPath string)
+	// Sends an event that can't be seen on disk, like a pull completing.
+	Publish(rootPath string, event Event)
+}
+
+// NewHub returns a hub that watches DBs on disk.
+func NewHub() Hub {
+	return &hubImpl{
+		lock:   &sync.Mutex{},
+		dbs:    make(map[string]*watchedDB),
+		settle: 100 * time.Millisecond,
+	}
+}
+
+// NewNotifyingDB wraps db so that its changes reach the hub right away.
+func NewNotifyingDB(hub Hub, rootPath string, db storage.DB) storage.DB {
+	return notifyingDB{DB: db, hub: hub, rootPath: rootPath}
+}
@@ -0,0 +1,116 @@
+package events
+
+import (
+	"crypto/sha256"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"medb/storage"
+)
+
+// What a DB looked like at one point, changes are found by comparing two.
+type snapshot struct {
+	files     map[uuid.UUID]fileState
+	head      string
+	conflicts []string
+}
+
+type fileState struct {
+	path string
+	hash [sha256.Size]byte
+}
+
+// Git is run with its working directory set rather than through the DB, which
+// would change the whole process' working directory from this goroutine.
+func takeSnapshot(rootPath string) (snapshot, error) {
+	files, err := storage.NewDB(rootPath).AllFiles()
+	if err != nil {
+		return snapshot{}, err
+	}
+	s := snapshot{files: make(map[uuid.UUID]fileState, len(files))}
+	for _, f := range files {
+		// Notes without a header aren't notes until tool/sync gives them one
+		if !f.HasHeader() {
+			continue
+		}
+		relativePath, err := filepath.Rel(rootPath, f.Path())
+		if err != nil {
+			return snapshot{}, err
+		}
+		s.files[f.ID()] = fileState{
+			path: filepath.ToSlash(relativePath),
+			hash: sha256.Sum256([]byte(f.Content())),
+		}
+	}
+
+	// A DB without any commits has no HEAD yet
+	head, err := runGit(rootPath, "rev-parse", "--verify", "-q", "HEAD")
+	if err == nil {
+		s.head = strings.TrimSpace(head)
+	}
+	conflicts, err := runGit(rootPath, "diff", "--name-only", "--diff-filter=U", "-z")
+	if err != nil {
+		return snapshot{}, err
+	}
+	for _, p := range strings.Split(conflicts, "\x00") {
+		if p != "" {
+			s.conflicts = append(s.conflicts, p)
+		}
+	}
+	sort.Strings(s.conflicts)
+	return s, nil
+}
+
+func runGit(rootPath string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = rootPath
+	output, err := cmd.Output()
+	return string(output), err
+}
+
+// Returns the events that turn s into next, notes in path order.
+func (s snapshot) diff(next snapshot) []Event {
+	now := time.Now()
+	events := make([]Event, 0)
+	for id, state := range next.files {
+		old, ok := s.files[id]
+		event := Event{Time: now, FileID: id.String(), Path: state.path}
+		switch {
+		case !ok:
+			event.Type = TypeCreated
+		case old.path != state.path:
+			event.Type = TypeMoved
+			event.OldPath = old.path
+			events = append(events, event)
+			if old.hash == state.hash {
+				continue
+			}
+			event.Type = TypeUpdated
+			event.OldPath = ""
+		case old.hash != state.hash:
+			event.Type = TypeUpdated
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+	for id, state := range s.files {
+		if _, ok := next.files[id]; !ok {
+			events = append(events, Event{Type: TypeDeleted, Time: now, FileID: id.String(), Path: state.path})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Path < events[j].Path })
+
+	if next.head != s.head && next.head != "" {
+		events = append(events, Event{Type: TypeCommit, Time: now, Commit: next.head})
+	}
+	if strings.Join(next.conflicts, "\x00") != strings.Join(s.conflicts, "\x00") {
+		events = append(events, Event{Type: TypeConflict, Time: now, Conflicts: next.conflicts})
+	}
+	return events
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Proxies tend to close streams that are quiet for too long
+const eventsKeepAlive = 30 * time.Second
+
+// Streams the changes to the user's DB as Server-Sent Events, each named
+// after its type. Browsers reconnect on their own if the stream ends.
+func eventsHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, db, _ := a.getMembership(w, r, accessReadNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming isn't supported.", 500)
+			return
+		}
+		stream, cancel, err := a.events.Subscribe(db.Path)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(200)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventsKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case event, ok := <-stream:
+				if !ok {
+					// We fell behind, the client starts over
+					return
+				}
+				raw, err := json.Marshal(event)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, raw)
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"medb/server/events"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	server := httptest.NewServer(ts.handler)
+	defer server.Close()
+
+	request := func(method string, url string, body string) *http.Response {
+		r, err := http.NewRequest(method, server.URL+url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "Bearer "+ts.writeToken)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := request("GET", "/api/1/events", "")
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal(resp.Status, resp.Header)
+	}
+	created := request("POST", "/api/2/notes", `{"path": "projects/ideas.md", "content": "one"}`)
+	created.Body.Close()
+	if created.StatusCode != 201 {
+		t.Fatal(created.Status)
+	}
+
+	// Read events until the note shows up
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	timeout := time.After(5 * time.Second)
+	eventType := ""
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("stream ended")
+			}
+			if strings.HasPrefix(line, "event: ") {
+				eventType = strings.TrimPrefix(line, "event: ")
+			}
+			if eventType != events.TypeCreated || !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var event events.Event
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+			if err != nil || event.Path != "projects/ideas.md" {
+				t.Fatal(line, err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no created event")
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"medb/client"
+	"medb/storage"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHistoryLimit(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	server := httptest.NewServer(ts.handler)
+	defer server.Close()
+	c, err := client.NewWithToken(server.URL, ts.writeToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ideas.md", "todo.md"} {
+		if _, err = c.Create(name, "one"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history := func(query string) []storage.HistoryEntry {
+		r := httptest.NewRequest("GET", "http://medb.example/api/1/history"+query, nil)
+		r.Header.Set("Authorization", "Bearer "+ts.readToken)
+		w := httptest.NewRecorder()
+		ts.handler.ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Fatalf("%s: %d %s", query, w.Code, w.Body.String())
+		}
+		var entries []storage.HistoryEntry
+		err := json.Unmarshal(w.Body.Bytes(), &entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	if entries := history("?limit=1"); len(entries) != 1 {
+		t.Fatal(entries)
+	}
+	// The limit of one request doesn't carry over to the next
+	if entries := history(""); len(entries) != 3 {
+		t.Fatal(entries)
+	}
+	if entries := history("?limit=2"); len(entries) != 2 {
+		t.Fatal(entries)
+	}
+}
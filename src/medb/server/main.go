@@ -5,28 +5,109 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"medb/server/stopwatch"
+	"medb/commitpolicy"
+	"medb/server/acl"
+	"medb/server/audit"
+	"medb/server/collab"
+	"medb/server/events"
+	"medb/server/session"
+	"medb/server/share"
 	"medb/server/user"
 	"medb/storage"
 	"net/http"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/alexedwards/scs"
 	"github.com/google/uuid"
 )
 
 func main() {
 	var staticDir string
 	var userFilePath string
-	var sessionSecret string
+	var sessionsFilePath string
+	var membersFilePath string
+	var sharesFilePath string
+	var auditLogPath string
+	var adminsRaw string
+	sessionLifetime := 30 * 24 * time.Hour
+	commitMessageText := commitpolicy.DefaultMessageTemplate
+	coalesceWindow := commitpolicy.DefaultCoalesceWindow
+	var signingKeyPath string
+	signingKeyFormat := storage.SigningFormatSSH
+	var allowedSignersFile string
+	var mirrorsRaw string
+	collabSaveInterval := defaultCollabSaveInterval
 	port := 3000
 
 	flag.StringVar(&staticDir, "static", staticDir, "path to the static dir for the ui")
 	flag.StringVar(&userFilePath, "usersFilePath", userFilePath, "path to the file with user information")
-	flag.StringVar(&sessionSecret, "sessionSecret", sessionSecret, "32 char random string to use for the sessions")
+	flag.StringVar(
+		&sessionsFilePath,
+		"sessionsFilePath",
+		sessionsFilePath,
+		"path to persist sessions to, they are only kept in memory if empty",
+	)
+	flag.DurationVar(&sessionLifetime, "sessionLifetime", sessionLifetime, "how long a login lasts")
+	flag.StringVar(
+		&membersFilePath,
+		"membersFilePath",
+		membersFilePath,
+		"path to the file with the members of shared DBs, sharing is disabled if empty",
+	)
+	flag.StringVar(
+		&sharesFilePath,
+		"sharesFilePath",
+		sharesFilePath,
+		"path to persist share links to, they are only kept in memory if empty",
+	)
+	flag.StringVar(
+		&auditLogPath,
+		"auditLogPath",
+		auditLogPath,
+		"path to append the audit log of logins, note and git operations to, nothing is recorded if empty",
+	)
+	flag.StringVar(&adminsRaw, "admins", adminsRaw, "comma separated usernames that can read the audit log")
+	flag.StringVar(
+		&commitMessageText,
+		"commitMessageTemplate",
+		commitMessageText,
+		"text/template for commit messages, can use .Operation, .Title and .Username",
+	)
+	flag.DurationVar(
+		&coalesceWindow,
+		"commitCoalesceWindow",
+		coalesceWindow,
+		"unpushed edits to a note by the same user within this window amend the last commit, 0 disables",
+	)
+	flag.StringVar(
+		&signingKeyPath,
+		"signingKey",
+		signingKeyPath,
+		"path to an ssh private key, or a GnuPG home dir for openpgp, to sign commits with",
+	)
+	flag.StringVar(&signingKeyFormat, "signingKeyFormat", signingKeyFormat, "either ssh or openpgp")
+	flag.StringVar(
+		&allowedSignersFile,
+		"allowedSignersFile",
+		allowedSignersFile,
+		"ssh allowed signers file used to verify commit signatures in the history",
+	)
+	flag.StringVar(
+		&mirrorsRaw,
+		"mirrors",
+		mirrorsRaw,
+		"comma separated git remotes to push to, defaults to the branch's upstream",
+	)
+	flag.DurationVar(
+		&collabSaveInterval,
+		"collabSaveInterval",
+		collabSaveInterval,
+		"how often notes being edited together are saved and committed",
+	)
 	flag.IntVar(&port, "port", port, "The port to listen on")
 	flag.Parse()
 
@@ -36,44 +117,138 @@ func main() {
 	if userFilePath == "" {
 		panic("Must specify path to the users file!")
 	}
-	if len(sessionSecret) != 32 {
-		panic("Must specify 32 char session secret!")
+	var signingKey *storage.SigningKey
+	if signingKeyPath != "" {
+		signingKey = &storage.SigningKey{Format: signingKeyFormat, Path: signingKeyPath}
+		err := signingKey.Validate()
+		if err != nil {
+			panic(err)
+		}
+		// Otherwise git can't verify the server's own commits, so the history
+		// would flag every one of them
+		if signingKey.Format == storage.SigningFormatSSH && allowedSignersFile == "" {
+			panic("Must specify allowed signers file to sign with an ssh key!")
+		}
+	}
+	commits, err := newCommitPolicy(commitMessageText, coalesceWindow, signingKey)
+	if err != nil {
+		panic(err)
+	}
+	var mirrors []string
+	if mirrorsRaw != "" {
+		mirrors = storage.ParseRemotes(mirrorsRaw)
+	}
+	historyOptions := storage.HistoryOptions{
+		Limit:              defaultHistoryLimit,
+		SigningKey:         signingKey,
+		AllowedSignersFile: allowedSignersFile,
 	}
 
 	staticServer := http.FileServer(http.Dir(staticDir))
 
 	http.Handle("/static/", staticServer)
-	http.HandleFunc("/", handlerTimer("rootView", rootViewHandler(staticDir)))
-	http.HandleFunc("/edit/", handlerTimer("editView", editViewHandler(staticDir)))
+	http.HandleFunc("/", handlerTimer("rootView", get(rootViewHandler(staticDir))))
+	http.HandleFunc("/edit/", handlerTimer("editView", get(editViewHandler(staticDir))))
 
-	// Session manager setup
-	manager := scs.NewCookieManager(sessionSecret)
-	// Let the cookie stay in the browser across browser restarts
-	manager.Persist(true)
+	// Session store setup
+	sessions, err := session.NewStore(sessionsFilePath, sessionLifetime)
+	if err != nil {
+		panic(err)
+	}
+
+	// Share store setup
+	shares, err := share.NewStore(sharesFilePath)
+	if err != nil {
+		panic(err)
+	}
 
 	// User store setup
 	store := user.NewStore(userFilePath)
+	var admins []string
+	if adminsRaw != "" {
+		admins = strings.Split(adminsRaw, ",")
+	}
+	a := newAuth(
+		sessions,
+		store,
+		acl.NewStore(membersFilePath),
+		audit.NewLog(auditLogPath),
+		events.NewHub(),
+		signingKey,
+		admins,
+	)
 
 	// API v1
-	http.HandleFunc("/api/1/login", handlerTimer("login", loginHandler(manager, store)))
-	http.HandleFunc("/api/1/list", handlerTimer("list", listHandler(manager)))
-	http.HandleFunc("/api/1/search", handlerTimer("search", searchHandler(manager)))
-	http.HandleFunc("/api/1/pull", handlerTimer("pull", pullHandler(manager)))
-	http.HandleFunc("/api/1/push", handlerTimer("push", pushHandler(manager)))
-	http.HandleFunc("/api/1/commit", handlerTimer("commit", commitHandler(manager)))
-	http.HandleFunc("/api/1/edit", handlerTimer("edit", editHandler(manager)))
-	http.HandleFunc("/api/1/load", handlerTimer("load", loadHandler(manager)))
-	http.HandleFunc("/api/1/git/info", handlerTimer("git/info", gitInfoHandler(manager)))
-
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	collabSessions := newCollabManager(commits, store, collabSaveInterval)
+	registerAPIV1(http.DefaultServeMux, a, shares, commits, collabSessions, mirrors, historyOptions)
+
+	// API v2
+	registerAPIV2(http.DefaultServeMux, a, commits)
+
+	// WebDAV
+	registerDAV(http.DefaultServeMux, a, commits)
+
+	err = http.ListenAndServe(fmt.Sprintf(":%d", port), csrfProtect(http.DefaultServeMux))
 	if err != nil {
 		panic(err)
 	}
 }
 
+// Registers the v1 routes on mux.
+func registerAPIV1(
+	mux *http.ServeMux,
+	a *auth,
+	shares share.Store,
+	commits commitPolicy,
+	collabSessions *collab.Manager,
+	mirrors []string,
+	historyOptions storage.HistoryOptions,
+) {
+	mux.HandleFunc("/api/1/login", handlerTimer("login", post(loginHandler(a))))
+	mux.HandleFunc("/api/1/login/totp", handlerTimer("login/totp", post(loginTOTPHandler(a))))
+	mux.HandleFunc("/api/1/logout", handlerTimer("logout", post(logoutHandler(a))))
+	mux.HandleFunc("/api/1/logout/all", handlerTimer("logout/all", post(logoutAllHandler(a))))
+	mux.HandleFunc("/api/1/sessions", handlerTimer("sessions", get(sessionsHandler(a))))
+	mux.HandleFunc("/api/1/account", handlerTimer("account", get(accountHandler(a))))
+	mux.HandleFunc("/api/1/account/profile", handlerTimer("account/profile", post(accountProfileHandler(a))))
+	mux.HandleFunc("/api/1/account/password", handlerTimer("account/password", post(accountPasswordHandler(a))))
+	mux.HandleFunc("/api/1/account/totp/enroll", handlerTimer("account/totp/enroll", post(totpEnrollHandler(a))))
+	mux.HandleFunc("/api/1/account/totp/confirm", handlerTimer("account/totp/confirm", post(totpConfirmHandler(a))))
+	mux.HandleFunc("/api/1/account/totp/disable", handlerTimer("account/totp/disable", post(totpDisableHandler(a))))
+	mux.HandleFunc("/api/1/tokens", handlerTimer("tokens", get(tokensHandler(a))))
+	mux.HandleFunc("/api/1/tokens/create", handlerTimer("tokens/create", post(createTokenHandler(a))))
+	mux.HandleFunc("/api/1/tokens/revoke", handlerTimer("tokens/revoke", post(revokeTokenHandler(a))))
+	mux.HandleFunc("/api/1/dbs", handlerTimer("dbs", get(dbsHandler(a))))
+	mux.HandleFunc("/api/1/dbs/select", handlerTimer("dbs/select", post(selectDBHandler(a))))
+	mux.HandleFunc("/api/1/members", handlerTimer("members", get(membersHandler(a))))
+	mux.HandleFunc("/api/1/members/set", handlerTimer("members/set", post(setMemberHandler(a))))
+	mux.HandleFunc("/api/1/members/remove", handlerTimer("members/remove", post(removeMemberHandler(a))))
+	mux.HandleFunc(sharePathPrefix, handlerTimer("share", get(sharePageHandler(shares))))
+	mux.HandleFunc("/api/1/shares", handlerTimer("shares", get(sharesHandler(a, shares))))
+	mux.HandleFunc("/api/1/shares/create", handlerTimer("shares/create", post(createShareHandler(a, shares))))
+	mux.HandleFunc("/api/1/shares/revoke", handlerTimer("shares/revoke", post(revokeShareHandler(a, shares))))
+	mux.HandleFunc("/api/1/audit", handlerTimer("audit", get(auditHandler(a))))
+	mux.HandleFunc("/api/1/list", handlerTimer("list", get(listHandler(a))))
+	mux.HandleFunc("/api/1/search", handlerTimer("search", post(searchHandler(a))))
+	mux.HandleFunc("/api/1/pull", handlerTimer("pull", post(pullHandler(a))))
+	mux.HandleFunc("/api/1/push", handlerTimer("push", post(pushHandler(a, mirrors))))
+	mux.HandleFunc("/api/1/commit", handlerTimer("commit", post(commitHandler(a, commits))))
+	mux.HandleFunc("/api/1/edit", handlerTimer("edit", post(editHandler(a, commits, collabSessions))))
+	mux.HandleFunc("/api/1/load", handlerTimer("load", post(loadHandler(a))))
+	mux.HandleFunc("/api/1/render", handlerTimer("render", get(renderHandler(a))))
+	mux.HandleFunc("/api/1/git/info", handlerTimer("git/info", get(gitInfoHandler(a, mirrors))))
+	mux.HandleFunc("/api/1/git/status", handlerTimer("git/status", get(gitStatusHandler(a))))
+	mux.HandleFunc("/api/1/history", handlerTimer("history", get(historyHandler(a, historyOptions))))
+	mux.HandleFunc("/api/1/events", handlerTimer("events", get(eventsHandler(a))))
+	mux.HandleFunc("/api/1/collab", handlerTimer("collab", get(collabHandler(a, collabSessions))))
+}
+
 const (
-	rootPathCookieName = "rootPath"
-	successJSON        = "{success: true}"
+	successJSON         = "{success: true}"
+	defaultHistoryLimit = 50
+	defaultAuditLimit   = 200
+	totpIssuer          = "MeDB"
+	totpLoginPage       = "/login-totp.html"
 )
 
 var logger = log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
@@ -102,7 +277,7 @@ func editViewHandler(staticDir string) func(w http.ResponseWriter, r *http.Reque
 	}
 }
 
-func loginHandler(sessionManager *scs.Manager, store user.Store) func(w http.ResponseWriter, r *http.Request) {
+func loginHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
@@ -112,16 +287,31 @@ func loginHandler(sessionManager *scs.Manager, store user.Store) func(w http.Res
 
 		username := r.PostFormValue("username")
 		password := r.PostFormValue("password")
-		u, err := store.Login(username, password)
+		if !a.allowLoginAttempt(w, r, username) {
+			return
+		}
+		u, err := a.users.Login(username, password)
 		if err != nil {
 			// User failed to login, send a 401
+			a.loginFailed(r, username, err.Error())
 			http.Error(w, "Failed to login.", 401)
 			return
 		}
 
-		// Put the user's path in the cookie, login succeeded
-		session := sessionManager.Load(r)
-		err = session.PutString(w, rootPathCookieName, u.Path())
+		if u.HasTOTP() {
+			// The password was right, now they need their second factor. Their
+			// failures aren't forgotten until they get that right too.
+			err = a.challenges.start(w, r, u.Name())
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			http.Redirect(w, r, totpLoginPage, 303)
+			return
+		}
+		a.loginSucceeded(r, username)
+
+		err = a.startSession(w, r, u)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
@@ -131,29 +321,628 @@ func loginHandler(sessionManager *scs.Manager, store user.Store) func(w http.Res
 	}
 }
 
-func getDB(w http.ResponseWriter, r *http.Request, sessionManager *scs.Manager) storage.DB {
-	defer stopwatch.Start("getDB").Stop(logger)
-	session := sessionManager.Load(r)
+func loginTOTPHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
 
-	rootPath, err := session.GetString(rootPathCookieName)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return nil
+		username, ok := a.challenges.guess(r)
+		if !ok {
+			// They need to start over with their password
+			http.Redirect(w, r, "/login.html", 303)
+			return
+		}
+		if !a.allowLoginAttempt(w, r, username) {
+			return
+		}
+		err = a.users.VerifySecondFactor(username, r.PostFormValue("code"), time.Now())
+		if err != nil {
+			a.loginFailed(r, username, "second factor: "+err.Error())
+			http.Error(w, "Failed to login.", 401)
+			return
+		}
+		a.loginSucceeded(r, username)
+		u, err := a.users.Lookup(username)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		a.challenges.finish(w, r)
+		err = a.startSession(w, r, u)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		// Login succeeded, redirect to root
+		http.Redirect(w, r, "/", 303)
+	}
+}
+
+func logoutHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := a.endSession(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		http.Redirect(w, r, "/login.html", 303)
 	}
-	if len(rootPath) == 0 {
-		// User needs to login
-		http.Redirect(w, r, "/login.html", 302)
-		// TODO: Consider returning something in JSON here anyway that indicates where to redirect to
-		// server-side rather than in the index file.
-		return nil
+}
+
+func logoutAllHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		err := a.sessions.DeleteAll(u.Name())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		// Clear this browser's cookie too, its session is already gone
+		err = a.endSession(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		http.Redirect(w, r, "/login.html", 303)
 	}
+}
 
-	return storage.NewDB(rootPath)
+func sessionsHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		sessions, err := a.sessions.List(u.Name())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		current := a.getSession(r)
+		type sessionJSON struct {
+			session.Session
+			Current bool `json:"current"`
+		}
+		sessionsJSON := make([]sessionJSON, len(sessions))
+		for i, s := range sessions {
+			sessionsJSON[i] = sessionJSON{
+				Session: s,
+				Current: current != nil && current.Handle == s.Handle,
+			}
+		}
+		raw, err := json.Marshal(sessionsJSON)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+type accountJSON struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Email       string `json:"email"`
+	TOTPEnabled bool   `json:"totpEnabled"`
+}
+
+func accountHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		raw, err := json.Marshal(accountJSON{
+			Username:    u.Name(),
+			DisplayName: u.DisplayName(),
+			Email:       u.Email(),
+			TOTPEnabled: u.HasTOTP(),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
 }
 
-func listHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *http.Request) {
+func accountProfileHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		db := getDB(w, r, sessionManager)
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		err = a.users.UpdateProfile(u.Name(), r.PostFormValue("displayName"), r.PostFormValue("email"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		fmt.Fprint(w, successJSON)
+	}
+}
+
+func accountPasswordHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		newPassword := r.PostFormValue("newPassword")
+		if len(newPassword) == 0 {
+			http.Error(w, "Invalid new password", 400)
+			return
+		}
+		if !a.allowLoginAttempt(w, r, u.Name()) {
+			return
+		}
+		err = a.users.ChangePassword(u.Name(), r.PostFormValue("oldPassword"), newPassword)
+		if err != nil {
+			a.loginFailed(r, u.Name(), "password change: "+err.Error())
+			http.Error(w, "Failed to change password.", 401)
+			return
+		}
+
+		// Log out every other device, they were using the old password
+		err = a.sessions.DeleteAll(u.Name())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		err = a.startSession(w, r, u)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, successJSON)
+	}
+}
+
+func totpEnrollHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		secret, err := a.users.BeginTOTPEnrollment(u.Name())
+		if err == user.ErrTOTPEnabled {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		enrollmentJSON := struct {
+			Secret          string `json:"secret"`
+			ProvisioningURI string `json:"provisioningURI"`
+		}{
+			Secret:          secret,
+			ProvisioningURI: user.TOTPProvisioningURI(totpIssuer, u.Name(), secret),
+		}
+		raw, err := json.Marshal(enrollmentJSON)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+func totpConfirmHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		recoveryCodes, err := a.users.ConfirmTOTPEnrollment(u.Name(), r.PostFormValue("code"), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		// These are only ever shown once
+		raw, err := json.Marshal(struct {
+			RecoveryCodes []string `json:"recoveryCodes"`
+		}{recoveryCodes})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+func totpDisableHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		if !a.allowLoginAttempt(w, r, u.Name()) {
+			return
+		}
+		err = a.users.DisableTOTP(u.Name(), r.PostFormValue("password"))
+		if err != nil {
+			a.loginFailed(r, u.Name(), "disabling TOTP: "+err.Error())
+			http.Error(w, "Failed to disable TOTP.", 401)
+			return
+		}
+		fmt.Fprint(w, successJSON)
+	}
+}
+
+// Tokens can only be managed from a browser session, never with another token.
+func tokensHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		tokens, err := a.users.ListTokens(u.Name())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		raw, err := json.Marshal(tokens)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+type createdTokenJSON struct {
+	user.Token
+	Secret string `json:"token"`
+}
+
+func createTokenHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		name := r.PostFormValue("name")
+		if len(name) == 0 {
+			http.Error(w, "Invalid token name", 400)
+			return
+		}
+		token, t, err := a.users.CreateToken(u.Name(), name, r.PostFormValue("scope"), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		// This is the only time the token is ever shown
+		raw, err := json.Marshal(createdTokenJSON{t, token})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+func revokeTokenHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		err = a.users.RevokeToken(u.Name(), r.PostFormValue("id"))
+		if err == user.ErrInvalidToken {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, successJSON)
+	}
+}
+
+type dbJSON struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+// Lists the user's DBs by name, the paths on the server aren't their business.
+func dbsHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, s := a.getUserAndSession(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		active := activeDB(u, s)
+		dbs := u.DBs()
+		dbsJSON := make([]dbJSON, len(dbs))
+		for i, db := range dbs {
+			dbsJSON[i] = dbJSON{Name: db.Name, Active: db.Name == active.Name}
+		}
+		raw, err := json.Marshal(dbsJSON)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+// Switches the session to another of the user's DBs.
+func selectDBHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		name := r.PostFormValue("name")
+		if _, ok := u.DB(name); !ok {
+			http.Error(w, fmt.Sprintf("No DB called %s", name), 404)
+			return
+		}
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			http.Error(w, "Not logged in.", 401)
+			return
+		}
+		err = a.sessions.SetActiveDB(cookie.Value, name)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, successJSON)
+	}
+}
+
+type memberJSON struct {
+	Username string   `json:"username"`
+	Role     acl.Role `json:"role"`
+}
+
+// Lists the members of the active DB. One that isn't shared only has its owner.
+func membersHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, db, role := a.getMembership(w, r, accessReadNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		members, err := a.members.Members(db.Path)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if len(members) == 0 {
+			members[u.Name()] = role
+		}
+		membersJSON := make([]memberJSON, 0, len(members))
+		for username, role := range members {
+			membersJSON = append(membersJSON, memberJSON{Username: username, Role: role})
+		}
+		sort.Slice(membersJSON, func(i, j int) bool {
+			return membersJSON[i].Username < membersJSON[j].Username
+		})
+		raw, err := json.Marshal(membersJSON)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+// Adds a member to the active DB or changes their role. The other user still
+// needs the DB in the users file to open it.
+func setMemberHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, db, _ := a.getMembership(w, r, accessManageMembers)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		username := r.PostFormValue("username")
+		role := acl.Role(r.PostFormValue("role"))
+		if !role.Valid() {
+			http.Error(w, fmt.Sprintf("Invalid role %s", role), 400)
+			return
+		}
+		_, err = a.users.Lookup(username)
+		if err == user.ErrUserNotFound {
+			http.Error(w, fmt.Sprintf("No user called %s", username), 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		// The owner of a DB that isn't shared yet has to stay its owner
+		members, err := a.members.Members(db.Path)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if len(members) == 0 && username != u.Name() {
+			err = a.members.SetRole(db.Path, u.Name(), acl.RoleOwner)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		err = a.members.SetRole(db.Path, username, role)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		logger.Printf("%s made %s a %s of %s", u.Name(), username, role, db.Path)
+		fmt.Fprint(w, successJSON)
+	}
+}
+
+func removeMemberHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, db, _ := a.getMembership(w, r, accessManageMembers)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		username := r.PostFormValue("username")
+		err = a.members.Remove(db.Path, username)
+		if err == acl.ErrNotMember {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		logger.Printf("%s removed %s from %s", u.Name(), username, db.Path)
+		fmt.Fprint(w, successJSON)
+	}
+}
+
+// Returns audit log events, newest first, to admins. Takes optional username,
+// action, since and until filters, the times in RFC 3339, and a limit.
+func auditHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := a.getUser(w, r)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		if !a.admins[u.Name()] {
+			a.record(r, audit.Event{Action: audit.ActionAuthFail, Username: u.Name(), Detail: "not an admin"})
+			http.Error(w, "Only admins can read the audit log.", 403)
+			return
+		}
+
+		filter := audit.Filter{
+			Username: r.FormValue("username"),
+			Action:   r.FormValue("action"),
+			Limit:    defaultAuditLimit,
+		}
+		for _, t := range []struct {
+			name  string
+			value *time.Time
+		}{
+			{"since", &filter.Since},
+			{"until", &filter.Until},
+		} {
+			raw := r.FormValue(t.name)
+			if raw == "" {
+				continue
+			}
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s, it must be RFC 3339", t.name), 400)
+				return
+			}
+			*t.value = parsed
+		}
+		if limitRaw := r.FormValue("limit"); limitRaw != "" {
+			limit, err := strconv.Atoi(limitRaw)
+			if err != nil || limit <= 0 {
+				http.Error(w, "Invalid limit", 400)
+				return
+			}
+			filter.Limit = limit
+		}
+
+		events, err := a.audit.Query(filter)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		raw, err := json.Marshal(events)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+func listHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := a.getDB(w, r, accessReadNotes)
 		if db == nil {
 			// This doesn't write an error because we already did that
 			return
@@ -174,9 +963,9 @@ func listHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *htt
 	}
 }
 
-func searchHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *http.Request) {
+func searchHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		db := getDB(w, r, sessionManager)
+		db := a.getDB(w, r, accessReadNotes)
 		if db == nil {
 			// This doesn't write an error because we already did that
 			return
@@ -218,9 +1007,9 @@ func searchHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *h
 	}
 }
 
-func pullHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *http.Request) {
+func pullHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		db := getDB(w, r, sessionManager)
+		u, db := a.getUserAndDB(w, r, accessSync)
 		if db == nil {
 			// This doesn't write an error because we already did that
 			return
@@ -230,29 +1019,52 @@ func pullHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *htt
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		a.recordAction(r, u, audit.ActionPull, "", "")
 		fmt.Fprint(w, successJSON)
 	}
 }
 
-func pushHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *http.Request) {
+func pushHandler(a *auth, mirrors []string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		db := getDB(w, r, sessionManager)
+		u, db := a.getUserAndDB(w, r, accessSync)
 		if db == nil {
 			// This doesn't write an error because we already did that
 			return
 		}
-		err := db.Push()
+		if len(mirrors) == 0 {
+			err := db.Push()
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			a.recordAction(r, u, audit.ActionPush, "", "")
+			fmt.Fprint(w, successJSON)
+			return
+		}
+
+		results, err := db.PushMirrors(mirrors)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		failures := make([]string, 0)
+		for _, result := range results {
+			if result.Err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", result.Remote, result.Err))
+			}
+		}
+		if len(failures) > 0 {
+			http.Error(w, "Failed to push to "+strings.Join(failures, ", "), 500)
+			return
+		}
+		a.recordAction(r, u, audit.ActionPush, "", strings.Join(mirrors, ","))
 		fmt.Fprint(w, successJSON)
 	}
 }
 
-func commitHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *http.Request) {
+func commitHandler(a *auth, commits commitPolicy) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		db := getDB(w, r, sessionManager)
+		u, db := a.getUserAndDB(w, r, accessWriteNotes)
 		if db == nil {
 			// This doesn't write an error because we already did that
 			return
@@ -277,24 +1089,30 @@ func commitHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *h
 			p = path.Join("unfiled", p)
 		}
 		err = db.NewFile(p, content)
+		if _, ok := err.(*storage.InvalidPathError); ok {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
 
-		err = db.CommitToGIT(fmt.Sprintf("MeDB Sync - saving note at %s", p))
+		_, title := path.Split(p)
+		err = commits.commitAsUser(db, u, commitpolicy.OperationCreate, title, uuid.Nil)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		a.recordAction(r, u, audit.ActionCreate, "", p)
 
 		fmt.Fprint(w, successJSON)
 	}
 }
 
-func loadHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *http.Request) {
+func loadHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		db := getDB(w, r, sessionManager)
+		u, db := a.getUserAndDB(w, r, accessReadNotes)
 		if db == nil {
 			// This doesn't write an error because we already did that
 			return
@@ -317,6 +1135,7 @@ func loadHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *htt
 			http.Error(w, err.Error(), 404)
 			return
 		}
+		a.recordAction(r, u, audit.ActionLoad, f.ID().String(), "")
 
 		fileAsJSON := struct {
 			Id      string `json:"id"`
@@ -336,13 +1155,14 @@ func loadHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *htt
 	}
 }
 
-func editHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *http.Request) {
+func editHandler(a *auth, commits commitPolicy, collabSessions *collab.Manager) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		db := getDB(w, r, sessionManager)
-		if db == nil {
+		u, dbInfo, _ := a.getMembership(w, r, accessWriteNotes)
+		if u == nil {
 			// This doesn't write an error because we already did that
 			return
 		}
+		db := a.openDB(dbInfo.Path)
 
 		err := r.ParseForm()
 		if err != nil {
@@ -358,6 +1178,12 @@ func editHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *htt
 			http.Error(w, "unable to parse fileid", 400)
 			return
 		}
+		// The session would take this in as a change made outside of it,
+		// on top of the same edits it already has
+		if collabSessions.Editing(dbInfo.Path, fileID) {
+			http.Error(w, "The note is being edited together, save it from the editing session.", 409)
+			return
+		}
 		f, err := db.LoadFile(fileID)
 		if err != nil {
 			http.Error(w, err.Error(), 404)
@@ -370,18 +1196,32 @@ func editHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *htt
 			return
 		}
 
-		err = db.CommitToGIT(fmt.Sprintf("MeDB Sync - saving updated file %s", f.ID()))
+		err = commits.commitAsUser(db, u, commitpolicy.OperationEdit, f.Name(), f.ID())
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		a.recordAction(r, u, audit.ActionEdit, f.ID().String(), "")
 		fmt.Fprint(w, successJSON)
 	}
 }
 
-func gitInfoHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *http.Request) {
+type remoteInfoJSON struct {
+	Remote string `json:"remote"`
+	// False if we don't have a tracking branch for the remote, the counts
+	// are meaningless then.
+	Tracked       bool  `json:"tracked"`
+	RemoteAheadBy int64 `json:"remoteAheadBy"`
+	LocalAheadBy  int64 `json:"localAheadBy"`
+	// Unix timestamps, 0 if it never happened
+	LastPushAttempt int64  `json:"lastPushAttempt"`
+	LastPushSuccess int64  `json:"lastPushSuccess"`
+	LastPushError   string `json:"lastPushError"`
+}
+
+func gitInfoHandler(a *auth, mirrors []string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		db := getDB(w, r, sessionManager)
+		db := a.getDB(w, r, accessReadGit)
 		if db == nil {
 			// This doesn't write an error because we already did that
 			return
@@ -403,21 +1243,46 @@ func gitInfoHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		aheadBehind, err := db.AheadBehindOriginMaster()
+		remotes := mirrors
+		if len(remotes) == 0 {
+			remotes = []string{"origin"}
+		}
+		remoteStatuses, err := db.RemoteStatuses(remotes)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		aheadBehind := storage.CombinedAheadBehind(remoteStatuses)
+		remoteInfos := make([]remoteInfoJSON, len(remoteStatuses))
+		for i, status := range remoteStatuses {
+			remoteInfos[i] = remoteInfoJSON{
+				Remote:        status.Remote,
+				LastPushError: status.LastPushError,
+			}
+			if status.AheadBehind != nil {
+				remoteInfos[i].Tracked = true
+				remoteInfos[i].RemoteAheadBy = status.AheadBehind.OriginAheadBy
+				remoteInfos[i].LocalAheadBy = status.AheadBehind.LocalAheadBy
+			}
+			if !status.LastPushAttempt.IsZero() {
+				remoteInfos[i].LastPushAttempt = status.LastPushAttempt.Unix()
+			}
+			if !status.LastPushSuccess.IsZero() {
+				remoteInfos[i].LastPushSuccess = status.LastPushSuccess.Unix()
+			}
+		}
 		gitInfoStruct := struct {
-			LastCommit    string `json:"lastCommit"`
-			LastPull      string `json:"lastPull"`
-			RemoteAheadBy string `json:"remoteAheadBy"`
-			LocalAheadBy  string `json:"localAheadBy"`
+			LastCommit    string           `json:"lastCommit"`
+			LastPull      string           `json:"lastPull"`
+			RemoteAheadBy string           `json:"remoteAheadBy"`
+			LocalAheadBy  string           `json:"localAheadBy"`
+			Remotes       []remoteInfoJSON `json:"remotes"`
 		}{
 			LastCommit:    fmt.Sprintf("Last Commit: %v ago.", time.Since(lastCommitTS)),
 			LastPull:      fmt.Sprintf("Last Pull: %v ago.", time.Since(lastPullTS)),
 			RemoteAheadBy: fmt.Sprintf("Remote ahead by: %d", aheadBehind.OriginAheadBy),
 			LocalAheadBy:  fmt.Sprintf("Local ahead by: %d", aheadBehind.LocalAheadBy),
+			Remotes:       remoteInfos,
 		}
 		raw, err := json.Marshal(gitInfoStruct)
 		if err != nil {
@@ -427,3 +1292,65 @@ func gitInfoHandler(sessionManager *scs.Manager) func(w http.ResponseWriter, r *
 		fmt.Fprint(w, string(raw))
 	}
 }
+
+func gitStatusHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := a.getDB(w, r, accessReadGit)
+		if db == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		entries, err := db.Status()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		raw, err := json.Marshal(entries)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+func historyHandler(
+	a *auth,
+	options storage.HistoryOptions,
+) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := a.getDB(w, r, accessReadGit)
+		if db == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		// The options are shared by every request, so each gets its own copy
+		requestOptions := options
+		if limitRaw := r.FormValue("limit"); limitRaw != "" {
+			requestOptions.Limit, err = strconv.Atoi(limitRaw)
+			if err != nil || requestOptions.Limit <= 0 {
+				http.Error(w, "Invalid limit", 400)
+				return
+			}
+		}
+
+		entries, err := db.History(requestOptions)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		raw, err := json.Marshal(entries)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
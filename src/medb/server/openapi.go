@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Serves the OpenAPI document for API v2, no login needed.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, openAPIDocument)
+}
+
+// Keep this in step with registerAPIV2.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "MeDB API",
+    "version": "2",
+    "description": "Notes in the active DB of the logged in user. Requests are authenticated by the session cookie, which also needs the medb_csrf cookie echoed in the X-CSRF-Token header for anything but GET, or by a personal access token."
+  },
+  "servers": [{"url": "/api/2"}],
+  "security": [{"session": []}, {"token": []}],
+  "paths": {
+    "/tree": {
+      "get": {
+        "summary": "Every note in the DB as a tree of folders",
+        "responses": {
+          "200": {"description": "The tree", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Tree"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/search": {
+      "post": {
+        "summary": "Searches the notes",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SearchRequest"}}}},
+        "responses": {
+          "200": {"description": "The notes that match, without content", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Notes"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/notes": {
+      "post": {
+        "summary": "Creates a note, never overwriting one",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateNote"}}}},
+        "responses": {
+          "201": {"description": "The new note", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Note"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/notes/{id}": {
+      "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string", "format": "uuid"}}],
+      "get": {
+        "summary": "Returns a note",
+        "responses": {
+          "200": {"description": "The note", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Note"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Replaces a note's content",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UpdateNote"}}}},
+        "responses": {
+          "200": {"description": "The updated note", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Note"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "patch": {
+        "summary": "Moves a note to another path, creating any missing folders",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MoveNote"}}}},
+        "responses": {
+          "200": {"description": "The moved note", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Note"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Deletes a note",
+        "responses": {
+          "204": {"description": "The note was deleted"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/changes": {
+      "get": {
+        "summary": "The notes created, updated or deleted since a cursor, as of the last commit",
+        "parameters": [{"name": "since", "in": "query", "description": "The cursor from the last sync, everything is returned without one", "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "The changes, sorted by path", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Changes"}}}},
+          "410": {"description": "The cursor is unknown, sync again without one", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Applies changes made offline, each on its own, and commits the ones that applied",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Upload"}}}},
+        "responses": {
+          "200": {"description": "A result for each change, in order", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UploadResults"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "session": {"type": "apiKey", "in": "cookie", "name": "medb_session"},
+      "token": {"type": "http", "scheme": "bearer"}
+    },
+    "responses": {
+      "Error": {
+        "description": "Anything that went wrong",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {
+            "type": "object",
+            "required": ["code", "message"],
+            "properties": {
+              "code": {
+                "type": "string",
+                "enum": ["bad_request", "unauthorized", "forbidden", "not_found", "method_not_allowed", "conflict", "gone", "too_many_requests", "internal"]
+              },
+              "message": {"type": "string"}
+            }
+          }
+        }
+      },
+      "Note": {
+        "type": "object",
+        "required": ["id", "name", "path"],
+        "properties": {
+          "id": {"type": "string", "format": "uuid"},
+          "name": {"type": "string"},
+          "path": {"type": "string", "description": "Relative to the DB root"},
+          "content": {"type": "string"}
+        }
+      },
+      "Notes": {
+        "type": "object",
+        "required": ["notes"],
+        "properties": {"notes": {"type": "array", "items": {"$ref": "#/components/schemas/Note"}}}
+      },
+      "TreeEntry": {
+        "type": "object",
+        "required": ["name", "state"],
+        "properties": {
+          "name": {"type": "string"},
+          "state": {"type": "string", "enum": ["file", "collapsed"]},
+          "id": {"type": "string", "format": "uuid"},
+          "contents": {"type": "array", "items": {"$ref": "#/components/schemas/TreeEntry"}}
+        }
+      },
+      "Tree": {
+        "type": "object",
+        "required": ["tree"],
+        "properties": {"tree": {"type": "array", "items": {"$ref": "#/components/schemas/TreeEntry"}}}
+      },
+      "SearchRequest": {
+        "type": "object",
+        "required": ["query"],
+        "properties": {
+          "query": {"type": "string"},
+          "limit": {"type": "integer", "default": 5}
+        }
+      },
+      "CreateNote": {
+        "type": "object",
+        "required": ["path"],
+        "properties": {
+          "path": {"type": "string", "description": "Relative to the DB root, missing folders are created"},
+          "content": {"type": "string"}
+        }
+      },
+      "UpdateNote": {
+        "type": "object",
+        "required": ["content"],
+        "properties": {"content": {"type": "string"}}
+      },
+      "MoveNote": {
+        "type": "object",
+        "required": ["path"],
+        "properties": {"path": {"type": "string", "description": "Relative to the DB root"}}
+      },
+      "Change": {
+        "type": "object",
+        "required": ["type", "id", "path"],
+        "properties": {
+          "type": {"type": "string", "enum": ["created", "updated", "deleted"]},
+          "id": {"type": "string", "format": "uuid"},
+          "path": {"type": "string", "description": "Where the note is now, or was before it was deleted"},
+          "hash": {"type": "string", "description": "SHA-256 of the content, left out for deletes"},
+          "content": {"type": "string", "description": "Left out for deletes"}
+        }
+      },
+      "Changes": {
+        "type": "object",
+        "required": ["cursor", "changes"],
+        "properties": {
+          "cursor": {"type": "string", "description": "To send as since next time"},
+          "changes": {"type": "array", "items": {"$ref": "#/components/schemas/Change"}}
+        }
+      },
+      "UploadChange": {
+        "type": "object",
+        "description": "Without an id, creates a note at the path. Otherwise changes the note whose content hashed to baseHash when it was last synced.",
+        "properties": {
+          "id": {"type": "string", "format": "uuid"},
+          "baseHash": {"type": "string"},
+          "path": {"type": "string", "description": "Relative to the DB root, the note is moved if it's somewhere else"},
+          "content": {"type": "string"},
+          "deleted": {"type": "boolean"}
+        }
+      },
+      "Upload": {
+        "type": "object",
+        "required": ["changes"],
+        "properties": {"changes": {"type": "array", "maxItems": 1000, "items": {"$ref": "#/components/schemas/UploadChange"}}}
+      },
+      "UploadResult": {
+        "type": "object",
+        "required": ["status"],
+        "properties": {
+          "status": {"type": "string", "enum": ["applied", "conflict", "rejected", "failed"]},
+          "message": {"type": "string"},
+          "id": {"type": "string", "format": "uuid"},
+          "path": {"type": "string"},
+          "hash": {"type": "string"},
+          "content": {"type": "string", "description": "The note on the server, for conflicts"}
+        }
+      },
+      "UploadResults": {
+        "type": "object",
+        "required": ["results"],
+        "properties": {"results": {"type": "array", "items": {"$ref": "#/components/schemas/UploadResult"}}}
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Config controls how quickly a Limiter backs off.
+type Config struct {
+	// Failures allowed before any delay is imposed
+	FreeFailures int
+	// The delay after the first failure past the free ones, doubling after that
+	BaseDelay time.Duration
+	// The longest delay backoff will impose
+	MaxDelay time.Duration
+	// After this many failures the key is locked out for LockoutDuration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// Failures are forgotten once there haven't been any for this long
+	ForgetAfter time.Duration
+}
+
+// Limiter tracks failed attempts per key, such as a username or IP, and
+// blocks keys with exponential backoff and then a temporary lockout.
+type Limiter struct {
+	config Config
+	// Replaced in tests
+	now func() time.Time
+
+	lock    sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+func NewLimiter(config Config) *Limiter {
+	return &Limiter{
+		config:  config,
+		now:     time.Now,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Allow returns whether the key may attempt now. If not, it also returns how
+// long until it may.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	e := l.entry(key)
+	if e == nil {
+		return true, 0
+	}
+	wait := e.blockedUntil.Sub(l.now())
+	if wait > 0 {
+		return false, wait
+	}
+	return true, 0
+}
+
+// Failure records a failed attempt, returning true if the key is now locked out.
+func (l *Limiter) Failure(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	e := l.entry(key)
+	if e == nil {
+		e = &entry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+
+	if l.config.LockoutAfter > 0 && e.failures >= l.config.LockoutAfter {
+		e.blockedUntil = now.Add(l.config.LockoutDuration)
+		return true
+	}
+	if e.failures > l.config.FreeFailures {
+		delay := l.config.BaseDelay
+		for i := l.config.FreeFailures + 1; i < e.failures && delay < l.config.MaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > l.config.MaxDelay {
+			delay = l.config.MaxDelay
+		}
+		e.blockedUntil = now.Add(delay)
+	}
+	return false
+}
+
+// Success forgets the key's failures.
+func (l *Limiter) Success(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.entries, key)
+}
+
+// Returns the key's entry, or nil if it has none that is still relevant. Also
+// prunes every forgotten entry. Must be called with the lock held.
+func (l *Limiter) entry(key string) *entry {
+	now := l.now()
+	for k, e := range l.entries {
+		if now.Sub(e.lastFailure) > l.config.ForgetAfter && !now.Before(e.blockedUntil) {
+			delete(l.entries, k)
+		}
+	}
+	return l.entries[key]
+}
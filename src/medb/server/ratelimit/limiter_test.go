@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterBackoffAndLockout(t *testing.T) {
+	l := NewLimiter(Config{
+		FreeFailures:    2,
+		BaseDelay:       time.Second,
+		MaxDelay:        4 * time.Second,
+		LockoutAfter:    6,
+		LockoutDuration: time.Hour,
+		ForgetAfter:     24 * time.Hour,
+	})
+	now := time.Unix(1513066695, 0)
+	l.now = func() time.Time { return now }
+
+	expectWait := func(expected time.Duration) {
+		allowed, wait := l.Allow("alice")
+		if allowed != (expected == 0) || wait != expected {
+			t.Fatalf("expected to wait %v, got %v %v", expected, allowed, wait)
+		}
+	}
+
+	// The first couple of failures are free
+	l.Failure("alice")
+	l.Failure("alice")
+	expectWait(0)
+
+	// Then the delay doubles up to the max
+	l.Failure("alice")
+	expectWait(time.Second)
+	l.Failure("alice")
+	expectWait(2 * time.Second)
+	l.Failure("alice")
+	expectWait(4 * time.Second)
+	now = now.Add(4 * time.Second)
+	expectWait(0)
+
+	// Other keys aren't affected
+	if allowed, _ := l.Allow("bob"); !allowed {
+		t.Fatal("bob was blocked")
+	}
+
+	// Until they're locked out
+	if !l.Failure("alice") {
+		t.Fatal("alice wasn't locked out")
+	}
+	expectWait(time.Hour)
+	now = now.Add(time.Hour)
+	expectWait(0)
+
+	// A success resets everything
+	l.Success("alice")
+	l.Failure("alice")
+	expectWait(0)
+
+	// And so does waiting long enough
+	l.Failure("alice")
+	l.Failure("alice")
+	now = now.Add(25 * time.Hour)
+	l.Failure("alice")
+	expectWait(0)
+}
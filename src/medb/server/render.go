@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"medb/server/audit"
+	"medb/server/render"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+type headingJSON struct {
+	Level int    `json:"level"`
+	ID    string `json:"id"`
+	Text  string `json:"text"`
+}
+
+type renderedNoteJSON struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Sanitized, so it can be put straight into a page
+	HTML string        `json:"html"`
+	TOC  []headingJSON `json:"toc"`
+}
+
+// Renders a note to HTML, so clients don't each need their own Markdown
+// renderer. Links to other notes go to their edit pages.
+func renderHandler(a *auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, dbInfo, _ := a.getMembership(w, r, accessReadNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		db := a.openDB(dbInfo.Path)
+
+		fileID, err := uuid.Parse(r.URL.Query().Get("fileID"))
+		if err != nil {
+			http.Error(w, "unable to parse fileid", 400)
+			return
+		}
+		f, err := db.LoadFile(fileID)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+
+		resolve := func(notePath string) (string, bool) {
+			linked, err := db.ReadFileAt(notePath)
+			if err != nil || !linked.HasHeader() {
+				return "", false
+			}
+			return "/edit/" + linked.ID().String(), true
+		}
+		note, err := render.Render(newNoteJSON(dbInfo, f, false).Path, f.Content(), resolve)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		a.recordAction(r, u, audit.ActionLoad, f.ID().String(), "render")
+
+		response := renderedNoteJSON{
+			ID:   f.ID().String(),
+			Name: f.Name(),
+			HTML: note.HTML,
+			TOC:  make([]headingJSON, len(note.TOC)),
+		}
+		for i, heading := range note.TOC {
+			response.TOC[i] = headingJSON{Level: heading.Level, ID: heading.ID, Text: heading.Text}
+		}
+		raw, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
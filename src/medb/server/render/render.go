@@ -0,0 +1,147 @@
+// Package render turns a note's Markdown into HTML that's safe to show in a
+// page. It's CommonMark with tables and task lists, raw HTML is allowed but
+// sanitized, and headings get IDs to link to.
+package render
+
+import (
+	"bytes"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+)
+
+// Heading is an entry in a note's table of contents.
+type Heading struct {
+	Level int
+	ID    string
+	Text  string
+}
+
+// Note is a rendered note.
+type Note struct {
+	HTML string
+	// Its headings, in order
+	TOC []Heading
+}
+
+// Resolver returns the URL of the note at a path relative to the DB root,
+// or false if there isn't one there.
+type Resolver func(notePath string) (string, bool)
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute)),
+		extension.TaskList,
+	),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+	// The policy sanitizes it afterwards
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+var headingIDRegexp = regexp.MustCompile(`^[\p{L}\p{N}_-]+$`)
+
+var policy = newPolicy()
+
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("id").Matching(headingIDRegexp).OnElements("h1", "h2", "h3", "h4", "h5", "h6")
+	// Task list items
+	p.AllowAttrs("type").Matching(regexp.MustCompile("^checkbox$")).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	return p
+}
+
+// Render renders the note at notePath, relative to the DB root. Links to
+// other notes, relative to it or to the root if they start with /, are
+// replaced with what resolve returns for them.
+func Render(notePath string, content string, resolve Resolver) (Note, error) {
+	source := []byte(content)
+	doc := markdown.Parser().Parse(text.NewReader(source))
+
+	note := Note{TOC: []Heading{}}
+	err := ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch node := n.(type) {
+		case *ast.Heading:
+			id, _ := node.AttributeString("id")
+			idBytes, _ := id.([]byte)
+			note.TOC = append(note.TOC, Heading{
+				Level: node.Level,
+				ID:    string(idBytes),
+				Text:  nodeText(node, source),
+			})
+		case *ast.Link:
+			resolved, ok := resolveLink(notePath, string(node.Destination), resolve)
+			if ok {
+				node.Destination = []byte(resolved)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return Note{}, err
+	}
+
+	var rendered bytes.Buffer
+	err = markdown.Renderer().Render(&rendered, source, doc)
+	if err != nil {
+		return Note{}, err
+	}
+	note.HTML = policy.Sanitize(rendered.String())
+	return note, nil
+}
+
+// Returns the URL of the note a link points at, keeping its fragment. Links
+// with a scheme or a host, or to somewhere on the same page, aren't to notes.
+func resolveLink(notePath string, destination string, resolve Resolver) (string, bool) {
+	link, err := url.Parse(destination)
+	if err != nil || link.Scheme != "" || link.Host != "" || link.Path == "" {
+		return "", false
+	}
+	target := link.Path
+	if !strings.HasPrefix(target, "/") {
+		target = path.Join(path.Dir(notePath), target)
+	}
+	target = strings.TrimPrefix(path.Clean("/"+target), "/")
+	if target == "" {
+		return "", false
+	}
+	resolved, ok := resolve(target)
+	if !ok {
+		return "", false
+	}
+	if link.Fragment != "" {
+		resolved += "#" + link.Fragment
+	}
+	return resolved, true
+}
+
+// Returns the text of the node's inline children, without any markup.
+func nodeText(n ast.Node, source []byte) string {
+	var b strings.Builder
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		switch c := child.(type) {
+		case *ast.Text:
+			b.Write(c.Segment.Value(source))
+			if c.SoftLineBreak() {
+				b.WriteString(" ")
+			}
+		case *ast.String:
+			b.Write(c.Value)
+		default:
+			b.WriteString(nodeText(c, source))
+		}
+	}
+	return b.String()
+}
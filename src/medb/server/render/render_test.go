@@ -0,0 +1,71 @@
+package render
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	notes := map[string]string{
+		"projects/todo.md": "/edit/todo-id",
+		"ideas.md":         "/edit/ideas-id",
+	}
+	resolve := func(notePath string) (string, bool) {
+		url, ok := notes[notePath]
+		return url, ok
+	}
+	content := strings.Join([]string{
+		"# Plans",
+		"",
+		"See [the list](todo.md#soon), [ideas](/ideas.md), [nothing](missing.md) and [the web](https://example.com).",
+		"",
+		"## Soon *enough*",
+		"",
+		"- [x] milk",
+		"- [ ] eggs",
+		"",
+		"| Item | Count |",
+		"| :--- | ----: |",
+		"| milk | 2 |",
+		"",
+		"<script>alert(1)</script><b onclick=\"alert(1)\">bold</b>",
+		"",
+		"[sneaky](javascript:alert(1))",
+	}, "\n")
+
+	note, err := Render("projects/plans.md", content, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<h1 id="plans">Plans</h1>`,
+		`<h2 id="soon-enough">`,
+		`href="/edit/todo-id#soon"`,
+		`href="/edit/ideas-id"`,
+		`href="missing.md"`,
+		`href="https://example.com"`,
+		`<input checked="" disabled="" type="checkbox"`,
+		`<table>`,
+		`<td align="right">2</td>`,
+		`<b>bold</b>`,
+	} {
+		if !strings.Contains(note.HTML, expected) {
+			t.Fatalf("Expected %s in %s", expected, note.HTML)
+		}
+	}
+	for _, unexpected := range []string{"<script", "onclick", "javascript:"} {
+		if strings.Contains(note.HTML, unexpected) {
+			t.Fatalf("Didn't expect %s in %s", unexpected, note.HTML)
+		}
+	}
+
+	expected := []Heading{{1, "plans", "Plans"}, {2, "soon-enough", "Soon enough"}}
+	if len(note.TOC) != len(expected) {
+		t.Fatal(note.TOC)
+	}
+	for i, heading := range note.TOC {
+		if heading != expected[i] {
+			t.Fatal(i, heading)
+		}
+	}
+}
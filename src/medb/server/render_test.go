@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"medb/client"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderNote(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	server := httptest.NewServer(ts.handler)
+	defer server.Close()
+	c, err := client.NewWithToken(server.URL, ts.writeToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	todo, err := c.Create("projects/todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plans, err := c.Create("projects/plans.md", "# Plans\n\nSee [the list](todo.md).\n\n<script>alert(1)</script>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	render := func(token string, fileID string, expectedStatus int) renderedNoteJSON {
+		r := httptest.NewRequest("GET", "http://medb.example/api/1/render?fileID="+fileID, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		ts.handler.ServeHTTP(w, r)
+		if w.Code != expectedStatus {
+			t.Fatalf("Expected %d, got %d: %s", expectedStatus, w.Code, w.Body.String())
+		}
+		var rendered renderedNoteJSON
+		if expectedStatus == 200 {
+			err := json.Unmarshal(w.Body.Bytes(), &rendered)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rendered
+	}
+
+	rendered := render(ts.readToken, plans.ID.String(), 200)
+	if rendered.ID != plans.ID.String() || !strings.Contains(rendered.HTML, `href="/edit/`+todo.ID.String()+`"`) ||
+		strings.Contains(rendered.HTML, "<script") {
+		t.Fatal(rendered)
+	}
+	if len(rendered.TOC) != 1 || rendered.TOC[0] != (headingJSON{Level: 1, ID: "plans", Text: "Plans"}) {
+		t.Fatal(rendered.TOC)
+	}
+	render(ts.readToken, "not-an-id", 400)
+	render(ts.readToken, "00000000-0000-0000-0000-000000000000", 404)
+}
@@ -0,0 +1,55 @@
+package session
+
+import (
+	"errors"
+	"medb/server/tokenstore"
+	"time"
+)
+
+var ErrNotFound = errors.New("session not found")
+
+type Store interface {
+	// Creates a new session for the user and returns it along with the
+	// opaque ID to give to the client.
+	Create(username string, userAgent string, remoteAddr string) (Session, string, error)
+	// Returns the session for an ID from the client, or ErrNotFound if it
+	// doesn't exist or has expired.
+	Get(id string) (Session, error)
+	Delete(id string) error
+	// Deletes every session of the user, logging them out everywhere
+	DeleteAll(username string) error
+	// Returns the user's active sessions, oldest first
+	List(username string) ([]Session, error)
+	// Sets which of the user's DBs the session is working in
+	SetActiveDB(id string, dbName string) error
+}
+
+// NewStore returns a session store that keeps sessions for lifetime. If
+// filePath isn't empty, sessions are persisted there so they survive a
+// restart.
+func NewStore(filePath string, lifetime time.Duration) (Store, error) {
+	s := &storeImpl{
+		File:     tokenstore.NewFile(filePath),
+		lifetime: lifetime,
+		sessions: make(map[string]Session),
+	}
+	err := s.Load(&s.sessions)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Session is what the server knows about a logged in client. The client's ID
+// is never stored, only its hash.
+type Session struct {
+	// A short, non-secret identifier for the session that can be shown to users
+	Handle     string    `json:"handle"`
+	Username   string    `json:"username"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+	UserAgent  string    `json:"userAgent"`
+	RemoteAddr string    `json:"remoteAddr"`
+	// The name of the DB the session is working in, empty for the user's default
+	ActiveDB string `json:"activeDB,omitempty"`
+}
@@ -0,0 +1,118 @@
+package session
+
+import (
+	"medb/server/tokenstore"
+	"sort"
+	"sync"
+	"time"
+)
+
+type storeImpl struct {
+	tokenstore.File
+	lifetime time.Duration
+
+	lock sync.Mutex
+	// Keyed by the hash of the session ID
+	sessions map[string]Session
+}
+
+var _ Store = &storeImpl{}
+
+func (s *storeImpl) Create(username string, userAgent string, remoteAddr string) (Session, string, error) {
+	id, hash, err := tokenstore.NewToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	now := s.Now()
+	session := Session{
+		Handle:     tokenstore.Handle(hash),
+		Username:   username,
+		Created:    now,
+		Expires:    now.Add(s.lifetime),
+		UserAgent:  userAgent,
+		RemoteAddr: remoteAddr,
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[hash] = session
+	return session, id, s.save()
+}
+
+func (s *storeImpl) Get(id string) (Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[tokenstore.Hash(id)]
+	if !ok || !s.Now().Before(session.Expires) {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (s *storeImpl) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hash := tokenstore.Hash(id)
+	if _, ok := s.sessions[hash]; !ok {
+		return ErrNotFound
+	}
+	delete(s.sessions, hash)
+	return s.save()
+}
+
+func (s *storeImpl) DeleteAll(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for hash, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, hash)
+		}
+	}
+	return s.save()
+}
+
+func (s *storeImpl) List(username string) ([]Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.Now()
+	sessions := make([]Session, 0)
+	for _, session := range s.sessions {
+		if session.Username == username && now.Before(session.Expires) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions, nil
+}
+
+func (s *storeImpl) SetActiveDB(id string, dbName string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hash := tokenstore.Hash(id)
+	session, ok := s.sessions[hash]
+	if !ok || !s.Now().Before(session.Expires) {
+		return ErrNotFound
+	}
+	session.ActiveDB = dbName
+	s.sessions[hash] = session
+	return s.save()
+}
+
+// Writes all unexpired sessions to disk. Must be called with the lock held.
+func (s *storeImpl) save() error {
+	now := s.Now()
+	for hash, session := range s.sessions {
+		if !now.Before(session.Expires) {
+			delete(s.sessions, hash)
+		}
+	}
+	return s.Save(s.sessions)
+}
@@ -0,0 +1,126 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-session-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "sessions.json")
+
+	store, err := NewStore(filePath, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1513066695, 0)
+	store.(*storeImpl).Now = func() time.Time { return now }
+
+	_, laptopID, err := store.Create("alice", "laptop", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, phoneID, err := store.Create("alice", "phone", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bobID, err := store.Create("bob", "laptop", "10.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := store.Get(laptopID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Username != "alice" || session.UserAgent != "laptop" {
+		t.Fatal(session)
+	}
+	sessions, err := store.List("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatal(sessions)
+	}
+
+	// Each session has its own active DB
+	err = store.SetActiveDB(phoneID, "personal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.SetActiveDB("missing", "personal") != ErrNotFound {
+		t.Fatal("set the DB of a session that doesn't exist")
+	}
+	if session, _ = store.Get(laptopID); session.ActiveDB != "" {
+		t.Fatal(session)
+	}
+
+	// Sessions survive a restart, and only their hashes are written to disk
+	raw, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{laptopID, phoneID, bobID} {
+		if strings.Contains(string(raw), id) {
+			t.Fatal("session id was written to disk")
+		}
+	}
+	store, err = NewStore(filePath, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.(*storeImpl).Now = func() time.Time { return now }
+	session, err = store.Get(phoneID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ActiveDB != "personal" {
+		t.Fatal(session)
+	}
+
+	// Logging out only ends that session
+	err = store.Delete(laptopID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(laptopID); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(phoneID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Logging out everywhere leaves other users alone
+	err = store.DeleteAll("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(phoneID); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(bobID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions expire
+	now = now.Add(time.Hour)
+	if _, err = store.Get(bobID); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	sessions, err = store.List("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatal(sessions)
+	}
+}
@@ -0,0 +1,55 @@
+package share
+
+import (
+	"errors"
+	"medb/server/tokenstore"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrNotFound = errors.New("share not found")
+
+// Store keeps the links that let anyone read a single note without logging in.
+type Store interface {
+	// Creates a share of the note and returns it along with the opaque token
+	// for its link. A zero expires means it never expires.
+	Create(dbPath string, fileID uuid.UUID, createdBy string, expires time.Time) (Share, string, error)
+	// Returns the share for a token from a link, or ErrNotFound if it doesn't
+	// exist, was revoked or has expired.
+	Get(token string) (Share, error)
+	// Returns the DB's unexpired shares, oldest first
+	List(dbPath string) ([]Share, error)
+	// Revokes one of the DB's shares by its handle
+	Revoke(dbPath string, handle string) error
+}
+
+// NewStore returns a share store. If filePath isn't empty, shares are
+// persisted there so they survive a restart.
+func NewStore(filePath string) (Store, error) {
+	s := &storeImpl{
+		File:   tokenstore.NewFile(filePath),
+		shares: make(map[string]Share),
+	}
+	err := s.Load(&s.shares)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Share is a link to a note. The token is never stored, only its hash.
+type Share struct {
+	// A short, non-secret identifier for the share that can be shown to users
+	Handle    string    `json:"handle"`
+	DBPath    string    `json:"dbPath"`
+	FileID    uuid.UUID `json:"fileID"`
+	CreatedBy string    `json:"createdBy"`
+	Created   time.Time `json:"created"`
+	// Zero if the share never expires
+	Expires time.Time `json:"expires"`
+}
+
+func (s Share) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && !now.Before(s.Expires)
+}
@@ -0,0 +1,96 @@
+package share
+
+import (
+	"medb/server/tokenstore"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type storeImpl struct {
+	tokenstore.File
+
+	lock sync.Mutex
+	// Keyed by the hash of the token
+	shares map[string]Share
+}
+
+var _ Store = &storeImpl{}
+
+func (s *storeImpl) Create(dbPath string, fileID uuid.UUID, createdBy string, expires time.Time) (Share, string, error) {
+	token, hash, err := tokenstore.NewToken()
+	if err != nil {
+		return Share{}, "", err
+	}
+
+	share := Share{
+		Handle:    tokenstore.Handle(hash),
+		DBPath:    path.Clean(dbPath),
+		FileID:    fileID,
+		CreatedBy: createdBy,
+		Created:   s.Now(),
+		Expires:   expires,
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.shares[hash] = share
+	return share, token, s.save()
+}
+
+func (s *storeImpl) Get(token string) (Share, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	share, ok := s.shares[tokenstore.Hash(token)]
+	if !ok || share.expired(s.Now()) {
+		return Share{}, ErrNotFound
+	}
+	return share, nil
+}
+
+func (s *storeImpl) List(dbPath string) ([]Share, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dbPath = path.Clean(dbPath)
+	now := s.Now()
+	shares := make([]Share, 0)
+	for _, share := range s.shares {
+		if share.DBPath == dbPath && !share.expired(now) {
+			shares = append(shares, share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Created.Before(shares[j].Created)
+	})
+	return shares, nil
+}
+
+func (s *storeImpl) Revoke(dbPath string, handle string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dbPath = path.Clean(dbPath)
+	for hash, share := range s.shares {
+		if share.DBPath == dbPath && share.Handle == handle {
+			delete(s.shares, hash)
+			return s.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// Writes all unexpired shares to disk. Must be called with the lock held.
+func (s *storeImpl) save() error {
+	now := s.Now()
+	for hash, share := range s.shares {
+		if share.expired(now) {
+			delete(s.shares, hash)
+		}
+	}
+	return s.Save(s.shares)
+}
@@ -0,0 +1,100 @@
+package share
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestShareLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-share-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "shares.json")
+
+	store, err := NewStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1513066695, 0)
+	store.(*storeImpl).Now = func() time.Time { return now }
+
+	fileID := uuid.New()
+	forever, foreverToken, err := store.Create("/notes", fileID, "alice", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dayToken, err := store.Create("/notes/", fileID, "alice", now.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherToken, err := store.Create("/other", uuid.New(), "bob", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	share, err := store.Get(foreverToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if share.FileID != fileID || share.DBPath != "/notes" || share.CreatedBy != "alice" {
+		t.Fatal(share)
+	}
+	if _, err = store.Get(foreverToken + "x"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	// Shares survive a restart, and only their hashes are written to disk
+	raw, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{foreverToken, dayToken, otherToken} {
+		if strings.Contains(string(raw), token) {
+			t.Fatal("share token was written to disk")
+		}
+	}
+	store, err = NewStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.(*storeImpl).Now = func() time.Time { return now }
+	shares, err := store.List("/notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 2 {
+		t.Fatal(shares)
+	}
+
+	// Shares can only be revoked from their own DB
+	if store.Revoke("/other", forever.Handle) != ErrNotFound {
+		t.Fatal("revoked a share from another DB")
+	}
+	err = store.Revoke("/notes", forever.Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(foreverToken); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	// Shares expire
+	if _, err = store.Get(dayToken); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(24 * time.Hour)
+	if _, err = store.Get(dayToken); err != ErrNotFound {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(otherToken); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"medb/server/audit"
+	"medb/server/render"
+	"medb/server/share"
+	"medb/storage"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const sharePathPrefix = "/share/"
+
+// The page anyone with a share link sees. The note is rendered the same way
+// as in the app, and sanitized so nothing in it can run in the reader's
+// browser.
+var sharePageTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; }
+pre { white-space: pre-wrap; word-wrap: break-word; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+{{.HTML}}
+</body>
+</html>
+`))
+
+type shareJSON struct {
+	Handle    string    `json:"handle"`
+	FileID    string    `json:"fileID"`
+	CreatedBy string    `json:"createdBy"`
+	Created   time.Time `json:"created"`
+	// Omitted if the share never expires
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func newShareJSON(s share.Share) shareJSON {
+	j := shareJSON{
+		Handle:    s.Handle,
+		FileID:    s.FileID.String(),
+		CreatedBy: s.CreatedBy,
+		Created:   s.Created,
+	}
+	if !s.Expires.IsZero() {
+		j.Expires = &s.Expires
+	}
+	return j
+}
+
+// Serves a shared note to anyone with the link, no login needed.
+func sharePageHandler(shares share.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The token is the secret, so don't leak it to anything the page links to
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("X-Robots-Tag", "noindex")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+
+		token := strings.TrimPrefix(r.URL.Path, sharePathPrefix)
+		s, err := shares.Get(token)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := storage.NewDB(s.DBPath).LoadFile(s.FileID)
+		if err != nil {
+			// The note was deleted since it was shared
+			http.NotFound(w, r)
+			return
+		}
+
+		notePath := strings.TrimPrefix(f.Path(), strings.TrimSuffix(s.DBPath, "/")+"/")
+		// Only this note is shared, so links to others are left alone
+		note, err := render.Render(notePath, f.Content(), func(string) (string, bool) {
+			return "", false
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = sharePageTemplate.Execute(w, struct {
+			Name string
+			// render.Render already sanitized it
+			HTML template.HTML
+		}{f.Name(), template.HTML(note.HTML)})
+		if err != nil {
+			logger.Printf("Unable to render share %s: %v", s.Handle, err)
+		}
+	}
+}
+
+// Lists the shares of notes in the active DB.
+func sharesHandler(a *auth, shares share.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, db, _ := a.getMembership(w, r, accessReadNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		list, err := shares.List(db.Path)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		sharesJSON := make([]shareJSON, len(list))
+		for i, s := range list {
+			sharesJSON[i] = newShareJSON(s)
+		}
+		raw, err := json.Marshal(sharesJSON)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+// Shares a note from the active DB. Takes an optional expiresIn duration, like
+// 24h, and returns the share along with its link.
+func createShareHandler(a *auth, shares share.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, db, _ := a.getMembership(w, r, accessWriteNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		fileID, err := uuid.Parse(r.PostFormValue("fileID"))
+		if err != nil {
+			http.Error(w, "unable to parse fileid", 400)
+			return
+		}
+		var expires time.Time
+		if expiresIn := r.PostFormValue("expiresIn"); expiresIn != "" {
+			duration, err := time.ParseDuration(expiresIn)
+			if err != nil || duration <= 0 {
+				http.Error(w, "Invalid expiresIn", 400)
+				return
+			}
+			expires = time.Now().Add(duration)
+		}
+
+		// Make sure the note exists before handing out a link to it
+		_, err = storage.NewDB(db.Path).LoadFile(fileID)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		s, token, err := shares.Create(db.Path, fileID, u.Name(), expires)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		logger.Printf("%s shared %s from %s", u.Name(), fileID, db.Path)
+		a.recordAction(r, u, audit.ActionShare, fileID.String(), s.Handle)
+
+		// This is the only time the link is ever shown
+		raw, err := json.Marshal(struct {
+			shareJSON
+			Path string `json:"path"`
+		}{newShareJSON(s), sharePathPrefix + token})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		fmt.Fprint(w, string(raw))
+	}
+}
+
+func revokeShareHandler(a *auth, shares share.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, db, _ := a.getMembership(w, r, accessWriteNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form.", 400)
+			return
+		}
+		err = shares.Revoke(db.Path, r.PostFormValue("handle"))
+		if err == share.ErrNotFound {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		logger.Printf("%s revoked share %s from %s", u.Name(), r.PostFormValue("handle"), db.Path)
+		fmt.Fprint(w, successJSON)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"medb/client"
+	"medb/server/share"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharePage(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	server := httptest.NewServer(ts.handler)
+	defer server.Close()
+	c, err := client.NewWithToken(server.URL, ts.writeToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Create("projects/todo.md", "milk"); err != nil {
+		t.Fatal(err)
+	}
+	plans, err := c.Create("projects/plans.md", "# Plans\n\nSee **[the list](todo.md)**.\n\n<script>alert(1)</script>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := share.NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := shares.Create(ts.dbPath, plans.ID, "alice", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://medb.example"+sharePathPrefix+token, nil)
+	w := httptest.NewRecorder()
+	sharePageHandler(shares)(w, r)
+	if w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	page := w.Body.String()
+	// Rendered like in the app, but without linking to notes that aren't shared
+	if !strings.Contains(page, `<h1 id="plans">Plans</h1>`) ||
+		!strings.Contains(page, `<strong><a href="todo.md"`) ||
+		strings.Contains(page, "<script") || strings.Contains(page, "/edit/") {
+		t.Fatal(page)
+	}
+
+	r = httptest.NewRequest("GET", "http://medb.example"+sharePathPrefix+token+"x", nil)
+	w = httptest.NewRecorder()
+	sharePageHandler(shares)(w, r)
+	if w.Code != 404 {
+		t.Fatal(w.Code)
+	}
+}
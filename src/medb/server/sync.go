@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"medb/commitpolicy"
+	"medb/server/audit"
+	"medb/server/user"
+	"medb/storage"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Offline clients keep a cursor, the commit they last synced, and ask for
+// the changes since then. They upload what they changed offline in batches,
+// each change saying which version of the note it was made to.
+
+// The most changes one upload can have
+const maxUploadChanges = 1000
+
+// The results of an uploaded change
+const (
+	uploadApplied = "applied"
+	// The note changed on the server since the client's version, or the path
+	// is taken
+	uploadConflict = "conflict"
+	// The change doesn't make sense, retrying it won't help
+	uploadRejected = "rejected"
+	// Something went wrong on the server, it can be retried
+	uploadFailed = "failed"
+)
+
+type changeJSON struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// Left out for deletes
+	Hash    string  `json:"hash,omitempty"`
+	Content *string `json:"content,omitempty"`
+}
+
+type changesJSON struct {
+	// To send as since next time
+	Cursor  string       `json:"cursor"`
+	Changes []changeJSON `json:"changes"`
+}
+
+// A change made offline. Without an ID it creates a note at the path,
+// otherwise it changes the note whose content hashed to BaseHash when the
+// client last synced it.
+type uploadChangeJSON struct {
+	ID       string  `json:"id"`
+	BaseHash string  `json:"baseHash"`
+	Path     string  `json:"path"`
+	Content  *string `json:"content"`
+	Deleted  bool    `json:"deleted"`
+}
+
+type uploadJSON struct {
+	Changes []uploadChangeJSON `json:"changes"`
+}
+
+// The result of a change. For conflicts, the note as it is on the server if
+// it still exists.
+type uploadResultJSON struct {
+	Status  string  `json:"status"`
+	Message string  `json:"message,omitempty"`
+	ID      string  `json:"id,omitempty"`
+	Path    string  `json:"path,omitempty"`
+	Hash    string  `json:"hash,omitempty"`
+	Content *string `json:"content,omitempty"`
+}
+
+// Results are in the same order as the changes.
+type uploadResultsJSON struct {
+	Results []uploadResultJSON `json:"results"`
+}
+
+func v2ChangesHandler(a *auth) v2Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, _, db := a.getV2DB(w, r, accessReadNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		changeSet, err := db.ChangesSince(r.URL.Query().Get("since"))
+		if err == storage.ErrUnknownCommit {
+			writeV2Error(w, 410, "Unknown cursor, sync again without one")
+			return
+		}
+		if err != nil {
+			writeV2Error(w, 500, err.Error())
+			return
+		}
+
+		response := changesJSON{Cursor: changeSet.Commit, Changes: make([]changeJSON, len(changeSet.Changes))}
+		for i, change := range changeSet.Changes {
+			response.Changes[i] = changeJSON{
+				Type: change.Type,
+				ID:   change.ID.String(),
+				Path: change.Path,
+				Hash: change.Hash,
+			}
+			if change.Type != storage.ChangeDeleted {
+				content := change.Content
+				response.Changes[i].Content = &content
+			}
+		}
+		writeV2JSON(w, 200, response)
+	}
+}
+
+// Applies each change on its own, so one conflict doesn't hold up the rest,
+// then commits everything that was applied at once.
+func v2UploadHandler(a *auth, commits commitPolicy) v2Handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, dbInfo, db := a.getV2DB(w, r, accessWriteNotes)
+		if u == nil {
+			// This doesn't write an error because we already did that
+			return
+		}
+		var request uploadJSON
+		if !readV2JSON(w, r, &request) {
+			return
+		}
+		if len(request.Changes) > maxUploadChanges {
+			writeV2Error(w, 400, fmt.Sprintf("At most %d changes can be uploaded at once", maxUploadChanges))
+			return
+		}
+
+		response := uploadResultsJSON{Results: make([]uploadResultJSON, len(request.Changes))}
+		applied := 0
+		for i, change := range request.Changes {
+			result, action := applyUpload(dbInfo, db, change)
+			response.Results[i] = result
+			if action != "" {
+				applied++
+				a.recordAction(r, u, action, result.ID, "sync")
+			}
+		}
+		if applied > 0 {
+			err := commits.commitAsUser(db, u, commitpolicy.OperationSync, fmt.Sprintf("%d notes", applied), uuid.Nil)
+			if err != nil {
+				writeV2Error(w, 500, err.Error())
+				return
+			}
+		}
+		writeV2JSON(w, 200, response)
+	}
+}
+
+// Applies one uploaded change, returning its result and the audit action if
+// anything changed.
+func applyUpload(dbInfo user.DB, db storage.DB, change uploadChangeJSON) (uploadResultJSON, string) {
+	if change.ID == "" {
+		return uploadCreate(dbInfo, db, change)
+	}
+	fileID, err := uuid.Parse(change.ID)
+	if err != nil {
+		return uploadResultJSON{Status: uploadRejected, Message: fmt.Sprintf("Invalid note ID %q", change.ID)}, ""
+	}
+	result := uploadResultJSON{ID: fileID.String()}
+	if change.BaseHash == "" {
+		result.Status = uploadRejected
+		result.Message = "The base hash is required"
+		return result, ""
+	}
+	f, err := db.LoadFile(fileID)
+	if err == storage.ErrFileNotFound {
+		if change.Deleted {
+			result.Status = uploadApplied
+			return result, ""
+		}
+		result.Status = uploadConflict
+		result.Message = "The note was deleted"
+		return result, ""
+	}
+	if err != nil {
+		return uploadError(result, err), ""
+	}
+
+	currentHash := storage.ContentHash(f.Content())
+	if change.Deleted {
+		if currentHash != change.BaseHash {
+			return uploadConflictWith(dbInfo, f), ""
+		}
+		err = db.DeleteFile(fileID)
+		if err != nil {
+			return uploadError(result, err), ""
+		}
+		result.Status = uploadApplied
+		return result, audit.ActionDelete
+	}
+	if change.Content == nil && change.Path == "" {
+		result.Status = uploadRejected
+		result.Message = "The change needs a content, a path or to delete the note"
+		return result, ""
+	}
+	// Uploading the same change again finds it already applied
+	alreadyApplied := change.Content != nil && currentHash == storage.ContentHash(*change.Content)
+	if currentHash != change.BaseHash && !alreadyApplied {
+		return uploadConflictWith(dbInfo, f), ""
+	}
+
+	action := ""
+	if change.Path != "" && change.Path != newNoteJSON(dbInfo, f, false).Path {
+		f, err = db.MoveFile(fileID, change.Path)
+		if _, ok := err.(*storage.InvalidPathError); ok {
+			result.Status = uploadRejected
+			result.Message = err.Error()
+			return result, ""
+		}
+		if err == storage.ErrFileExists {
+			result.Status = uploadConflict
+			result.Message = fmt.Sprintf("%s already exists", change.Path)
+			return result, ""
+		}
+		if err != nil {
+			return uploadError(result, err), ""
+		}
+		action = audit.ActionMove
+	}
+	if change.Content != nil && !alreadyApplied {
+		f.Update(*change.Content)
+		err = db.SaveFile(f)
+		if err != nil {
+			return uploadError(result, err), action
+		}
+		action = audit.ActionEdit
+	}
+	return uploadAppliedTo(dbInfo, f), action
+}
+
+func uploadCreate(dbInfo user.DB, db storage.DB, change uploadChangeJSON) (uploadResultJSON, string) {
+	if change.Deleted {
+		return uploadResultJSON{Status: uploadRejected, Message: "Only existing notes can be deleted"}, ""
+	}
+	content := ""
+	if change.Content != nil {
+		content = *change.Content
+	}
+	f, err := db.CreateFile(change.Path, content)
+	if _, ok := err.(*storage.InvalidPathError); ok {
+		return uploadResultJSON{Status: uploadRejected, Message: err.Error()}, ""
+	}
+	if err == storage.ErrFileExists {
+		return uploadResultJSON{Status: uploadConflict, Message: fmt.Sprintf("%s already exists", change.Path)}, ""
+	}
+	if err != nil {
+		return uploadError(uploadResultJSON{}, err), ""
+	}
+	return uploadAppliedTo(dbInfo, f), audit.ActionCreate
+}
+
+func uploadAppliedTo(dbInfo user.DB, f storage.File) uploadResultJSON {
+	return uploadResultJSON{
+		Status: uploadApplied,
+		ID:     f.ID().String(),
+		Path:   newNoteJSON(dbInfo, f, false).Path,
+		Hash:   storage.ContentHash(f.Content()),
+	}
+}
+
+func uploadConflictWith(dbInfo user.DB, f storage.File) uploadResultJSON {
+	note := newNoteJSON(dbInfo, f, true)
+	return uploadResultJSON{
+		Status:  uploadConflict,
+		Message: "The note changed since it was synced",
+		ID:      note.ID,
+		Path:    note.Path,
+		Hash:    storage.ContentHash(f.Content()),
+		Content: note.Content,
+	}
+}
+
+func uploadError(result uploadResultJSON, err error) uploadResultJSON {
+	result.Status = uploadFailed
+	result.Message = "Unable to apply the change: " + strings.TrimSpace(err.Error())
+	return result
+}
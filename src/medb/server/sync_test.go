@@ -0,0 +1,123 @@
+package main
+
+import (
+	"medb/client"
+	"medb/storage"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSync(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.cleanUp()
+	server := httptest.NewServer(ts.handler)
+	defer server.Close()
+	c, err := client.NewWithToken(server.URL, ts.writeToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := func(s string) *string { return &s }
+
+	ideas, err := c.Create("ideas.md", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	todo, err := c.Create("todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := c.Changes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Changes) != 2 || all.Cursor == "" {
+		t.Fatal(all)
+	}
+	if change := all.Changes[0]; change.Type != storage.ChangeCreated || change.ID != ideas.ID || change.Content != "one" {
+		t.Fatal(change)
+	}
+	ideasHash, todoHash := all.Changes[0].Hash, all.Changes[1].Hash
+
+	// Someone else edits the todo list while we're offline
+	err = c.Edit(todo.ID, "milk, eggs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := c.UploadChanges([]client.Upload{
+		{ID: ideas.ID, BaseHash: ideasHash, Path: "archive/ideas.md", Content: content("two")},
+		{ID: todo.ID, BaseHash: todoHash, Content: content("milk, bread")},
+		{Path: "shopping.md", Content: content("eggs")},
+		{Path: "../outside.md", Content: content("eggs")},
+		{ID: uuid.New(), BaseHash: todoHash, Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"applied", "conflict", "applied", "rejected", "applied"}
+	if len(results) != len(expected) {
+		t.Fatal(results)
+	}
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Fatal(i, result)
+		}
+	}
+	if results[0].Path != "archive/ideas.md" || results[0].Hash != storage.ContentHash("two") {
+		t.Fatal(results[0])
+	}
+	if results[1].Content != "milk, eggs" || results[1].Hash != storage.ContentHash("milk, eggs") {
+		t.Fatal(results[1])
+	}
+	// Retrying what already applied doesn't conflict
+	retried, err := c.UploadChanges([]client.Upload{{ID: ideas.ID, BaseHash: ideasHash, Content: content("two")}})
+	if err != nil || retried[0].Status != "applied" {
+		t.Fatal(retried, err)
+	}
+
+	changes, err := c.Changes(all.Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]string{}
+	for _, change := range changes.Changes {
+		types[change.Path] = change.Type
+	}
+	if len(types) != 3 || types["archive/ideas.md"] != "updated" || types["shopping.md"] != "created" ||
+		types["todo.md"] != "updated" {
+		t.Fatal(changes)
+	}
+
+	// Deletes need the latest hash too
+	results, err = c.UploadChanges([]client.Upload{{ID: todo.ID, BaseHash: todoHash, Deleted: true}})
+	if err != nil || results[0].Status != "conflict" {
+		t.Fatal(results, err)
+	}
+	results, err = c.UploadChanges([]client.Upload{{ID: todo.ID, BaseHash: results[0].Hash, Deleted: true}})
+	if err != nil || results[0].Status != "applied" {
+		t.Fatal(results, err)
+	}
+	changes, err = c.Changes(changes.Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Changes) != 1 || changes.Changes[0].Type != "deleted" || changes.Changes[0].ID != todo.ID {
+		t.Fatal(changes)
+	}
+
+	if _, err = c.Changes("0000000000000000000000000000000000000000"); err != client.ErrUnknownCursor {
+		t.Fatal(err)
+	}
+	reader, err := client.NewWithToken(server.URL, ts.readToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reader.Changes(""); err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.UploadChanges([]client.Upload{{Path: "new.md"}})
+	if clientErr, ok := err.(*client.Error); !ok || clientErr.StatusCode != 403 {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,78 @@
+// Package tokenstore has the parts of a store that hands out random tokens,
+// only ever keeps their hashes, and persists what they're for to a JSON file.
+package tokenstore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"medb/atomicfile"
+	"os"
+	"time"
+)
+
+// NewToken returns a new random token along with its hash.
+func NewToken() (string, string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, Hash(token), nil
+}
+
+// Hash returns what a token is stored as.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Handle returns a short, non-secret identifier for the token with this hash
+// that can be shown to users.
+func Handle(hash string) string {
+	return hash[:12]
+}
+
+// File is where a store persists its records.
+type File struct {
+	// Nothing is persisted if it's empty
+	Path string
+	// Replaced in tests
+	Now func() time.Time
+}
+
+// NewFile returns a File at filePath that uses the real time.
+func NewFile(filePath string) File {
+	return File{Path: filePath, Now: time.Now}
+}
+
+// Load reads the records into v. It does nothing if the file doesn't exist.
+func (f File) Load(v interface{}) error {
+	if f.Path == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Save replaces the file with the records in v.
+func (f File) Save(v interface{}) error {
+	if f.Path == "" {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(f.Path, raw, 0600)
+}
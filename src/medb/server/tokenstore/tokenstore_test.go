@@ -0,0 +1,59 @@
+package tokenstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestNewToken(t *testing.T) {
+	token, hash, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherHash, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == other || hash == otherHash {
+		t.Fatal("tokens aren't random")
+	}
+	if hash != Hash(token) || hash == token || len(Handle(hash)) != 12 || !strings.HasPrefix(hash, Handle(hash)) {
+		t.Fatal(token, hash)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-tokenstore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewFile(path.Join(dir, "tokens.json"))
+	records := map[string]string{}
+	// A file that doesn't exist yet has no records
+	err = f.Load(&records)
+	if err != nil || len(records) != 0 {
+		t.Fatal(records, err)
+	}
+	err = f.Save(map[string]string{"abc": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewFile(f.Path).Load(&records)
+	if err != nil || records["abc"] != "alice" {
+		t.Fatal(records, err)
+	}
+
+	// Nothing is persisted without a path
+	memory := NewFile("")
+	if err = memory.Save(records); err != nil {
+		t.Fatal(err)
+	}
+	if err = memory.Load(&records); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,65 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The name of the DB when the users file only has a path for the user
+const DefaultDBName = "default"
+
+// DB is one of a user's note repositories.
+type DB struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// A user's DBs are stored in the path column. A plain path is a single DB
+// called DefaultDBName, otherwise it's semicolon separated entries of
+// name=path. Older users files can have relative paths, so anything that
+// isn't absolute and has no = in it is a plain path too.
+func encodeDBs(dbs []DB) string {
+	if len(dbs) == 1 && dbs[0].Name == DefaultDBName {
+		return dbs[0].Path
+	}
+	encoded := make([]string, len(dbs))
+	for i, db := range dbs {
+		encoded[i] = db.Name + "=" + db.Path
+	}
+	return strings.Join(encoded, ";")
+}
+
+func decodeDBs(column string) ([]DB, error) {
+	if strings.HasPrefix(column, "/") || !strings.Contains(column, "=") {
+		return []DB{{Name: DefaultDBName, Path: column}}, nil
+	}
+	dbs := make([]DB, 0)
+	for _, encoded := range strings.Split(column, ";") {
+		i := strings.Index(encoded, "=")
+		if i <= 0 {
+			return nil, errors.New("malformed users file, invalid DB")
+		}
+		dbs = append(dbs, DB{Name: encoded[:i], Path: encoded[i+1:]})
+	}
+	return dbs, nil
+}
+
+func validateDBName(name string) error {
+	if name == "" {
+		return errors.New("DB name can't be empty")
+	}
+	if strings.ContainsAny(name, "=;,/ \t\r\n") {
+		return fmt.Errorf("DB name %s can't contain whitespace or any of =;,/", name)
+	}
+	return nil
+}
+
+func findDB(dbs []DB, name string) int {
+	for i, db := range dbs {
+		if db.Name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -1,13 +1,74 @@
 package user
 
+import (
+	"sync"
+	"time"
+)
+
 type Store interface {
 	Login(username string, password string) (User, error)
+	Lookup(username string) (User, error)
+	// Changes the user's password, as long as the old one is correct
+	ChangePassword(username string, oldPassword string, newPassword string) error
+	// Sets the optional profile fields, empty values clear them
+	UpdateProfile(username string, displayName string, email string) error
+
+	// Starts enrolling a TOTP second factor and returns its secret. It isn't
+	// required to login until it's confirmed. Fails with ErrTOTPEnabled if the
+	// user already has one, which has to be disabled first.
+	BeginTOTPEnrollment(username string) (string, error)
+	// Turns on the pending TOTP secret if the code is valid for it at now,
+	// and returns the user's new recovery codes.
+	ConfirmTOTPEnrollment(username string, code string, now time.Time) ([]string, error)
+	DisableTOTP(username string, password string) error
+	// Checks a TOTP code or a recovery code. Neither can ever be used again.
+	VerifySecondFactor(username string, code string, now time.Time) error
+
+	// Creates a personal access token. This is the only time the token itself
+	// is available, only its hash is kept.
+	CreateToken(username string, name string, scope string, now time.Time) (string, Token, error)
+	ListTokens(username string) ([]Token, error)
+	RevokeToken(username string, tokenID string) error
+	// Returns the user a token belongs to, and what it may do
+	LoginWithToken(token string) (User, Token, error)
+}
+
+// WritableStore is a Store that can also change the users file. Every change
+// rewrites the file atomically.
+type WritableStore interface {
+	Store
+	List() ([]User, error)
+	Add(username string, password string, dbPath string) error
+	Remove(username string) error
+	SetPassword(username string, password string) error
+	SetPath(username string, dbPath string) error
+	AddDB(username string, name string, dbPath string) error
+	RemoveDB(username string, name string) error
 }
 
 func NewStore(userFilePath string) Store {
-	return userStoreImpl{userFilePath}
+	return NewWritableStore(userFilePath)
+}
+
+func NewWritableStore(userFilePath string) WritableStore {
+	return userStoreImpl{
+		userFilePath: userFilePath,
+		lock:         &sync.Mutex{},
+		cache:        &recordCache{},
+	}
 }
 
 type User interface {
+	Name() string
+	// The path of the user's default DB, which is their first
 	Path() string
+	// Every DB the user has, the default first
+	DBs() []DB
+	DB(name string) (DB, bool)
+	// The name and email to attribute changes to, falls back to the username
+	// when the users file doesn't have one.
+	DisplayName() string
+	Email() string
+	// True if logging in also needs a TOTP or recovery code
+	HasTOTP() bool
 }
@@ -1,57 +1,678 @@
 package user
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/csv"
 	"errors"
+	"fmt"
+	"medb/atomicfile"
+	"net/mail"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type userStoreImpl struct {
 	// Path to a file that stores the user entries. These should be stored in CSV format:
-	// username,passwordHash,pathToDB
+	// username,passwordHash,pathToDB[,displayName,email,totpSecret,pendingTOTPSecret,recoveryCodeHashes,tokens,
+	// lastTOTPCounter]
+	// where pathToDB may list several DBs as encoded by encodeDBs, recoveryCodeHashes are separated
+	// by semicolons, tokens are encoded by encodeTokens and lastTOTPCounter is the time step of the last
+	// TOTP code that was accepted.
 	userFilePath string
+	// Serializes changes to the file from this process
+	lock  *sync.Mutex
+	cache *recordCache
 }
 
-var _ Store = userStoreImpl{}
+// recordCache holds the parsed users file until it changes on disk.
+type recordCache struct {
+	lock    sync.Mutex
+	records [][]string
+	// The file they were read from or written to
+	info os.FileInfo
+}
+
+// Returns true if the file could have changed since the records were cached.
+// Every update renames a new file into place, so the file itself changes even
+// when its time and size don't.
+func (c *recordCache) stale(info os.FileInfo) bool {
+	return c.records == nil ||
+		!os.SameFile(info, c.info) ||
+		!info.ModTime().Equal(c.info.ModTime()) ||
+		info.Size() != c.info.Size()
+}
+
+// Caches the records, padded out to numColumns.
+func (c *recordCache) set(records [][]string, info os.FileInfo) {
+	c.records = make([][]string, len(records))
+	for i, record := range records {
+		c.records[i] = append([]string(nil), record...)
+		for len(c.records[i]) < numColumns {
+			c.records[i] = append(c.records[i], "")
+		}
+	}
+	c.info = info
+}
+
+var _ WritableStore = userStoreImpl{}
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrInvalidCode  = errors.New("invalid code")
+	ErrTOTPEnabled  = errors.New("TOTP is already enabled, disable it first")
+)
+
+// The column indices of the users file
+const (
+	usernameColumn = iota
+	passwordHashColumn
+	pathColumn
+	displayNameColumn
+	emailColumn
+	totpSecretColumn
+	pendingTOTPSecretColumn
+	recoveryCodesColumn
+	tokensColumn
+	lastTOTPCounterColumn
+	numColumns
+)
 
 func (s userStoreImpl) Login(username string, password string) (User, error) {
+	records, err := s.readRecords()
+	if err != nil {
+		return nil, err
+	}
+	record, _, err := findRecord(records, username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Now see if the password matches
+	err = bcrypt.CompareHashAndPassword([]byte(record[passwordHashColumn]), []byte(password))
+	if err != nil {
+		return nil, err
+	}
+	return newUserFromRecord(record), nil
+}
+
+func (s userStoreImpl) Lookup(username string) (User, error) {
+	records, err := s.readRecords()
+	if err != nil {
+		return nil, err
+	}
+	record, _, err := findRecord(records, username)
+	if err != nil {
+		return nil, err
+	}
+	return newUserFromRecord(record), nil
+}
+
+func (s userStoreImpl) ChangePassword(username string, oldPassword string, newPassword string) error {
+	_, err := s.Login(username, oldPassword)
+	if err != nil {
+		return err
+	}
+	return s.SetPassword(username, newPassword)
+}
+
+func (s userStoreImpl) UpdateProfile(username string, displayName string, email string) error {
+	err := validateProfile(displayName, email)
+	if err != nil {
+		return err
+	}
+	return s.update(func(records [][]string) ([][]string, error) {
+		record, _, err := findRecord(records, username)
+		if err != nil {
+			return nil, err
+		}
+		record[displayNameColumn] = displayName
+		record[emailColumn] = email
+		return records, nil
+	})
+}
+
+func (s userStoreImpl) BeginTOTPEnrollment(username string) (string, error) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	return secret, s.update(func(records [][]string) ([][]string, error) {
+		record, _, err := findRecord(records, username)
+		if err != nil {
+			return nil, err
+		}
+		// Otherwise a session alone could replace the second factor
+		if record[totpSecretColumn] != "" {
+			return nil, ErrTOTPEnabled
+		}
+		record[pendingTOTPSecretColumn] = secret
+		return records, nil
+	})
+}
+
+func (s userStoreImpl) ConfirmTOTPEnrollment(username string, code string, now time.Time) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = s.update(func(records [][]string) ([][]string, error) {
+		record, _, err := findRecord(records, username)
+		if err != nil {
+			return nil, err
+		}
+		if record[totpSecretColumn] != "" {
+			return nil, ErrTOTPEnabled
+		}
+		pendingSecret := record[pendingTOTPSecretColumn]
+		if pendingSecret == "" {
+			return nil, errors.New("no TOTP enrollment in progress")
+		}
+		counter, ok := validateTOTP(pendingSecret, code, now)
+		if !ok {
+			return nil, ErrInvalidCode
+		}
+		record[totpSecretColumn] = pendingSecret
+		record[pendingTOTPSecretColumn] = ""
+		record[recoveryCodesColumn] = strings.Join(hashes, ";")
+		record[lastTOTPCounterColumn] = strconv.FormatInt(counter, 10)
+		return records, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (s userStoreImpl) DisableTOTP(username string, password string) error {
+	_, err := s.Login(username, password)
+	if err != nil {
+		return err
+	}
+	return s.update(func(records [][]string) ([][]string, error) {
+		record, _, err := findRecord(records, username)
+		if err != nil {
+			return nil, err
+		}
+		record[totpSecretColumn] = ""
+		record[pendingTOTPSecretColumn] = ""
+		record[recoveryCodesColumn] = ""
+		record[lastTOTPCounterColumn] = ""
+		return records, nil
+	})
+}
+
+// Checks and uses up the code in one update, so two logins can never both
+// use the same one.
+func (s userStoreImpl) VerifySecondFactor(username string, code string, now time.Time) error {
+	return s.update(func(records [][]string) ([][]string, error) {
+		record, _, err := findRecord(records, username)
+		if err != nil {
+			return nil, err
+		}
+		if record[totpSecretColumn] == "" {
+			return nil, errors.New("user doesn't have a second factor")
+		}
+		if counter, ok := validateTOTP(record[totpSecretColumn], code, now); ok {
+			// RFC 6238 section 5.2, a code that was already accepted can't be
+			// used again, and nor can any older one
+			lastCounter, _ := strconv.ParseInt(record[lastTOTPCounterColumn], 10, 64)
+			if counter <= lastCounter {
+				return nil, ErrInvalidCode
+			}
+			record[lastTOTPCounterColumn] = strconv.FormatInt(counter, 10)
+			return records, nil
+		}
+
+		// Maybe it's a recovery code, those get used up
+		codeHash := hashRecoveryCode(code)
+		hashes := strings.Split(record[recoveryCodesColumn], ";")
+		for i, hash := range hashes {
+			if hash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(codeHash)) == 1 {
+				hashes = append(hashes[:i], hashes[i+1:]...)
+				record[recoveryCodesColumn] = strings.Join(hashes, ";")
+				return records, nil
+			}
+		}
+		return nil, ErrInvalidCode
+	})
+}
+
+func (s userStoreImpl) CreateToken(username string, name string, scope string, now time.Time) (string, Token, error) {
+	err := validateScope(scope)
+	if err != nil {
+		return "", Token{}, err
+	}
+	token, stored, err := generateToken(name, scope, now)
+	if err != nil {
+		return "", Token{}, err
+	}
+	err = s.updateTokens(username, func(tokens []storedToken) ([]storedToken, error) {
+		return append(tokens, stored), nil
+	})
+	if err != nil {
+		return "", Token{}, err
+	}
+	return token, stored.Token, nil
+}
+
+func (s userStoreImpl) ListTokens(username string) ([]Token, error) {
+	records, err := s.readRecords()
+	if err != nil {
+		return nil, err
+	}
+	record, _, err := findRecord(records, username)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := decodeTokens(record[tokensColumn])
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]Token, len(stored))
+	for i, t := range stored {
+		tokens[i] = t.Token
+	}
+	return tokens, nil
+}
+
+func (s userStoreImpl) RevokeToken(username string, tokenID string) error {
+	return s.updateTokens(username, func(tokens []storedToken) ([]storedToken, error) {
+		for i, t := range tokens {
+			if t.ID == tokenID {
+				return append(tokens[:i], tokens[i+1:]...), nil
+			}
+		}
+		return nil, ErrInvalidToken
+	})
+}
+
+func (s userStoreImpl) LoginWithToken(token string) (User, Token, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil, Token{}, ErrInvalidToken
+	}
+	records, err := s.readRecords()
+	if err != nil {
+		return nil, Token{}, err
+	}
+	hash := hashToken(token)
+	for _, record := range records {
+		tokens, err := decodeTokens(record[tokensColumn])
+		if err != nil {
+			return nil, Token{}, err
+		}
+		for _, t := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t.hash), []byte(hash)) == 1 {
+				return newUserFromRecord(record), t.Token, nil
+			}
+		}
+	}
+	return nil, Token{}, ErrInvalidToken
+}
+
+func (s userStoreImpl) updateTokens(
+	username string,
+	change func(tokens []storedToken) ([]storedToken, error),
+) error {
+	return s.update(func(records [][]string) ([][]string, error) {
+		record, _, err := findRecord(records, username)
+		if err != nil {
+			return nil, err
+		}
+		tokens, err := decodeTokens(record[tokensColumn])
+		if err != nil {
+			return nil, err
+		}
+		tokens, err = change(tokens)
+		if err != nil {
+			return nil, err
+		}
+		record[tokensColumn] = encodeTokens(tokens)
+		return records, nil
+	})
+}
+
+func (s userStoreImpl) List() ([]User, error) {
+	records, err := s.readRecords()
+	if err != nil {
+		return nil, err
+	}
+	users := make([]User, len(records))
+	for i, record := range records {
+		users[i] = newUserFromRecord(record)
+	}
+	return users, nil
+}
+
+func (s userStoreImpl) Add(username string, password string, dbPath string) error {
+	err := validateUsername(username)
+	if err != nil {
+		return err
+	}
+	err = ValidateDBPath(dbPath)
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return s.update(func(records [][]string) ([][]string, error) {
+		_, _, err := findRecord(records, username)
+		if err == nil {
+			return nil, fmt.Errorf("user %s already exists", username)
+		}
+		record := make([]string, numColumns)
+		record[usernameColumn] = username
+		record[passwordHashColumn] = hash
+		record[pathColumn] = dbPath
+		return append(records, record), nil
+	})
+}
+
+func (s userStoreImpl) Remove(username string) error {
+	return s.update(func(records [][]string) ([][]string, error) {
+		_, i, err := findRecord(records, username)
+		if err != nil {
+			return nil, err
+		}
+		return append(records[:i], records[i+1:]...), nil
+	})
+}
+
+func (s userStoreImpl) SetPassword(username string, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return s.setColumn(username, passwordHashColumn, hash)
+}
+
+// Replaces the path of the user's first DB, which is the one used by default.
+func (s userStoreImpl) SetPath(username string, dbPath string) error {
+	err := ValidateDBPath(dbPath)
+	if err != nil {
+		return err
+	}
+	return s.updateDBs(username, func(dbs []DB) ([]DB, error) {
+		dbs[0].Path = dbPath
+		return dbs, nil
+	})
+}
+
+func (s userStoreImpl) AddDB(username string, name string, dbPath string) error {
+	err := validateDBName(name)
+	if err != nil {
+		return err
+	}
+	err = ValidateDBPath(dbPath)
+	if err != nil {
+		return err
+	}
+	return s.updateDBs(username, func(dbs []DB) ([]DB, error) {
+		if findDB(dbs, name) >= 0 {
+			return nil, fmt.Errorf("user %s already has a DB called %s", username, name)
+		}
+		return append(dbs, DB{Name: name, Path: dbPath}), nil
+	})
+}
+
+func (s userStoreImpl) RemoveDB(username string, name string) error {
+	return s.updateDBs(username, func(dbs []DB) ([]DB, error) {
+		i := findDB(dbs, name)
+		if i < 0 {
+			return nil, fmt.Errorf("user %s doesn't have a DB called %s", username, name)
+		}
+		if len(dbs) == 1 {
+			return nil, errors.New("can't remove a user's only DB")
+		}
+		return append(dbs[:i], dbs[i+1:]...), nil
+	})
+}
+
+func (s userStoreImpl) updateDBs(username string, change func(dbs []DB) ([]DB, error)) error {
+	return s.update(func(records [][]string) ([][]string, error) {
+		record, _, err := findRecord(records, username)
+		if err != nil {
+			return nil, err
+		}
+		dbs, err := decodeDBs(record[pathColumn])
+		if err != nil {
+			return nil, err
+		}
+		dbs, err = change(dbs)
+		if err != nil {
+			return nil, err
+		}
+		record[pathColumn] = encodeDBs(dbs)
+		return records, nil
+	})
+}
+
+func (s userStoreImpl) setColumn(username string, column int, value string) error {
+	return s.update(func(records [][]string) ([][]string, error) {
+		record, _, err := findRecord(records, username)
+		if err != nil {
+			return nil, err
+		}
+		record[column] = value
+		return records, nil
+	})
+}
+
+// Reads every record, padded out to numColumns so they're safe to index. The
+// records are only parsed again if the file changed since the last read, and
+// callers get their own copy to modify.
+func (s userStoreImpl) readRecords() ([][]string, error) {
 	f, err := os.Open(s.userFilePath)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.lock.Lock()
+	defer s.cache.lock.Unlock()
+	if s.cache.stale(info) {
+		records, err := parseRecords(f)
+		if err != nil {
+			return nil, err
+		}
+		s.cache.set(records, info)
+	}
+
+	records := make([][]string, len(s.cache.records))
+	for i, record := range s.cache.records {
+		records[i] = append([]string(nil), record...)
+	}
+	return records, nil
+}
+
+// Like readRecords, but always parses the file.
+func (s userStoreImpl) readRecordsFromFile() ([][]string, error) {
+	f, err := os.Open(s.userFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRecords(f)
+}
+
+func parseRecords(f *os.File) ([][]string, error) {
 	r := csv.NewReader(f)
+	// The profile columns are optional
+	r.FieldsPerRecord = -1
 	records, err := r.ReadAll()
 	if err != nil {
 		return nil, err
 	}
-	userIndex := -1
 	for i, record := range records {
-		if record[0] == username {
+		if len(record) <= pathColumn {
+			return nil, errors.New("malformed users file, not enough columns")
+		}
+		_, err = decodeDBs(record[pathColumn])
+		if err != nil {
+			return nil, err
+		}
+		for len(record) < numColumns {
+			record = append(record, "")
+		}
+		records[i] = record
+	}
+	return records, nil
+}
+
+// Applies the change to the records and atomically replaces the users file
+// with the result.
+func (s userStoreImpl) update(change func(records [][]string) ([][]string, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Read the file itself rather than the cache, so that the change always
+	// sees the last one, like the last TOTP counter that was used
+	records, err := s.readRecordsFromFile()
+	if os.IsNotExist(err) {
+		// Adding the first user creates the file
+		records, err = [][]string{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	records, err = change(records)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for _, record := range records {
+		// Don't write out optional columns that are empty
+		end := len(record)
+		for end > pathColumn+1 && record[end-1] == "" {
+			end--
+		}
+		err = w.Write(record[:end])
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	err = w.Error()
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(s.userFilePath, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	// Remember what we wrote, rather than trusting the next read to notice
+	info, err := os.Stat(s.userFilePath)
+	if err != nil {
+		return err
+	}
+	s.cache.lock.Lock()
+	defer s.cache.lock.Unlock()
+	s.cache.set(records, info)
+	return nil
+}
+
+func findRecord(records [][]string, username string) ([]string, int, error) {
+	for i, record := range records {
+		if record[usernameColumn] == username {
 			// Found our match
-			userIndex = i
-			break
+			return record, i, nil
 		}
 	}
-	if userIndex == -1 {
-		return nil, errors.New("user not found")
+	return nil, -1, ErrUserNotFound
+}
+
+func validateUsername(username string) error {
+	if username == "" {
+		return errors.New("username can't be empty")
+	}
+	if strings.ContainsAny(username, " \t\r\n,") {
+		return errors.New("username can't contain whitespace or commas")
 	}
+	return nil
+}
 
-	// Now see if the password matches
-	err = bcrypt.CompareHashAndPassword([]byte(records[userIndex][1]), []byte(password))
+// The profile ends up in git's author field, so it can't contain anything that
+// would break the "Name <email>" format.
+func validateProfile(displayName string, email string) error {
+	if strings.ContainsAny(displayName, "<>\r\n") {
+		return errors.New("display name can't contain <, > or newlines")
+	}
+	if email == "" {
+		return nil
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return fmt.Errorf("invalid email %s", email)
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("password can't be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return string(hash), nil
+}
+
+// ValidateDBPath returns an error unless the path is the root of a git repo.
+func ValidateDBPath(dbPath string) error {
+	if !path.IsAbs(dbPath) {
+		return fmt.Errorf("db path %s must be absolute", dbPath)
+	}
+	if strings.Contains(dbPath, ";") {
+		return fmt.Errorf("db path %s can't contain a semicolon", dbPath)
+	}
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("db path %s isn't a directory", dbPath)
+	}
+	_, err = os.Stat(path.Join(dbPath, ".git"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("db path %s isn't a git repo, run `git init` in it", dbPath)
+	}
+	return err
+}
+
+// The record must have come from parseRecords, which checks the DBs are valid.
+func newUserFromRecord(record []string) userImpl {
+	dbs, _ := decodeDBs(record[pathColumn])
 	return userImpl{
-		username: username,
-		path:     records[userIndex][2],
-	}, nil
+		username:    record[usernameColumn],
+		dbs:         dbs,
+		displayName: record[displayNameColumn],
+		email:       record[emailColumn],
+		hasTOTP:     record[totpSecretColumn] != "",
+	}
 }
 
 type userImpl struct {
-	username string
-	path     string
+	username    string
+	dbs         []DB
+	displayName string
+	email       string
+	hasTOTP     bool
 }
 
 var _ User = userImpl{}
@@ -61,5 +682,32 @@ func (u userImpl) Name() string {
 }
 
 func (u userImpl) Path() string {
-	return u.path
+	return u.dbs[0].Path
+}
+
+func (u userImpl) DBs() []DB {
+	return append([]DB(nil), u.dbs...)
+}
+
+func (u userImpl) DB(name string) (DB, bool) {
+	i := findDB(u.dbs, name)
+	if i < 0 {
+		return DB{}, false
+	}
+	return u.dbs[i], true
+}
+
+func (u userImpl) DisplayName() string {
+	if u.displayName == "" {
+		return u.username
+	}
+	return u.displayName
+}
+
+func (u userImpl) Email() string {
+	return u.email
+}
+
+func (u userImpl) HasTOTP() bool {
+	return u.hasTOTP
 }
@@ -0,0 +1,381 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestWritableStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-user-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := path.Join(dir, "db")
+	otherDBPath := path.Join(dir, "other")
+	for _, p := range []string{dbPath, otherDBPath} {
+		err = os.MkdirAll(path.Join(p, ".git"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	notARepo := path.Join(dir, "plain")
+	err = os.MkdirAll(notARepo, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewWritableStore(path.Join(dir, "users.csv"))
+	err = store.Add("alice", "hunter2", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Add("bob", "correct horse", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Add("alice", "again", dbPath) == nil {
+		t.Fatal("added a duplicate user")
+	}
+	if store.Add("carol", "pass", notARepo) == nil {
+		t.Fatal("added a user with a DB that isn't a git repo")
+	}
+	if store.Add("carol", "pass", path.Join(dir, "missing")) == nil {
+		t.Fatal("added a user with a DB that doesn't exist")
+	}
+	if store.Add("carol,admin", "pass", dbPath) == nil {
+		t.Fatal("added a user with a comma in their name")
+	}
+
+	u, err := store.Login("alice", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path() != dbPath || u.DisplayName() != "alice" {
+		t.Fatal(u)
+	}
+
+	err = store.SetPassword("alice", "hunter3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Login("alice", "hunter2"); err == nil {
+		t.Fatal("old password still works")
+	}
+	if _, err = store.Login("alice", "hunter3"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.SetPath("bob", otherDBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.SetPath("bob", notARepo) == nil {
+		t.Fatal("set a path that isn't a git repo")
+	}
+	u, err = store.Lookup("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path() != otherDBPath {
+		t.Fatal(u.Path())
+	}
+
+	err = store.Remove("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Remove("alice") != ErrUserNotFound {
+		t.Fatal("removed alice twice")
+	}
+	users, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Name() != "bob" {
+		t.Fatal(users)
+	}
+}
+
+func TestReadsLegacyUsersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-user-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Hash of "hunter2"
+	userFilePath := path.Join(dir, "users.csv")
+	err = ioutil.WriteFile(
+		userFilePath,
+		[]byte("alice,$2a$10$J1g0q3sq8PQX30Z6PcgKKukrBP4N/cFhXr2UOiDDhBk2A298lynXi,/notes\n"),
+		0600,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewStore(userFilePath).Login("alice", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path() != "/notes" || u.Email() != "" {
+		t.Fatal(u)
+	}
+}
+
+func TestReadsLegacyRelativePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-user-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Hash of "hunter2", in a users file from before there were several DBs
+	userFilePath := path.Join(dir, "users.csv")
+	err = ioutil.WriteFile(
+		userFilePath,
+		[]byte("alice,$2a$10$J1g0q3sq8PQX30Z6PcgKKukrBP4N/cFhXr2UOiDDhBk2A298lynXi,notes\n"+
+			"bob,$2a$10$J1g0q3sq8PQX30Z6PcgKKukrBP4N/cFhXr2UOiDDhBk2A298lynXi,../shared/notes\n"),
+		0600,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(userFilePath)
+	for username, dbPath := range map[string]string{"alice": "notes", "bob": "../shared/notes"} {
+		u, err := store.Login(username, "hunter2")
+		if err != nil {
+			t.Fatal(username, err)
+		}
+		dbs := u.DBs()
+		if u.Path() != dbPath || len(dbs) != 1 || dbs[0] != (DB{Name: DefaultDBName, Path: dbPath}) {
+			t.Fatal(u)
+		}
+	}
+}
+
+func TestSelfServiceChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-user-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(path.Join(dir, ".git"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewWritableStore(path.Join(dir, "users.csv"))
+	err = store.Add("alice", "hunter2", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.ChangePassword("alice", "wrong", "hunter3") == nil {
+		t.Fatal("changed the password without the old one")
+	}
+	err = store.ChangePassword("alice", "hunter2", "hunter3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Login("alice", "hunter3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.UpdateProfile("alice", "Alice <root@evil>", "") == nil {
+		t.Fatal("allowed a display name that breaks the author format")
+	}
+	if store.UpdateProfile("alice", "Alice", "not an email") == nil {
+		t.Fatal("allowed an invalid email")
+	}
+	err = store.UpdateProfile("alice", "Alice Liddell", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.Lookup("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.DisplayName() != "Alice Liddell" || u.Email() != "alice@example.com" {
+		t.Fatal(u)
+	}
+}
+
+func TestReloadsChangedUsersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-user-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	userFilePath := path.Join(dir, "users.csv")
+	writeUsers := func(contents string, modTime time.Time) {
+		err := ioutil.WriteFile(userFilePath, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(userFilePath, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	modTime := time.Unix(1513066695, 0)
+	writeUsers("alice,hash,/notes\n", modTime)
+
+	store := NewStore(userFilePath)
+	u, err := store.Lookup("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path() != "/notes" {
+		t.Fatal(u.Path())
+	}
+
+	// Edited by hand, same size but newer
+	writeUsers("alice,hash,/other\n", modTime.Add(time.Second))
+	u, err = store.Lookup("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path() != "/other" {
+		t.Fatal(u.Path())
+	}
+}
+
+func TestSeesSameSizeChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-user-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(path.Join(dir, ".git"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userFilePath := path.Join(dir, "users.csv")
+	store := NewWritableStore(userFilePath)
+	err = store.Add("alice", "hunter2", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Login("alice", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(userFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keeps the file looking the same as when it was cached, like a change
+	// within one tick of the clock
+	sameTime := func() {
+		err := os.Chtimes(userFilePath, info.ModTime(), info.ModTime())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// bcrypt hashes are all the same size
+	err = store.SetPassword("alice", "hunter3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameTime()
+	if _, err = store.Login("alice", "hunter2"); err == nil {
+		t.Fatal("the old password still works")
+	}
+	if _, err = store.Login("alice", "hunter3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process changing the password
+	other := NewWritableStore(userFilePath)
+	err = other.SetPassword("alice", "hunter4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameTime()
+	if _, err = store.Login("alice", "hunter3"); err == nil {
+		t.Fatal("the old password still works")
+	}
+	if _, err = store.Login("alice", "hunter4"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultipleDBs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-user-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	workPath := path.Join(dir, "work")
+	personalPath := path.Join(dir, "personal=notes")
+	for _, p := range []string{workPath, personalPath} {
+		err = os.MkdirAll(path.Join(p, ".git"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	userFilePath := path.Join(dir, "users.csv")
+	store := NewWritableStore(userFilePath)
+	err = store.Add("alice", "hunter2", workPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.AddDB("alice", "personal", personalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.AddDB("alice", "personal", workPath) == nil {
+		t.Fatal("added a DB with a duplicate name")
+	}
+	if store.AddDB("alice", "a;b", workPath) == nil {
+		t.Fatal("added a DB with a semicolon in its name")
+	}
+
+	u, err := store.Lookup("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DB{{DefaultDBName, workPath}, {"personal", personalPath}}
+	dbs := u.DBs()
+	if len(dbs) != 2 || dbs[0] != expected[0] || dbs[1] != expected[1] || u.Path() != workPath {
+		t.Fatal(dbs)
+	}
+	if db, ok := u.DB("personal"); !ok || db.Path != personalPath {
+		t.Fatal(db)
+	}
+	if _, ok := u.DB("missing"); ok {
+		t.Fatal("found a DB that doesn't exist")
+	}
+
+	// The users file is still readable from scratch
+	u, err = NewStore(userFilePath).Lookup("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.DBs()) != 2 {
+		t.Fatal(u.DBs())
+	}
+
+	err = store.RemoveDB("alice", DefaultDBName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.RemoveDB("alice", "personal") == nil {
+		t.Fatal("removed the only DB")
+	}
+	u, err = store.Lookup("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path() != personalPath {
+		t.Fatal(u.DBs())
+	}
+}
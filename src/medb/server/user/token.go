@@ -0,0 +1,122 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The scopes a personal access token can have
+const (
+	// Can read notes and the git state, but change nothing
+	ScopeReadOnly = "read-only"
+	// Can read and edit notes
+	ScopeReadWrite = "read-write"
+	// Can see the git state, pull and push, but not read notes
+	ScopeGitSync = "git-sync"
+)
+
+const tokenPrefix = "medb_"
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Token is a personal access token, without the secret itself.
+type Token struct {
+	// Derived from the token's hash, used to refer to it when revoking
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scope   string    `json:"scope"`
+	Created time.Time `json:"created"`
+}
+
+// Tokens are stored as their hash with some metadata, see encodeTokens.
+type storedToken struct {
+	Token
+	hash string
+}
+
+func validateScope(scope string) error {
+	switch scope {
+	case ScopeReadOnly, ScopeReadWrite, ScopeGitSync:
+		return nil
+	}
+	return fmt.Errorf("unknown token scope %q", scope)
+}
+
+// Returns a new token and how to store it.
+func generateToken(name string, scope string, now time.Time) (string, storedToken, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", storedToken{}, err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	hash := hashToken(token)
+	return token, storedToken{
+		Token: Token{
+			ID:      hash[:12],
+			Name:    name,
+			Scope:   scope,
+			Created: time.Unix(now.Unix(), 0),
+		},
+		hash: hash,
+	}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Tokens are stored in a single column as semicolon separated entries of
+// hash:scope:createdUnix:name, with the name URL escaped.
+func encodeTokens(tokens []storedToken) string {
+	encoded := make([]string, len(tokens))
+	for i, t := range tokens {
+		encoded[i] = strings.Join([]string{
+			t.hash,
+			t.Scope,
+			strconv.FormatInt(t.Created.Unix(), 10),
+			url.QueryEscape(t.Name),
+		}, ":")
+	}
+	return strings.Join(encoded, ";")
+}
+
+func decodeTokens(column string) ([]storedToken, error) {
+	tokens := make([]storedToken, 0)
+	if column == "" {
+		return tokens, nil
+	}
+	for _, encoded := range strings.Split(column, ";") {
+		fields := strings.Split(encoded, ":")
+		if len(fields) != 4 || len(fields[0]) < 12 {
+			return nil, errors.New("malformed users file, invalid token")
+		}
+		created, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		name, err := url.QueryUnescape(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, storedToken{
+			Token: Token{
+				ID:      fields[0][:12],
+				Name:    name,
+				Scope:   fields[1],
+				Created: time.Unix(created, 0),
+			},
+			hash: fields[0],
+		})
+	}
+	return tokens, nil
+}
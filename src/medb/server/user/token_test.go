@@ -0,0 +1,99 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-user-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(path.Join(dir, ".git"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userFilePath := path.Join(dir, "users.csv")
+	store := NewWritableStore(userFilePath)
+	for _, username := range []string{"alice", "bob"} {
+		err = store.Add(username, "hunter2", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Unix(1513066695, 0)
+
+	if _, _, err = store.CreateToken("alice", "backup", "admin", now); err == nil {
+		t.Fatal("created a token with an unknown scope")
+	}
+	backupToken, backup, err := store.CreateToken("alice", "backup: nightly; cron", ScopeGitSync, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptToken, _, err := store.CreateToken("alice", "script", ScopeReadWrite, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobToken, _, err := store.CreateToken("bob", "reader", ScopeReadOnly, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only hashes are stored
+	raw, err := ioutil.ReadFile(userFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{backupToken, scriptToken, bobToken} {
+		if strings.Contains(string(raw), token) {
+			t.Fatal("token was stored in plain text")
+		}
+	}
+
+	tokens, err := store.ListTokens("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0] != backup {
+		t.Fatal(tokens)
+	}
+
+	u, token, err := store.LoginWithToken(backupToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name() != "alice" || token.Scope != ScopeGitSync || token.Name != "backup: nightly; cron" {
+		t.Fatal(u, token)
+	}
+	u, token, err = store.LoginWithToken(bobToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name() != "bob" || token.Scope != ScopeReadOnly {
+		t.Fatal(u, token)
+	}
+	if _, _, err = store.LoginWithToken(backupToken + "x"); err != ErrInvalidToken {
+		t.Fatal(err)
+	}
+
+	// Users can only revoke their own tokens
+	if store.RevokeToken("bob", backup.ID) != ErrInvalidToken {
+		t.Fatal("bob revoked alice's token")
+	}
+	err = store.RevokeToken("alice", backup.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = store.LoginWithToken(backupToken); err != ErrInvalidToken {
+		t.Fatal(err)
+	}
+	if _, _, err = store.LoginWithToken(scriptToken); err != nil {
+		t.Fatal(err)
+	}
+}
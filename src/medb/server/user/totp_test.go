@@ -0,0 +1,176 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 secret from RFC 6238's test vectors, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// From RFC 6238 Appendix B, truncated to 6 digits
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for ts, expected := range vectors {
+		code, err := totpCode(rfcSecret, time.Unix(ts, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Errorf("at %d expected %s, got %s", ts, expected, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, err := totpCode(rfcSecret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter, ok := validateTOTP(rfcSecret, code, now); !ok || counter != totpCounter(now) {
+		t.Fatal("rejected the current code", counter)
+	}
+	// Allow a little clock drift, but not much. The code is still for the
+	// time it was made at.
+	if counter, ok := validateTOTP(rfcSecret, code, now.Add(totpPeriod)); !ok || counter != totpCounter(now) {
+		t.Fatal("rejected the previous code", counter)
+	}
+	if _, ok := validateTOTP(rfcSecret, code, now.Add(3*totpPeriod)); ok {
+		t.Fatal("accepted an old code")
+	}
+	_, emptyOK := validateTOTP(rfcSecret, "", now)
+	_, shortOK := validateTOTP(rfcSecret, "12345", now)
+	if emptyOK || shortOK {
+		t.Fatal("accepted a malformed code")
+	}
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-user-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(path.Join(dir, ".git"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewWritableStore(path.Join(dir, "users.csv"))
+	err = store.Add("alice", "hunter2", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1513066695, 0)
+
+	secret, err := store.BeginTOTPEnrollment("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.Lookup("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.HasTOTP() {
+		t.Fatal("TOTP is required before it was confirmed")
+	}
+	uri := TOTPProvisioningURI("MeDB", "alice", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/MeDB:alice?") || !strings.Contains(uri, "secret="+secret) {
+		t.Fatal(uri)
+	}
+
+	if _, err = store.ConfirmTOTPEnrollment("alice", "000000", now); err != ErrInvalidCode {
+		t.Fatal(err)
+	}
+	code, err := totpCode(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recoveryCodes, err := store.ConfirmTOTPEnrollment("alice", code, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recoveryCodes) != numRecoveryCodes {
+		t.Fatal(recoveryCodes)
+	}
+	u, err = store.Lookup("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.HasTOTP() {
+		t.Fatal("TOTP isn't required after it was confirmed")
+	}
+
+	// Enrolling again would replace the second factor without the password
+	if _, err = store.BeginTOTPEnrollment("alice"); err != ErrTOTPEnabled {
+		t.Fatal(err)
+	}
+
+	// TOTP codes work at login, but only around the time they're for, and
+	// only once. The code used to confirm is already used up.
+	if err = store.VerifySecondFactor("alice", code, now); err != ErrInvalidCode {
+		t.Fatal(err)
+	}
+	later := now.Add(2 * totpPeriod)
+	laterCode, err := totpCode(secret, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.VerifySecondFactor("alice", laterCode, later); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.VerifySecondFactor("alice", laterCode, later); err != ErrInvalidCode {
+		t.Fatal(err)
+	}
+	// Nor can an older code that's still within the clock drift allowance
+	olderCode, err := totpCode(secret, later.Add(-totpPeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.VerifySecondFactor("alice", olderCode, later); err != ErrInvalidCode {
+		t.Fatal(err)
+	}
+	if err = store.VerifySecondFactor("alice", laterCode, later.Add(time.Hour)); err != ErrInvalidCode {
+		t.Fatal(err)
+	}
+
+	// Recovery codes work exactly once
+	if err = store.VerifySecondFactor("alice", strings.ToUpper(recoveryCodes[3]), now); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.VerifySecondFactor("alice", recoveryCodes[3], now); err != ErrInvalidCode {
+		t.Fatal(err)
+	}
+	if err = store.VerifySecondFactor("alice", recoveryCodes[4], now); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.DisableTOTP("alice", "wrong") == nil {
+		t.Fatal("disabled TOTP without the password")
+	}
+	err = store.DisableTOTP("alice", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = store.Lookup("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.HasTOTP() {
+		t.Fatal("TOTP is still required after disabling it")
+	}
+	if _, err = store.BeginTOTPEnrollment("alice"); err != nil {
+		t.Fatal(err)
+	}
+}
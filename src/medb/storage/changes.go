@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// The types of change
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// ErrUnknownCommit means the commit to look for changes since isn't in the
+// repo, maybe because it was amended and collected since. The only way to
+// catch up is to start over from nothing.
+var ErrUnknownCommit = errors.New("unknown commit")
+
+var commitHashRegexp = regexp.MustCompile("^[0-9a-f]{4,64}$")
+
+// Change is what happened to one note. Moves are updates to the path.
+type Change struct {
+	Type string
+	ID   uuid.UUID
+	// Relative to the root, where the note is now or was before it was
+	// deleted
+	Path string
+	// ContentHash of the note, empty for deletes
+	Hash    string
+	Content string
+}
+
+type ChangeSet struct {
+	// The commit the changes lead up to, to ask for the changes since next
+	Commit  string
+	Changes []Change
+}
+
+// ContentHash returns a hash of a note's content, for telling whether two
+// copies of it are the same.
+func ContentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// ChangesSince returns how the notes at HEAD differ from the ones at the
+// commit, sorted by path. With no commit, every note is created. Only
+// committed changes are seen, files without a header aren't notes. A DB
+// without any commits has no changes, and an empty commit to ask again with.
+func (d dbImpl) ChangesSince(commit string) (ChangeSet, error) {
+	headRaw, err := d.runGit("rev-parse", "--verify", "-q", "HEAD^{commit}")
+	if err != nil {
+		// It's fine for there to be nothing committed yet, as long as it's a repo
+		_, repoErr := d.runGit("rev-parse", "--git-dir")
+		if repoErr != nil {
+			return ChangeSet{}, err
+		}
+		if commit != "" {
+			return ChangeSet{}, ErrUnknownCommit
+		}
+		return ChangeSet{Changes: []Change{}}, nil
+	}
+	head := strings.TrimSpace(headRaw)
+	changeSet := ChangeSet{Commit: head, Changes: []Change{}}
+	if commit == head {
+		return changeSet, nil
+	}
+
+	// The paths whose notes could be gone, and the ones there could be notes at
+	var before, after []string
+	if commit == "" {
+		listRaw, err := d.runGit("ls-tree", "-r", "-z", "--name-only", head)
+		if err != nil {
+			return ChangeSet{}, err
+		}
+		after = strings.Split(strings.TrimSuffix(listRaw, "\x00"), "\x00")
+	} else {
+		if !commitHashRegexp.MatchString(commit) {
+			return ChangeSet{}, ErrUnknownCommit
+		}
+		_, err = d.runGit("rev-parse", "--verify", "-q", commit+"^{commit}")
+		if err != nil {
+			return ChangeSet{}, ErrUnknownCommit
+		}
+		diffRaw, err := d.runGit("diff", "--name-status", "-z", "--no-renames", commit, head)
+		if err != nil {
+			return ChangeSet{}, err
+		}
+		fields := strings.Split(strings.TrimSuffix(diffRaw, "\x00"), "\x00")
+		for i := 0; i+1 < len(fields); i += 2 {
+			status, p := fields[i], fields[i+1]
+			if status != "A" {
+				before = append(before, p)
+			}
+			if status != "D" {
+				after = append(after, p)
+			}
+		}
+	}
+
+	oldNotes, err := d.notesAt(commit, before)
+	if err != nil {
+		return ChangeSet{}, err
+	}
+	newNotes, err := d.notesAt(head, after)
+	if err != nil {
+		return ChangeSet{}, err
+	}
+	for id, f := range newNotes {
+		change := Change{Type: ChangeCreated, ID: id, Path: f.currentLocation, Hash: ContentHash(f.Content()), Content: f.Content()}
+		if _, ok := oldNotes[id]; ok {
+			change.Type = ChangeUpdated
+		}
+		changeSet.Changes = append(changeSet.Changes, change)
+	}
+	for id, f := range oldNotes {
+		if _, ok := newNotes[id]; !ok {
+			changeSet.Changes = append(changeSet.Changes, Change{Type: ChangeDeleted, ID: id, Path: f.currentLocation})
+		}
+	}
+	sort.Slice(changeSet.Changes, func(i, j int) bool {
+		return changeSet.Changes[i].Path < changeSet.Changes[j].Path
+	})
+	return changeSet, nil
+}
+
+// Reads the notes at the paths in the commit, by ID. Their locations are the
+// paths.
+func (d dbImpl) notesAt(commit string, paths []string) (map[uuid.UUID]*fileImpl, error) {
+	notes := make(map[uuid.UUID]*fileImpl)
+	specs := make([]string, 0, len(paths))
+	notePaths := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if p == "" || isBlacklistedPath(p) {
+			continue
+		}
+		specs = append(specs, commit+":"+p)
+		notePaths = append(notePaths, p)
+	}
+	if len(specs) == 0 {
+		return notes, nil
+	}
+
+	contents, err := d.readBlobs(specs)
+	if err != nil {
+		return nil, err
+	}
+	for i, content := range contents {
+		f, err := parseFile(content)
+		if err != nil || !f.HasHeader() {
+			continue
+		}
+		f.currentLocation = notePaths[i]
+		notes[f.ID()] = f
+	}
+	return notes, nil
+}
+
+// Reads the blobs, like "HEAD:notes/ideas.md", with one git process rather
+// than one for each.
+func (d dbImpl) readBlobs(specs []string) ([]string, error) {
+	cmd := exec.Command("git", "cat-file", "--batch")
+	cmd.Dir = d.rootPath
+	cmd.Stdin = strings.NewReader(strings.Join(specs, "\n") + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(output))
+	contents := make([]string, len(specs))
+	for i := range specs {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		// "<hash> <type> <size>", or "<spec> missing" where the spec can
+		// have spaces in it. A submodule's commit is missing, it isn't a note
+		// so it's left empty.
+		fields := strings.Fields(line)
+		if !isObjectHeader(fields) {
+			if strings.HasSuffix(line, " missing\n") {
+				continue
+			}
+			return nil, fmt.Errorf("unable to read %s: %s", specs[i], strings.TrimSpace(line))
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		content := make([]byte, size+1)
+		_, err = io.ReadFull(reader, content)
+		if err != nil {
+			return nil, err
+		}
+		if fields[1] == "blob" {
+			contents[i] = string(content[:size])
+		}
+	}
+	return contents, nil
+}
+
+// Returns true if the fields are the "<hash> <type> <size>" git cat-file
+// --batch puts before an object.
+func isObjectHeader(fields []string) bool {
+	if len(fields) != 3 || !commitHashRegexp.MatchString(fields[0]) {
+		return false
+	}
+	_, err := strconv.Atoi(fields[2])
+	return err == nil
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestChangesSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-changes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(output), err)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	git("init", "-q", "-b", "master")
+	git("config", "user.name", "MeDB Test")
+	git("config", "user.email", "test@medb.example")
+	d := dbImpl{rootPath: dir}
+	commit := func() string {
+		err := d.CommitToGIT("Change")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return git("rev-parse", "HEAD")
+	}
+
+	ideas, err := d.CreateFile("ideas.md", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	todo, err := d.CreateFile("todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(dir, "README"), []byte("Not a note"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := commit()
+
+	all, err := d.ChangesSince("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all.Commit != first || len(all.Changes) != 2 {
+		t.Fatal(all)
+	}
+	if c := all.Changes[0]; c.Type != ChangeCreated || c.ID != ideas.ID() || c.Path != "ideas.md" ||
+		c.Content != "one" || c.Hash != ContentHash("one") {
+		t.Fatal(c)
+	}
+
+	ideas.Update("two")
+	err = d.SaveFile(ideas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.MoveFile(todo.ID(), "archive/todo.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shopping, err := d.CreateFile("shopping.md", "eggs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := commit()
+	// Not committed yet, so not seen
+	err = d.DeleteFile(shopping.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := d.ChangesSince(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Type: ChangeUpdated, ID: todo.ID(), Path: "archive/todo.md"},
+		{Type: ChangeUpdated, ID: ideas.ID(), Path: "ideas.md"},
+		{Type: ChangeCreated, ID: shopping.ID(), Path: "shopping.md"},
+	}
+	if changes.Commit != second || len(changes.Changes) != len(expected) {
+		t.Fatal(changes)
+	}
+	for i, c := range changes.Changes {
+		if c.Type != expected[i].Type || c.ID != expected[i].ID || c.Path != expected[i].Path {
+			t.Fatal(i, c)
+		}
+	}
+	if changes.Changes[1].Content != "two" || changes.Changes[1].Hash != ContentHash("two") {
+		t.Fatal(changes.Changes[1])
+	}
+
+	third := commit()
+	changes, err = d.ChangesSince(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.Commit != third || len(changes.Changes) != 1 {
+		t.Fatal(changes)
+	}
+	if c := changes.Changes[0]; c.Type != ChangeDeleted || c.ID != shopping.ID() || c.Hash != "" {
+		t.Fatal(c)
+	}
+	if changes, err = d.ChangesSince(third); err != nil || len(changes.Changes) != 0 {
+		t.Fatal(changes, err)
+	}
+
+	for _, unknown := range []string{"0000000000000000000000000000000000000000", "HEAD~1", "--all"} {
+		if _, err = d.ChangesSince(unknown); err != ErrUnknownCommit {
+			t.Fatal(unknown, err)
+		}
+	}
+}
+
+func TestChangesSinceEmptyDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-changes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output, err := exec.Command("git", "init", "-q", "-b", "master", dir).CombinedOutput()
+	if err != nil {
+		t.Fatal(string(output), err)
+	}
+	d := dbImpl{rootPath: dir}
+
+	changes, err := d.ChangesSince("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.Commit != "" || changes.Changes == nil || len(changes.Changes) != 0 {
+		t.Fatal(changes)
+	}
+	if _, err = d.ChangesSince("d6cd1e2bd19e03a81132a23b2d920a6d1d2a2e5b"); err != ErrUnknownCommit {
+		t.Fatal(err)
+	}
+
+	// Not a repo at all is still an error
+	plain, err := ioutil.TempDir("", "medb-changes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(plain)
+	if _, err = (dbImpl{rootPath: plain}).ChangesSince(""); err == nil {
+		t.Fatal("no error outside a repo")
+	}
+}
+
+func TestReadBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-changes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(output), err)
+		}
+	}
+	git("init", "-q", "-b", "master")
+	git("config", "user.name", "MeDB Test")
+	git("config", "user.email", "test@medb.example")
+	d := dbImpl{rootPath: dir}
+	f, err := d.CreateFile("my ideas.md", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A submodule, whose commit isn't in this repo
+	git("update-index", "--add", "--cacheinfo", "160000,d6cd1e2bd19e03a81132a23b2d920a6d1d2a2e5b,vendor/lib")
+	err = d.CommitWithOptions("Start", CommitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := d.ChangesSince("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Changes) != 1 || all.Changes[0].ID != f.ID() || all.Changes[0].Path != "my ideas.md" {
+		t.Fatal(all)
+	}
+
+	// From wherever the process happens to be
+	contents, err := d.readBlobs([]string{"HEAD:my ideas.md", "HEAD:no such note.md", "HEAD:vendor/lib", "HEAD:vendor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents) != 4 || !strings.HasSuffix(contents[0], "one") || contents[1] != "" || contents[2] != "" ||
+		contents[3] != "" {
+		t.Fatal(contents)
+	}
+}
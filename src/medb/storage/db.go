@@ -2,6 +2,7 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -26,6 +27,11 @@ var blacklistedFileNames = map[string]struct{}{
 	".gitignore": {},
 }
 
+var (
+	ErrFileNotFound = errors.New("file doesn't exist")
+	ErrFileExists   = errors.New("file already exists")
+)
+
 type DB interface {
 	AllFiles() ([]File, error)
 	AsJSON() ([]*JSONFile, error)
@@ -33,21 +39,47 @@ type DB interface {
 	SaveFile(File) error
 	LoadFile(fileID uuid.UUID) (File, error)
 	NewFile(path string, content string) error
+	// Like NewFile, but creates any missing folders, fails with ErrFileExists
+	// rather than overwriting a file and returns the new file.
+	CreateFile(path string, content string) (File, error)
+	DeleteFile(fileID uuid.UUID) error
+	// Moves the file to the new path, creating any missing folders. Fails with
+	// ErrFileExists rather than overwriting a file.
+	MoveFile(fileID uuid.UUID, newPath string) (File, error)
+	// Returns where the path relative to the root is on disk, as long as it's
+	// inside the DB and not in a folder medb or git manage.
+	ResolvePath(path string) (string, error)
+	// Reads the file at the path, which might not have a header.
+	ReadFileAt(path string) (File, error)
+	// Writes the content to the file at the path, keeping its header or
+	// giving it one if it doesn't have one yet.
+	WriteFileAt(path string, content string) (File, error)
 
 	// TODO: Move to a git interface?
 	CommitToGIT(message string) error
+	CommitWithOptions(message string, options CommitOptions) error
+	SquashAutoCommits(window time.Duration, signingKey *SigningKey) (int, error)
+	History(options HistoryOptions) ([]HistoryEntry, error)
+	ChangesSince(commit string) (ChangeSet, error)
 	Push() error
+	PushMirrors(remotes []string) ([]PushResult, error)
 	Pull() error
 	Fetch() error
 	LastCommitTS() (time.Time, error)
 	LastPullTS() (time.Time, error)
-	AheadBehindOriginMaster() (AheadBehindStruct, error)
+	RemoteStatuses(remotes []string) ([]RemoteStatus, error)
+	Status() ([]StatusEntry, error)
 }
 
 func NewDB(rootPath string) DB {
 	return dbImpl{rootPath: rootPath}
 }
 
+// Like NewDB, but CommitToGIT signs its commits with the key.
+func NewSigningDB(rootPath string, signingKey *SigningKey) DB {
+	return dbImpl{rootPath: rootPath, signingKey: signingKey}
+}
+
 type JSONFile struct {
 	Name     string      `json:"name"`
 	State    string      `json:"state"`
@@ -64,8 +96,51 @@ type AheadBehindStruct struct {
 	LocalAheadBy  int64
 }
 
+// Author is the identity a commit is attributed to.
+type Author struct {
+	Name  string
+	Email string
+}
+
+type CommitOptions struct {
+	// When nil, git's configured identity is used.
+	Author *Author
+	// The note this commit saves, recorded as a trailer in the message.
+	NoteID uuid.UUID
+	// When positive, a commit for the same note by the same author within
+	// this long of HEAD amends HEAD instead, as long as HEAD isn't pushed.
+	CoalesceWindow time.Duration
+	// When set, the commit is signed with this key.
+	SigningKey *SigningKey
+}
+
+// The states a note can be in relative to the last commit.
+const (
+	StatusModified  = "modified"
+	StatusAdded     = "added"
+	StatusDeleted   = "deleted"
+	StatusUntracked = "untracked"
+	// Left unmerged by a pull
+	StatusConflicted = "conflicted"
+)
+
+// The codes git status uses for unmerged paths
+var conflictedStatusCodes = map[string]struct{}{
+	"DD": {}, "AU": {}, "UD": {}, "UA": {}, "DU": {}, "AA": {}, "UU": {},
+}
+
+// StatusEntry describes a single uncommitted change in the working tree.
+// Id is uuid.Nil when the note doesn't have a header yet.
+type StatusEntry struct {
+	State string    `json:"state"`
+	Path  string    `json:"path"`
+	Id    uuid.UUID `json:"id"`
+}
+
 type dbImpl struct {
 	rootPath string
+	// Used by CommitToGIT, nil when commits aren't signed
+	signingKey *SigningKey
 }
 
 func (d dbImpl) scanForFilenames() ([]string, error) {
@@ -284,7 +359,15 @@ func (d dbImpl) SaveFile(fileToSave File) error {
 		return errors.New("don't know how to save this type of file")
 	}
 
-	return ioutil.WriteFile(f.currentLocation, []byte(f.generateHeader()+f.content), 0644)
+	relativePath, err := d.relativePath(f.currentLocation)
+	if err != nil {
+		return err
+	}
+	fullPath, err := d.resolveWritePath(relativePath)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fullPath, []byte(f.generateHeader()+f.content), 0644)
 }
 
 func (d dbImpl) LoadFile(fileID uuid.UUID) (File, error) {
@@ -298,21 +381,157 @@ func (d dbImpl) LoadFile(fileID uuid.UUID) (File, error) {
 			return f, nil
 		}
 	}
-	return nil, errors.New("file doesn't exist")
+	return nil, ErrFileNotFound
 }
 
 func (d dbImpl) NewFile(desiredPath string, content string) error {
+	fullPath, err := d.resolveWritePath(desiredPath)
+	if err != nil {
+		return err
+	}
 	fileToSave := &fileImpl{
 		content:         content,
-		currentLocation: path.Join(d.rootPath, desiredPath),
+		currentLocation: fullPath,
 	}
-	err := fileToSave.CreateHeader()
+	err = fileToSave.CreateHeader()
 	if err != nil {
 		return err
 	}
 	return d.SaveFile(fileToSave)
 }
 
+func (d dbImpl) CreateFile(desiredPath string, content string) (File, error) {
+	fullPath, err := d.resolveWritePath(desiredPath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Lstat(fullPath)
+	if err == nil {
+		return nil, ErrFileExists
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = os.MkdirAll(path.Dir(fullPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	fileToSave := &fileImpl{
+		content:         content,
+		currentLocation: fullPath,
+	}
+	err = fileToSave.CreateHeader()
+	if err != nil {
+		return nil, err
+	}
+	err = d.SaveFile(fileToSave)
+	if err != nil {
+		return nil, err
+	}
+	return fileToSave, nil
+}
+
+func (d dbImpl) ResolvePath(relativePath string) (string, error) {
+	return d.resolveWritePath(relativePath)
+}
+
+func (d dbImpl) ReadFileAt(relativePath string) (File, error) {
+	fullPath, err := d.resolveWritePath(relativePath)
+	if err != nil {
+		return nil, err
+	}
+	rawBytes, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseFile(string(rawBytes))
+	if err != nil {
+		return nil, err
+	}
+	f.currentLocation = fullPath
+	return f, nil
+}
+
+func (d dbImpl) WriteFileAt(relativePath string, content string) (File, error) {
+	f, err := d.ReadFileAt(relativePath)
+	if os.IsNotExist(err) {
+		fullPath, _ := d.resolveWritePath(relativePath)
+		f = &fileImpl{currentLocation: fullPath}
+	} else if err != nil {
+		return nil, err
+	}
+	f.Update(content)
+	if !f.HasHeader() {
+		err = f.CreateHeader()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, d.SaveFile(f)
+}
+
+// IsHiddenName returns true for the names of files and folders that aren't
+// part of the notes, like .git.
+func IsHiddenName(name string) bool {
+	_, folder := blacklistedFolderNames[name]
+	_, file := blacklistedFileNames[name]
+	return folder || file
+}
+
+func (d dbImpl) DeleteFile(fileID uuid.UUID) error {
+	f, err := d.LoadFile(fileID)
+	if err != nil {
+		return err
+	}
+	relativePath, err := d.relativePath(f.Path())
+	if err != nil {
+		return err
+	}
+	fullPath, err := d.resolveWritePath(relativePath)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fullPath)
+}
+
+func (d dbImpl) MoveFile(fileID uuid.UUID, newPath string) (File, error) {
+	newFullPath, err := d.resolveWritePath(newPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.LoadFile(fileID)
+	if err != nil {
+		return nil, err
+	}
+	relativePath, err := d.relativePath(f.Path())
+	if err != nil {
+		return nil, err
+	}
+	fullPath, err := d.resolveWritePath(relativePath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Lstat(newFullPath)
+	if err == nil {
+		return nil, ErrFileExists
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = os.MkdirAll(path.Dir(newFullPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(fullPath, newFullPath)
+	if err != nil {
+		return nil, err
+	}
+	f.(*fileImpl).currentLocation = newFullPath
+	return f, nil
+}
+
 // Changes the working directory to the rootPath and returns a defer to move
 // it back to the original.
 func (d dbImpl) moveCurDir() (func(), error) {
@@ -331,11 +550,34 @@ func (d dbImpl) moveCurDir() (func(), error) {
 
 // Runs the command and returns a string of the output
 func (d dbImpl) runCommand(name string, args ...string) (string, error) {
+	return d.runCommandWithEnv(nil, name, args...)
+}
+
+// Runs the command with extra environment variables set, in "KEY=value" form
+func (d dbImpl) runCommandWithEnv(env []string, name string, args ...string) (string, error) {
 	cmd := exec.Command(name, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return runCmd(cmd)
+}
+
+// Runs git in the root directory, whatever the process's working directory is
+func (d dbImpl) runGit(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = d.rootPath
+	return runCmd(cmd)
+}
+
+// Runs the command, and says what it wrote to stderr if it fails
+func runCmd(cmd *exec.Cmd) (string, error) {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return "", err
 	}
+	// Kept so that failures say why, not just their exit status
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
 	if err := cmd.Start(); err != nil {
 		return "", err
 	}
@@ -343,14 +585,21 @@ func (d dbImpl) runCommand(name string, args ...string) (string, error) {
 	buf.ReadFrom(stdout)
 
 	if err := cmd.Wait(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%v: %s", err, message)
+		}
 		return "", err
 	}
 
 	return buf.String(), nil
 }
 
-// Returns true if a new commit was made, false otherwise
+// Commits everything, signed with the DB's key if it has one
 func (d dbImpl) CommitToGIT(message string) error {
+	return d.CommitWithOptions(message, CommitOptions{SigningKey: d.signingKey})
+}
+
+func (d dbImpl) CommitWithOptions(message string, options CommitOptions) error {
 	toDefer, err := d.moveCurDir()
 	if err != nil {
 		return err
@@ -370,11 +619,54 @@ func (d dbImpl) CommitToGIT(message string) error {
 		return nil
 	}
 
+	signingArgs, signingEnv := options.SigningKey.gitArgs()
+	if d.shouldAmend(options) {
+		args := append(signingArgs, "commit", "-a", "--amend", "--no-edit")
+		_, err = d.runCommandWithEnv(signingEnv, "git", args...)
+		return err
+	}
+
 	// Now commit everything
-	_, err = d.runCommand("git", "commit", "-am", message)
+	if options.NoteID != uuid.Nil {
+		message += "\n\n" + noteTrailerPrefix + options.NoteID.String()
+	}
+	args := append(signingArgs, "commit", "-am", message)
+	if options.Author != nil {
+		args = append(args, fmt.Sprintf("--author=%s <%s>", options.Author.Name, options.Author.Email))
+	}
+	_, err = d.runCommandWithEnv(signingEnv, "git", args...)
 	return err
 }
 
+// Returns true if HEAD is an unpushed commit of the same note by the same
+// author that is recent enough to coalesce into. Must be called from within
+// the root directory.
+func (d dbImpl) shouldAmend(options CommitOptions) bool {
+	if options.CoalesceWindow <= 0 || options.Author == nil || options.NoteID == uuid.Nil {
+		return false
+	}
+	headRaw, err := d.runCommand("git", "log", "-1", "--format="+logFormat)
+	if err != nil {
+		// Probably no commits yet
+		return false
+	}
+	commits, err := parseLog(headRaw)
+	if err != nil || len(commits) != 1 {
+		return false
+	}
+	head := commits[0]
+	if head.noteID() != options.NoteID ||
+		head.authorName != options.Author.Name ||
+		head.authorEmail != options.Author.Email ||
+		time.Since(head.commitTS) > options.CoalesceWindow {
+		return false
+	}
+
+	// Never rewrite something that a remote already has
+	remoteBranches, err := d.runCommand("git", "branch", "-r", "--contains", "HEAD")
+	return err == nil && strings.TrimSpace(remoteBranches) == ""
+}
+
 func (d dbImpl) Push() error {
 	toDefer, err := d.moveCurDir()
 	if err != nil {
@@ -393,7 +685,8 @@ func (d dbImpl) Fetch() error {
 	}
 	defer toDefer()
 
-	_, err = d.runCommand("git", "fetch")
+	// Fetch every remote so that the counts for mirrors are accurate too
+	_, err = d.runCommand("git", "fetch", "--all")
 	return err
 }
 
@@ -404,7 +697,9 @@ func (d dbImpl) Pull() error {
 	}
 	defer toDefer()
 
-	_, err = d.runCommand("git", "push")
+	// Merge rather than rebase, so that a conflict is left for the user to
+	// resolve instead of stopping halfway through a rebase
+	_, err = d.runCommand("git", "pull", "--no-rebase", "--no-edit")
 	return err
 }
 
@@ -444,14 +739,12 @@ func (d dbImpl) LastPullTS() (time.Time, error) {
 	return time.Unix(lastPullTS, 0), nil
 }
 
-func (d dbImpl) AheadBehindOriginMaster() (AheadBehindStruct, error) {
-	toDefer, err := d.moveCurDir()
-	if err != nil {
-		return AheadBehindStruct{}, err
-	}
-	defer toDefer()
-
-	leftAndRightRaw, err := d.runCommand("git", "rev-list", "--left-right", "--count", "origin/master...master")
+// Compares master to the remote's master. Must be called from within the root
+// directory.
+func (d dbImpl) aheadBehind(remote string) (AheadBehindStruct, error) {
+	leftAndRightRaw, err := d.runCommand(
+		"git", "rev-list", "--left-right", "--count", remote+"/master...master",
+	)
 	if err != nil {
 		return AheadBehindStruct{}, err
 	}
@@ -469,3 +762,87 @@ func (d dbImpl) AheadBehindOriginMaster() (AheadBehindStruct, error) {
 	}
 	return AheadBehindStruct{originAheadBy, localAheadBy}, nil
 }
+
+func (d dbImpl) Status() ([]StatusEntry, error) {
+	toDefer, err := d.moveCurDir()
+	if err != nil {
+		return nil, err
+	}
+	defer toDefer()
+
+	statusRaw, err := d.runCommand(
+		"git", "status", "--porcelain", "-z", "--no-renames", "--untracked-files=all",
+	)
+	if err != nil {
+		return nil, err
+	}
+	entries := parseStatus(statusRaw)
+	for i := range entries {
+		entries[i].Id = d.statusFileID(entries[i])
+	}
+	return entries, nil
+}
+
+// Parses the output of `git status --porcelain -z --no-renames` into entries
+// without IDs. Changes to blacklisted files and folders are skipped.
+func parseStatus(raw string) []StatusEntry {
+	entries := make([]StatusEntry, 0)
+	for _, line := range strings.Split(raw, "\x00") {
+		if len(line) < 4 {
+			continue
+		}
+		code, p := line[:2], line[3:]
+		if isBlacklistedPath(p) {
+			continue
+		}
+
+		state := StatusModified
+		_, conflicted := conflictedStatusCodes[code]
+		switch {
+		case conflicted:
+			state = StatusConflicted
+		case code == "??":
+			state = StatusUntracked
+		case code[0] == 'A':
+			state = StatusAdded
+		case code[0] == 'D' || code[1] == 'D':
+			state = StatusDeleted
+		}
+		entries = append(entries, StatusEntry{State: state, Path: p})
+	}
+	return entries
+}
+
+// Returns true if any component of the relative path is blacklisted.
+func isBlacklistedPath(relativePath string) bool {
+	components := strings.Split(relativePath, "/")
+	for i, component := range components {
+		if _, ok := blacklistedFolderNames[component]; ok && i < len(components)-1 {
+			return true
+		}
+	}
+	_, ok := blacklistedFileNames[components[len(components)-1]]
+	return ok
+}
+
+// Looks up the header ID of the note for a status entry. Deleted notes are
+// read from HEAD. Must be called from within the root directory.
+func (d dbImpl) statusFileID(entry StatusEntry) uuid.UUID {
+	var raw string
+	var err error
+	if entry.State == StatusDeleted {
+		raw, err = d.runCommand("git", "show", "HEAD:"+entry.Path)
+	} else {
+		var rawBytes []byte
+		rawBytes, err = ioutil.ReadFile(entry.Path)
+		raw = string(rawBytes)
+	}
+	if err != nil {
+		return uuid.Nil
+	}
+	file, err := parseFile(raw)
+	if err != nil {
+		return uuid.Nil
+	}
+	return file.ID()
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseStatus(t *testing.T) {
+	raw := " M notes/a.md\x00A  notes/b.md\x00 D notes/c.md\x00D  d.md\x00" +
+		"?? unfiled/e.md\x00?? .medb/cache\x00 M .gitignore\x00UU notes/f.md\x00AA notes/g.md\x00"
+	entries := parseStatus(raw)
+	expected := []StatusEntry{
+		{State: StatusModified, Path: "notes/a.md"},
+		{State: StatusAdded, Path: "notes/b.md"},
+		{State: StatusDeleted, Path: "notes/c.md"},
+		{State: StatusDeleted, Path: "d.md"},
+		{State: StatusUntracked, Path: "unfiled/e.md"},
+		{State: StatusConflicted, Path: "notes/f.md"},
+		{State: StatusConflicted, Path: "notes/g.md"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatal(expected, entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Fatal(expected[i], entries[i])
+		}
+	}
+}
+
+func TestSigningDBSignsCommitToGIT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-db-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := func(name string, args ...string) string {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(output), err)
+		}
+		return string(output)
+	}
+	keyDir, err := ioutil.TempDir("", "medb-db-test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+	keyPath := path.Join(keyDir, "signing_key")
+	run("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "medb@example.com", "-f", keyPath)
+	run("git", "init", "-q", "-b", "master")
+	run("git", "config", "user.name", "MeDB Test")
+	run("git", "config", "user.email", "medb@example.com")
+
+	db := NewSigningDB(dir, &SigningKey{Format: SigningFormatSSH, Path: keyPath})
+	_, err = db.CreateFile("todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CommitToGIT("create todo.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(run("git", "cat-file", "commit", "HEAD"), "\ngpgsig ") {
+		t.Fatal("The commit isn't signed")
+	}
+}
+
+func TestPull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-db-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := func(cwd string, name string, args ...string) string {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = cwd
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(output), err)
+		}
+		return string(output)
+	}
+	origin := path.Join(dir, "origin.git")
+	local := path.Join(dir, "local")
+	other := path.Join(dir, "other")
+	run(dir, "git", "init", "-q", "--bare", "-b", "master", origin)
+	for _, clone := range []string{local, other} {
+		run(dir, "git", "clone", "-q", origin, clone)
+		run(clone, "git", "config", "user.name", "MeDB Test")
+		run(clone, "git", "config", "user.email", "medb@example.com")
+	}
+	db := NewDB(local)
+	_, err = db.CreateFile("todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CommitToGIT("create todo.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both sides change different notes, so the pull merges them
+	run(other, "git", "pull", "-q")
+	err = ioutil.WriteFile(path.Join(other, "ideas.md"), []byte("garden"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(other, "git", "add", "-A")
+	run(other, "git", "commit", "-q", "-m", "create ideas.md")
+	run(other, "git", "push", "-q")
+	_, err = db.CreateFile("shopping.md", "eggs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CommitToGIT("create shopping.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path.Join(local, "ideas.md")); err != nil {
+		t.Fatal(err)
+	}
+	parents := strings.Fields(run(local, "git", "log", "-1", "--format=%P"))
+	if len(parents) != 2 {
+		t.Fatal(parents)
+	}
+	// Nothing was pushed by pulling
+	if strings.TrimSpace(run(origin, "git", "rev-parse", "master")) != strings.TrimSpace(run(other, "git", "rev-parse", "HEAD")) {
+		t.Fatal("The pull pushed")
+	}
+}
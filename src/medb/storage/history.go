@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The supported signing key formats
+const (
+	SigningFormatSSH     = "ssh"
+	SigningFormatOpenPGP = "openpgp"
+)
+
+// The signature states of a commit in the history
+const (
+	// Signed by a key we trust
+	SignatureValid = "valid"
+	// Signed, but by a key we don't know or trust
+	SignatureForeign = "foreign"
+	// The signature doesn't match the commit
+	SignatureBad     = "bad"
+	SignatureMissing = "unsigned"
+)
+
+// SigningKey is a locally configured key to sign commits with.
+type SigningKey struct {
+	// One of SigningFormatSSH or SigningFormatOpenPGP
+	Format string
+	// For ssh this is the path to the private key. For openpgp it is the path
+	// to a GnuPG home directory whose default secret key is used.
+	Path string
+}
+
+func (k *SigningKey) Validate() error {
+	if k.Path == "" {
+		return errors.New("signing key path is empty")
+	}
+	if k.Format != SigningFormatSSH && k.Format != SigningFormatOpenPGP {
+		return fmt.Errorf("unknown signing key format %q", k.Format)
+	}
+	return nil
+}
+
+// Returns the arguments to put before a git subcommand, and the environment
+// to run it with, so that commits are signed with this key.
+func (k *SigningKey) gitArgs() ([]string, []string) {
+	if k == nil {
+		return nil, nil
+	}
+	args := []string{"-c", "commit.gpgsign=true", "-c", "gpg.format=" + k.Format}
+	if k.Format == SigningFormatSSH {
+		return append(args, "-c", "user.signingkey="+k.Path), nil
+	}
+	return args, []string{"GNUPGHOME=" + k.Path}
+}
+
+type HistoryOptions struct {
+	// The max number of commits to return, newest first
+	Limit int
+	// Used to verify openpgp signatures, the keys in its keyring are trusted
+	SigningKey *SigningKey
+	// Path to an ssh allowed signers file, used to verify ssh signatures
+	AllowedSignersFile string
+}
+
+type HistoryEntry struct {
+	Hash      string    `json:"hash"`
+	Author    string    `json:"author"`
+	Email     string    `json:"email"`
+	Time      time.Time `json:"time"`
+	Message   string    `json:"message"`
+	Signature string    `json:"signature"`
+	SignedBy  string    `json:"signedBy"`
+	// True if the commit isn't signed by a trusted key
+	Flagged bool `json:"flagged"`
+}
+
+// Fields are NUL separated and commits are separated by the ASCII record separator.
+const historyFormat = "%H%x00%an%x00%ae%x00%at%x00%s%x00%G?%x00%GK%x1e"
+
+func (d dbImpl) History(options HistoryOptions) ([]HistoryEntry, error) {
+	toDefer, err := d.moveCurDir()
+	if err != nil {
+		return nil, err
+	}
+	defer toDefer()
+
+	args := []string{}
+	var env []string
+	if options.AllowedSignersFile != "" {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+options.AllowedSignersFile)
+	}
+	if options.SigningKey != nil && options.SigningKey.Format == SigningFormatOpenPGP {
+		env = []string{"GNUPGHOME=" + options.SigningKey.Path}
+	}
+	args = append(args, "log", "--format="+historyFormat)
+	if options.Limit > 0 {
+		args = append(args, "-n", strconv.Itoa(options.Limit))
+	}
+	historyRaw, err := d.runCommandWithEnv(env, "git", args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseHistory(historyRaw)
+}
+
+func parseHistory(raw string) ([]HistoryEntry, error) {
+	entries := make([]HistoryEntry, 0)
+	for _, record := range strings.Split(raw, "\x1e") {
+		record = strings.TrimLeft(record, "\n")
+		if record == "" {
+			continue
+		}
+		fields := strings.Split(record, "\x00")
+		if len(fields) != 7 {
+			return nil, errors.New("unable to parse git log output")
+		}
+		ts, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		signature := signatureState(fields[5])
+		entries = append(entries, HistoryEntry{
+			Hash:      fields[0],
+			Author:    fields[1],
+			Email:     fields[2],
+			Time:      time.Unix(ts, 0),
+			Message:   fields[4],
+			Signature: signature,
+			SignedBy:  fields[6],
+			Flagged:   signature != SignatureValid,
+		})
+	}
+	return entries, nil
+}
+
+// Maps git's %G? placeholder to one of our signature states
+func signatureState(code string) string {
+	switch code {
+	case "G":
+		return SignatureValid
+	case "B":
+		return SignatureBad
+	case "N":
+		return SignatureMissing
+	default:
+		// Good signatures with unknown validity, expired or revoked keys, and
+		// keys we can't check at all.
+		return SignatureForeign
+	}
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistory(t *testing.T) {
+	record := func(code string, key string) string {
+		return strings.Join([]string{
+			"d6cd1e2bd19e03a81132a23b2d920a6d1d2a2e5b", "alice", "alice@example.com", "1513066695", "edit todo.md", code, key,
+		}, "\x00") + "\x1e\n"
+	}
+	tests := []struct {
+		name      string
+		code      string
+		key       string
+		signature string
+		flagged   bool
+	}{
+		{"signed", "G", "SHA256:abc", SignatureValid, false},
+		{"unsigned", "N", "", SignatureMissing, true},
+		{"bad", "B", "SHA256:abc", SignatureBad, true},
+		{"unknown validity", "U", "SHA256:def", SignatureForeign, true},
+		{"foreign key", "E", "SHA256:def", SignatureForeign, true},
+		{"expired key", "Y", "SHA256:def", SignatureForeign, true},
+		{"revoked key", "R", "SHA256:def", SignatureForeign, true},
+	}
+	for _, test := range tests {
+		entries, err := parseHistory(record(test.code, test.key))
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if len(entries) != 1 {
+			t.Fatal(test.name, entries)
+		}
+		entry := entries[0]
+		if entry.Signature != test.signature || entry.Flagged != test.flagged || entry.SignedBy != test.key {
+			t.Fatal(test.name, entry)
+		}
+		if entry.Author != "alice" || entry.Email != "alice@example.com" || entry.Message != "edit todo.md" ||
+			!entry.Time.Equal(time.Unix(1513066695, 0)) {
+			t.Fatal(test.name, entry)
+		}
+	}
+
+	entries, err := parseHistory(record("G", "SHA256:abc") + record("N", ""))
+	if err != nil || len(entries) != 2 {
+		t.Fatal(entries, err)
+	}
+	if _, err = parseHistory("d6cd1e2b\x00alice\x1e"); err == nil {
+		t.Fatal("Expected an error for a short record")
+	}
+}
+
+func TestSquashKeepsSignatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-history-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := func(name string, args ...string) {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(output), err)
+		}
+	}
+	keyDir, err := ioutil.TempDir("", "medb-history-test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+	keyPath := path.Join(keyDir, "signing_key")
+	run("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "medb@example.com", "-f", keyPath)
+	publicKey, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedSigners := path.Join(keyDir, "allowed_signers")
+	err = ioutil.WriteFile(allowedSigners, []byte("medb@example.com "+string(publicKey)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run("git", "init", "-q", "-b", "master")
+	run("git", "config", "user.name", "MeDB Test")
+	run("git", "config", "user.email", "medb@example.com")
+
+	key := &SigningKey{Format: SigningFormatSSH, Path: keyPath}
+	d := dbImpl{rootPath: dir}
+	f, err := d.CreateFile("todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := CommitOptions{NoteID: f.ID(), SigningKey: key}
+	for _, content := range []string{"milk", "milk, eggs", "milk, eggs, bread"} {
+		f.Update(content)
+		err = d.SaveFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.CommitWithOptions("edit todo.md", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	squashed, err := d.SquashAutoCommits(10*time.Minute, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if squashed != 2 {
+		t.Fatal(squashed)
+	}
+	entries, err := d.History(HistoryOptions{AllowedSignersFile: allowedSigners})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Signature != SignatureValid || entries[0].Flagged {
+		t.Fatal(entries)
+	}
+}
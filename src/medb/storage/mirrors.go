@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"medb/atomicfile"
+	"os"
+	"strings"
+	"time"
+)
+
+// Where we track the push results for each remote. It lives in .git so that
+// it's never committed.
+const pushRecordsPath = ".git/medb-pushes.json"
+
+type PushResult struct {
+	Remote string
+	Err    error
+}
+
+// RemoteStatus is what we know about the state of a remote.
+type RemoteStatus struct {
+	Remote string
+	// nil if we don't have a tracking branch for the remote yet
+	AheadBehind     *AheadBehindStruct
+	LastPushAttempt time.Time
+	LastPushSuccess time.Time
+	// Empty if the last push attempt succeeded
+	LastPushError string
+}
+
+type pushRecord struct {
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastError   string    `json:"lastError"`
+}
+
+// ParseRemotes returns the remotes in a comma separated list, ignoring
+// spaces around them and empty entries.
+func ParseRemotes(raw string) []string {
+	remotes := make([]string, 0)
+	for _, remote := range strings.Split(raw, ",") {
+		remote = strings.TrimSpace(remote)
+		if remote != "" {
+			remotes = append(remotes, remote)
+		}
+	}
+	return remotes
+}
+
+// CombinedAheadBehind sums up the remotes we track: how far the furthest
+// ahead of them is ahead of us, and how far we're ahead of the furthest
+// behind.
+func CombinedAheadBehind(statuses []RemoteStatus) AheadBehindStruct {
+	combined := AheadBehindStruct{}
+	for _, status := range statuses {
+		if status.AheadBehind == nil {
+			continue
+		}
+		if status.AheadBehind.OriginAheadBy > combined.OriginAheadBy {
+			combined.OriginAheadBy = status.AheadBehind.OriginAheadBy
+		}
+		if status.AheadBehind.LocalAheadBy > combined.LocalAheadBy {
+			combined.LocalAheadBy = status.AheadBehind.LocalAheadBy
+		}
+	}
+	return combined
+}
+
+// Pushes master to each of the remotes, and records how that went.
+// The returned error is only set if we couldn't record the results.
+func (d dbImpl) PushMirrors(remotes []string) ([]PushResult, error) {
+	toDefer, err := d.moveCurDir()
+	if err != nil {
+		return nil, err
+	}
+	defer toDefer()
+
+	records, err := d.readPushRecords()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]PushResult, 0, len(remotes))
+	for _, remote := range remotes {
+		now := time.Now()
+		_, pushErr := d.runCommand("git", "push", remote, "master")
+
+		record := records[remote]
+		record.LastAttempt = now
+		record.LastError = ""
+		if pushErr != nil {
+			record.LastError = pushErr.Error()
+		} else {
+			record.LastSuccess = now
+		}
+		records[remote] = record
+		results = append(results, PushResult{Remote: remote, Err: pushErr})
+	}
+	return results, d.writePushRecords(records)
+}
+
+func (d dbImpl) RemoteStatuses(remotes []string) ([]RemoteStatus, error) {
+	toDefer, err := d.moveCurDir()
+	if err != nil {
+		return nil, err
+	}
+	defer toDefer()
+
+	records, err := d.readPushRecords()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]RemoteStatus, 0, len(remotes))
+	for _, remote := range remotes {
+		record := records[remote]
+		status := RemoteStatus{
+			Remote:          remote,
+			LastPushAttempt: record.LastAttempt,
+			LastPushSuccess: record.LastSuccess,
+			LastPushError:   record.LastError,
+		}
+		aheadBehind, err := d.aheadBehind(remote)
+		if err == nil {
+			status.AheadBehind = &aheadBehind
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Must be called from within the root directory.
+func (d dbImpl) readPushRecords() (map[string]pushRecord, error) {
+	records := make(map[string]pushRecord)
+	raw, err := ioutil.ReadFile(pushRecordsPath)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &records)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Must be called from within the root directory.
+func (d dbImpl) writePushRecords(records map[string]pushRecord) error {
+	raw, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(pushRecordsPath, raw, 0644)
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseRemotes(t *testing.T) {
+	remotes := ParseRemotes(" backup, offsite ,,github")
+	expected := []string{"backup", "offsite", "github"}
+	if len(remotes) != len(expected) {
+		t.Fatal(remotes)
+	}
+	for i, remote := range remotes {
+		if remote != expected[i] {
+			t.Fatal(remotes)
+		}
+	}
+	if remotes = ParseRemotes(""); len(remotes) != 0 {
+		t.Fatal(remotes)
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-mirrors-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(output), err)
+		}
+	}
+	dbPath := path.Join(dir, "db")
+	clonePath := path.Join(dir, "clone")
+	for _, p := range []string{dbPath, path.Join(dir, "backup.git"), path.Join(dir, "offsite.git")} {
+		err = os.MkdirAll(p, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(path.Join(dir, "backup.git"), "init", "-q", "--bare", "-b", "master")
+	git(path.Join(dir, "offsite.git"), "init", "-q", "--bare", "-b", "master")
+	git(dbPath, "init", "-q", "-b", "master")
+	git(dbPath, "config", "user.name", "MeDB Test")
+	git(dbPath, "config", "user.email", "test@medb.example")
+	// There's no origin, only mirrors
+	git(dbPath, "remote", "add", "backup", path.Join(dir, "backup.git"))
+	git(dbPath, "remote", "add", "offsite", path.Join(dir, "offsite.git"))
+	git(dbPath, "remote", "add", "broken", path.Join(dir, "missing.git"))
+
+	d := dbImpl{rootPath: dbPath}
+	commit := func(name string) {
+		_, err := d.CreateFile(name, "one")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.CommitWithOptions("create "+name, CommitOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit("ideas.md")
+
+	statuses, err := d.RemoteStatuses([]string{"backup", "offsite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AheadBehind != nil || !status.LastPushAttempt.IsZero() {
+			t.Fatal(status)
+		}
+	}
+
+	results, err := d.PushMirrors([]string{"backup", "offsite", "broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Err != nil || results[1].Err != nil || results[2].Err == nil {
+		t.Fatal(results)
+	}
+	statuses, err = d.RemoteStatuses([]string{"backup", "offsite", "broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, broken := statuses[0], statuses[2]
+	if backup.AheadBehind == nil || *backup.AheadBehind != (AheadBehindStruct{}) ||
+		backup.LastPushSuccess.IsZero() || backup.LastPushError != "" {
+		t.Fatal(backup)
+	}
+	// Says why, not just that git failed
+	if broken.AheadBehind != nil || !broken.LastPushSuccess.IsZero() ||
+		!strings.Contains(broken.LastPushError, "does not appear to be a git repository") {
+		t.Fatal(broken)
+	}
+
+	// Someone else pushes to offsite, and we commit something new
+	git(dir, "clone", "-q", path.Join(dir, "offsite.git"), clonePath)
+	git(clonePath, "config", "user.name", "MeDB Test")
+	git(clonePath, "config", "user.email", "test@medb.example")
+	git(clonePath, "commit", "-q", "--allow-empty", "-m", "Elsewhere")
+	git(clonePath, "push", "-q", "origin", "master")
+	commit("todo.md")
+	git(dbPath, "remote", "remove", "broken")
+	err = d.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err = d.RemoteStatuses([]string{"backup", "offsite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *statuses[0].AheadBehind != (AheadBehindStruct{OriginAheadBy: 0, LocalAheadBy: 1}) {
+		t.Fatal(statuses[0])
+	}
+	if *statuses[1].AheadBehind != (AheadBehindStruct{OriginAheadBy: 1, LocalAheadBy: 1}) {
+		t.Fatal(statuses[1])
+	}
+	if combined := CombinedAheadBehind(statuses); combined != (AheadBehindStruct{OriginAheadBy: 1, LocalAheadBy: 1}) {
+		t.Fatal(combined)
+	}
+	if combined := CombinedAheadBehind(nil); combined != (AheadBehindStruct{}) {
+		t.Fatal(combined)
+	}
+}
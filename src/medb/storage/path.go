@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// InvalidPathError is returned when a path given to the DB would write
+// outside of its root, or into one of the folders medb and git manage.
+type InvalidPathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *InvalidPathError) Error() string {
+	return fmt.Sprintf("invalid path %q: %s", e.Path, e.Reason)
+}
+
+// Every write to the DB must go through this. It validates a path relative to
+// the root and returns where to actually write it.
+func (d dbImpl) resolveWritePath(relativePath string) (string, error) {
+	invalid := func(reason string) error {
+		return &InvalidPathError{Path: relativePath, Reason: reason}
+	}
+	if relativePath == "" {
+		return "", invalid("path is empty")
+	}
+	if strings.ContainsRune(relativePath, 0) {
+		return "", invalid("path contains a NUL byte")
+	}
+	if path.IsAbs(relativePath) || filepath.IsAbs(relativePath) {
+		return "", invalid("path must be relative to the db root")
+	}
+	for _, component := range strings.Split(relativePath, "/") {
+		if component == ".." {
+			return "", invalid("path can't contain ..")
+		}
+	}
+	cleanPath := path.Clean(relativePath)
+	if cleanPath == "." {
+		return "", invalid("path is the db root")
+	}
+	if isReservedPath(cleanPath) {
+		return "", invalid("path is reserved")
+	}
+
+	// Lastly, make sure that no symlink along the way takes us somewhere else
+	err := d.checkSymlinks(cleanPath)
+	if err != nil {
+		return "", invalid(err.Error())
+	}
+	return path.Join(d.rootPath, cleanPath), nil
+}
+
+// Returns true if the clean relative path is in a blacklisted folder or is a
+// blacklisted file itself.
+func isReservedPath(cleanPath string) bool {
+	components := strings.Split(cleanPath, "/")
+	for _, component := range components {
+		if _, ok := blacklistedFolderNames[component]; ok {
+			return true
+		}
+	}
+	_, ok := blacklistedFileNames[components[len(components)-1]]
+	return ok
+}
+
+// Resolves the deepest part of the path that exists and makes sure it's
+// still inside the root, and not in a reserved folder.
+func (d dbImpl) checkSymlinks(cleanPath string) error {
+	realRoot, err := filepath.EvalSymlinks(d.rootPath)
+	if err != nil {
+		return err
+	}
+	existing := cleanPath
+	for {
+		_, err := os.Lstat(path.Join(d.rootPath, existing))
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		existing = path.Dir(existing)
+		if existing == "." {
+			// Nothing below the root exists yet
+			return nil
+		}
+	}
+
+	realPath, err := filepath.EvalSymlinks(path.Join(d.rootPath, existing))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is a dangling symlink", existing)
+	}
+	if err != nil {
+		return err
+	}
+	realRelative, err := filepath.Rel(realRoot, realPath)
+	if err != nil {
+		return err
+	}
+	realRelative = filepath.ToSlash(realRelative)
+	if realRelative == ".." || strings.HasPrefix(realRelative, "../") {
+		return fmt.Errorf("%s links outside of the db root", existing)
+	}
+	if realRelative != "." && isReservedPath(realRelative) {
+		return fmt.Errorf("%s links to a reserved path", existing)
+	}
+	return nil
+}
+
+// Returns the path of a file in the DB relative to the root.
+func (d dbImpl) relativePath(fullPath string) (string, error) {
+	relative, err := filepath.Rel(d.rootPath, fullPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(relative), nil
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Creates a db root with a .git folder and a directory outside of it.
+func setUpSandbox(t *testing.T) (dbImpl, string, func()) {
+	dir, err := ioutil.TempDir("", "medb-path-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := path.Join(dir, "root")
+	outside := path.Join(dir, "outside")
+	for _, p := range []string{path.Join(root, ".git"), path.Join(root, "notes"), outside} {
+		err = os.MkdirAll(p, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dbImpl{rootPath: root}, outside, func() { os.RemoveAll(dir) }
+}
+
+func TestResolveWritePath(t *testing.T) {
+	d, outside, cleanUp := setUpSandbox(t)
+	defer cleanUp()
+
+	mustSymlink := func(target string, name string) {
+		err := os.Symlink(target, path.Join(d.rootPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustSymlink(outside, "escape")
+	mustSymlink(path.Join(outside, "missing.md"), "dangling.md")
+	mustSymlink(path.Join(d.rootPath, ".git"), "sneaky")
+	mustSymlink(path.Join(d.rootPath, "notes"), "alias")
+
+	invalidPaths := []string{
+		"",
+		".",
+		"/etc/passwd",
+		"../outside/note.md",
+		"notes/../../outside/note.md",
+		"notes/../note.md",
+		".git/config",
+		".git/hooks/post-commit",
+		"notes/.git/config",
+		".medb/state",
+		".gitignore",
+		"escape/note.md",
+		"escape",
+		"dangling.md",
+		"sneaky/config",
+		"null\x00byte.md",
+	}
+	for _, p := range invalidPaths {
+		_, err := d.resolveWritePath(p)
+		if _, ok := err.(*InvalidPathError); !ok {
+			t.Errorf("expected %q to be rejected, got %v", p, err)
+		}
+	}
+
+	validPaths := map[string]string{
+		"note.md":               "note.md",
+		"notes/note.md":         "notes/note.md",
+		"./notes/note.md":       "notes/note.md",
+		"new/folder/note.md":    "new/folder/note.md",
+		"alias/note.md":         "alias/note.md",
+		"notes//double/note.md": "notes/double/note.md",
+	}
+	for p, expected := range validPaths {
+		resolved, err := d.resolveWritePath(p)
+		if err != nil {
+			t.Errorf("expected %q to be allowed, got %v", p, err)
+			continue
+		}
+		if resolved != path.Join(d.rootPath, expected) {
+			t.Errorf("expected %q to resolve to %q, got %q", p, expected, resolved)
+		}
+	}
+}
+
+func TestWritesAreSandboxed(t *testing.T) {
+	d, outside, cleanUp := setUpSandbox(t)
+	defer cleanUp()
+
+	err := d.NewFile("../outside/note.md", "content")
+	if _, ok := err.(*InvalidPathError); !ok {
+		t.Fatal(err)
+	}
+	err = d.NewFile(".git/hooks/pre-commit", "#!/bin/sh")
+	if _, ok := err.(*InvalidPathError); !ok {
+		t.Fatal(err)
+	}
+
+	// A file that somehow points outside of the root can't be saved either
+	f := &fileImpl{currentLocation: path.Join(outside, "note.md")}
+	f.CreateHeader()
+	err = d.SaveFile(f)
+	if _, ok := err.(*InvalidPathError); !ok {
+		t.Fatal(err)
+	}
+	infos, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Fatal("wrote outside of the root")
+	}
+
+	err = d.NewFile("notes/note.md", "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(path.Join(d.rootPath, "notes", "note.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateAndDeleteFile(t *testing.T) {
+	d, _, cleanUp := setUpSandbox(t)
+	defer cleanUp()
+
+	f, err := d.CreateFile("projects/medb/ideas.md", "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name() != "ideas.md" || f.Content() != "content" {
+		t.Fatal(f)
+	}
+	loaded, err := d.LoadFile(f.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Content() != "content" {
+		t.Fatal(loaded)
+	}
+
+	// Unlike NewFile, this never overwrites
+	if _, err = d.CreateFile("projects/medb/ideas.md", "other"); err != ErrFileExists {
+		t.Fatal(err)
+	}
+	if _, err = d.CreateFile(".git/config", "other"); err == nil {
+		t.Fatal("created a reserved file")
+	}
+
+	err = d.DeleteFile(f.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.LoadFile(f.ID()); err != ErrFileNotFound {
+		t.Fatal(err)
+	}
+	if err = d.DeleteFile(f.ID()); err != ErrFileNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	d, _, cleanUp := setUpSandbox(t)
+	defer cleanUp()
+
+	f, err := d.CreateFile("unfiled/ideas.md", "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.CreateFile("unfiled/other.md", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := d.MoveFile(f.ID(), "projects/medb/ideas.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.ID() != f.ID() || moved.Name() != "ideas.md" || moved.Content() != "content" {
+		t.Fatal(moved)
+	}
+	loaded, err := d.LoadFile(f.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Path() != moved.Path() {
+		t.Fatal(loaded.Path(), moved.Path())
+	}
+
+	// Never onto another file, or out of the root
+	if _, err = d.MoveFile(f.ID(), "unfiled/other.md"); err != ErrFileExists {
+		t.Fatal(err)
+	}
+	if _, err = d.MoveFile(f.ID(), "../ideas.md"); err == nil {
+		t.Fatal("moved out of the root")
+	}
+	if _, err = d.MoveFile(uuid.New(), "unfiled/new.md"); err != ErrFileNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteFileAt(t *testing.T) {
+	d, _, cleanUp := setUpSandbox(t)
+	defer cleanUp()
+
+	f, err := d.WriteFileAt("notes/new.md", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.HasHeader() {
+		t.Fatal("no header")
+	}
+	// The header stays when it's written again
+	if _, err = d.WriteFileAt("notes/new.md", "two"); err != nil {
+		t.Fatal(err)
+	}
+	read, err := d.ReadFileAt("notes/new.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.ID() != f.ID() || read.Content() != "two" {
+		t.Fatal(read.ID(), read.Content())
+	}
+
+	err = ioutil.WriteFile(path.Join(d.rootPath, "notes", "plain.md"), []byte("plain"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read, err = d.ReadFileAt("notes/plain.md"); err != nil || read.HasHeader() || read.Content() != "plain" {
+		t.Fatal(read, err)
+	}
+	if f, err = d.WriteFileAt("notes/plain.md", "plainer"); err != nil || !f.HasHeader() {
+		t.Fatal(f, err)
+	}
+
+	if _, err = d.ReadFileAt("notes/missing.md"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if _, err = d.WriteFileAt(".git/config", "oops"); err == nil {
+		t.Fatal("wrote into .git")
+	}
+	if !IsHiddenName(".medb") || !IsHiddenName(".gitignore") || IsHiddenName("notes") {
+		t.Fatal("hidden names are wrong")
+	}
+}
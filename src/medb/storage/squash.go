@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Commits that save a single note end with this trailer followed by the note's ID.
+	noteTrailerPrefix = "MeDB-Note: "
+
+	// A git log format that parseLog understands. Fields are NUL separated and
+	// commits are separated by the ASCII record separator.
+	logFormat = "%H%x00%P%x00%an%x00%ae%x00%at%x00%ct%x00%B%x1e"
+)
+
+// Returned by SquashAutoCommits without a signing key, rather than replacing
+// signed commits with unsigned ones.
+var ErrSignedCommits = errors.New("refusing to rewrite signed commits")
+
+// Commits made before we added the trailer only have the ID in the message
+var legacyNoteCommitRegexp = regexp.MustCompile(
+	"^MeDB Sync - saving updated file ([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})",
+)
+
+type commitInfo struct {
+	hash        string
+	parents     []string
+	authorName  string
+	authorEmail string
+	authorTS    time.Time
+	commitTS    time.Time
+	message     string
+}
+
+// Returns the note that the commit saves, or uuid.Nil if it isn't an
+// automatic commit of a single note.
+func (c commitInfo) noteID() uuid.UUID {
+	for _, line := range strings.Split(c.message, "\n") {
+		if strings.HasPrefix(line, noteTrailerPrefix) {
+			id, err := uuid.Parse(strings.TrimSpace(line[len(noteTrailerPrefix):]))
+			if err == nil {
+				return id
+			}
+		}
+	}
+	submatches := legacyNoteCommitRegexp.FindStringSubmatch(c.message)
+	if len(submatches) == 2 {
+		id, err := uuid.Parse(submatches[1])
+		if err == nil {
+			return id
+		}
+	}
+	return uuid.Nil
+}
+
+func parseLog(raw string) ([]commitInfo, error) {
+	commits := make([]commitInfo, 0)
+	for _, record := range strings.Split(raw, "\x1e") {
+		record = strings.TrimLeft(record, "\n")
+		if record == "" {
+			continue
+		}
+		fields := strings.Split(record, "\x00")
+		if len(fields) != 7 {
+			return nil, errors.New("unable to parse git log output")
+		}
+		authorTS, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		commitTS, err := strconv.ParseInt(fields[5], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, commitInfo{
+			hash:        fields[0],
+			parents:     strings.Fields(fields[1]),
+			authorName:  fields[2],
+			authorEmail: fields[3],
+			authorTS:    time.Unix(authorTS, 0),
+			commitTS:    time.Unix(commitTS, 0),
+			message:     strings.TrimSpace(fields[6]),
+		})
+	}
+	return commits, nil
+}
+
+// Groups oldest-first commits into runs of automatic commits of the same note
+// by the same author, each made within window of the previous one. Every
+// other commit ends up in a group of its own.
+func groupCommitRuns(commits []commitInfo, window time.Duration) [][]commitInfo {
+	groups := make([][]commitInfo, 0, len(commits))
+	for _, c := range commits {
+		if len(groups) > 0 {
+			lastGroup := groups[len(groups)-1]
+			last := lastGroup[len(lastGroup)-1]
+			id := c.noteID()
+			if id != uuid.Nil &&
+				id == last.noteID() &&
+				c.authorName == last.authorName &&
+				c.authorEmail == last.authorEmail &&
+				c.authorTS.Sub(last.authorTS) <= window {
+				groups[len(groups)-1] = append(lastGroup, c)
+				continue
+			}
+		}
+		groups = append(groups, []commitInfo{c})
+	}
+	return groups
+}
+
+// Squashes runs of unpushed automatic commits (see groupCommitRuns) into a
+// single commit each, signing the new commits with signingKey if it isn't
+// nil. Returns the number of commits that were removed.
+func (d dbImpl) SquashAutoCommits(window time.Duration, signingKey *SigningKey) (int, error) {
+	toDefer, err := d.moveCurDir()
+	if err != nil {
+		return 0, err
+	}
+	defer toDefer()
+
+	logRaw, err := d.runCommand(
+		"git", "log", "--reverse", "--first-parent", "--format="+logFormat, "HEAD", "--not", "--remotes",
+	)
+	if err != nil {
+		return 0, err
+	}
+	commits, err := parseLog(logRaw)
+	if err != nil {
+		return 0, err
+	}
+	// Only rewrite the linear history since the last merge
+	for i := len(commits) - 1; i >= 0; i-- {
+		if len(commits[i].parents) > 1 {
+			commits = commits[i+1:]
+			break
+		}
+	}
+	groups := groupCommitRuns(commits, window)
+	if len(groups) == len(commits) {
+		// Nothing to squash
+		return 0, nil
+	}
+
+	if signingKey == nil {
+		// Every commit from the first run on gets a new hash, so their
+		// signatures would be lost
+		firstRewritten := 0
+		for _, group := range groups {
+			if len(group) > 1 {
+				break
+			}
+			firstRewritten++
+		}
+		for _, c := range commits[firstRewritten:] {
+			signed, err := d.isSigned(c.hash)
+			if err != nil {
+				return 0, err
+			}
+			if signed {
+				return 0, ErrSignedCommits
+			}
+		}
+	}
+
+	signingArgs, signingEnv := signingKey.gitArgs()
+	parent := ""
+	if len(commits[0].parents) == 1 {
+		parent = commits[0].parents[0]
+	}
+	for _, group := range groups {
+		first, last := group[0], group[len(group)-1]
+		if len(group) == 1 && len(first.parents) == 1 && first.parents[0] == parent {
+			// Nothing has changed up to here, keep the commit as it is
+			parent = first.hash
+			continue
+		}
+
+		// Keep the first message, but the content and date of the last commit
+		args := append(append([]string{}, signingArgs...), "commit-tree", last.hash+"^{tree}", "-m", first.message)
+		if signingKey != nil {
+			// commit-tree doesn't sign unless it's asked to
+			args = append(args, "-S")
+		}
+		if parent != "" {
+			args = append(args, "-p", parent)
+		}
+		newHash, err := d.runCommandWithEnv(append([]string{
+			"GIT_AUTHOR_NAME=" + first.authorName,
+			"GIT_AUTHOR_EMAIL=" + first.authorEmail,
+			fmt.Sprintf("GIT_AUTHOR_DATE=%d +0000", last.authorTS.Unix()),
+		}, signingEnv...), "git", args...)
+		if err != nil {
+			return 0, err
+		}
+		parent = strings.TrimSpace(newHash)
+	}
+
+	oldHead := commits[len(commits)-1].hash
+	_, err = d.runCommand("git", "update-ref", "-m", "medb: squash automatic commits", "HEAD", parent, oldHead)
+	if err != nil {
+		return 0, err
+	}
+	return len(commits) - len(groups), nil
+}
+
+// Returns whether the commit carries a signature, without verifying it.
+// Must be called from within the root directory.
+func (d dbImpl) isSigned(hash string) (bool, error) {
+	raw, err := d.runCommand("git", "cat-file", "commit", hash)
+	if err != nil {
+		return false, err
+	}
+	// The headers end at the first empty line
+	for _, line := range strings.Split(raw, "\n") {
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "gpgsig") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
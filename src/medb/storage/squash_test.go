@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCommitNoteID(t *testing.T) {
+	c := commitInfo{message: "MeDB Sync - edit todo.md\n\n" + noteTrailerPrefix + "430bf597-74ac-40ad-9453-edcc353bc026"}
+	if c.noteID().String() != "430bf597-74ac-40ad-9453-edcc353bc026" {
+		t.Fatal(c.noteID())
+	}
+	c = commitInfo{message: "MeDB Sync - saving updated file 430bf597-74ac-40ad-9453-edcc353bc026"}
+	if c.noteID().String() != "430bf597-74ac-40ad-9453-edcc353bc026" {
+		t.Fatal(c.noteID())
+	}
+	c = commitInfo{message: "MeDB Sync - 1513066695"}
+	if c.noteID().String() != "00000000-0000-0000-0000-000000000000" {
+		t.Fatal(c.noteID())
+	}
+}
+
+func TestGroupCommitRuns(t *testing.T) {
+	start := time.Unix(1513066695, 0)
+	noteA := "\n\n" + noteTrailerPrefix + "430bf597-74ac-40ad-9453-edcc353bc026"
+	noteB := "\n\n" + noteTrailerPrefix + "530bf597-74ac-40ad-9453-edcc353bc026"
+	commit := func(hash string, author string, offset time.Duration, message string) commitInfo {
+		return commitInfo{
+			hash:        hash,
+			authorName:  author,
+			authorEmail: author + "@example.com",
+			authorTS:    start.Add(offset),
+			message:     message,
+		}
+	}
+	commits := []commitInfo{
+		commit("1", "alice", 0, "edit"+noteA),
+		commit("2", "alice", time.Minute, "edit"+noteA),
+		commit("3", "alice", 2*time.Minute, "edit"+noteA),
+		// Different author
+		commit("4", "bob", 3*time.Minute, "edit"+noteA),
+		// Different note
+		commit("5", "bob", 4*time.Minute, "edit"+noteB),
+		// Too long after the previous edit
+		commit("6", "bob", time.Hour, "edit"+noteB),
+		// Not an automatic note commit
+		commit("7", "bob", time.Hour, "MeDB Sync - 1513066695"),
+		commit("8", "bob", time.Hour, "MeDB Sync - 1513066695"),
+	}
+	groups := groupCommitRuns(commits, 10*time.Minute)
+	expected := [][]string{{"1", "2", "3"}, {"4"}, {"5"}, {"6"}, {"7"}, {"8"}}
+	if len(groups) != len(expected) {
+		t.Fatal(expected, groups)
+	}
+	for i, group := range groups {
+		if len(group) != len(expected[i]) {
+			t.Fatal(expected[i], group)
+		}
+		for j, c := range group {
+			if c.hash != expected[i][j] {
+				t.Fatal(expected[i], group)
+			}
+		}
+	}
+}
+
+func TestSquashRefusesSignedCommits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "medb-squash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := func(name string, args ...string) string {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(output), err)
+		}
+		return string(output)
+	}
+	keyDir, err := ioutil.TempDir("", "medb-squash-test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+	keyPath := path.Join(keyDir, "signing_key")
+	run("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "medb@example.com", "-f", keyPath)
+	run("git", "init", "-q", "-b", "master")
+	run("git", "config", "user.name", "MeDB Test")
+	run("git", "config", "user.email", "medb@example.com")
+
+	d := dbImpl{rootPath: dir}
+	f, err := d.CreateFile("todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := CommitOptions{NoteID: f.ID(), SigningKey: &SigningKey{Format: SigningFormatSSH, Path: keyPath}}
+	for _, content := range []string{"milk", "milk, eggs"} {
+		f.Update(content)
+		err = d.SaveFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.CommitWithOptions("edit todo.md", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	head := run("git", "rev-parse", "HEAD")
+
+	_, err = d.SquashAutoCommits(10*time.Minute, nil)
+	if err != ErrSignedCommits {
+		t.Fatal(err)
+	}
+	if run("git", "rev-parse", "HEAD") != head {
+		t.Fatal("HEAD was rewritten")
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"medb/client"
+	"medb/commitpolicy"
+	"medb/storage"
+)
+
+// A note as the commands see it, wherever it's stored. The content is empty
+// in lists of notes.
+type note struct {
+	id uuid.UUID
+	// Relative to the root of the DB. Servers only load the name.
+	path    string
+	content string
+}
+
+// backend is where the notes are, either a local DB or a server.
+type backend interface {
+	list() ([]note, error)
+	load(id uuid.UUID) (note, error)
+	search(query string) ([]note, error)
+	create(path string, content string) (note, error)
+	save(id uuid.UUID, content string) error
+	move(id uuid.UUID, newPath string) (note, error)
+	remove(id uuid.UUID) error
+	history(limit int) ([]storage.HistoryEntry, error)
+}
+
+// Returns the identity git commits as in the DB, or nil if there isn't one.
+func gitAuthor(rootPath string) *storage.Author {
+	config := func(key string) string {
+		cmd := exec.Command("git", "config", key)
+		cmd.Dir = rootPath
+		value, err := cmd.Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(value))
+	}
+	name := config("user.name")
+	if name == "" {
+		return nil
+	}
+	return &storage.Author{Name: name, Email: config("user.email")}
+}
+
+type localBackend struct {
+	rootPath string
+	db       storage.DB
+	commits  commitpolicy.Policy
+	// When nil, git's configured identity is used and edits aren't coalesced
+	author *storage.Author
+}
+
+func newLocalBackend(rootPath string, commits commitpolicy.Policy, author *storage.Author) backend {
+	return localBackend{rootPath: rootPath, db: storage.NewDB(rootPath), commits: commits, author: author}
+}
+
+// Commits everything in the DB. noteID should be uuid.Nil unless the change
+// is to a single existing note, so that only edits are coalesced.
+func (l localBackend) commit(operation string, title string, noteID uuid.UUID) error {
+	username := ""
+	if l.author != nil {
+		username = l.author.Name
+	}
+	return l.commits.Commit(l.db, l.author, username, operation, title, noteID)
+}
+
+func (l localBackend) toNote(f storage.File, withContent bool) note {
+	n := note{
+		id:   f.ID(),
+		path: strings.TrimPrefix(f.Path(), strings.TrimSuffix(l.rootPath, "/")+"/"),
+	}
+	if withContent {
+		n.content = f.Content()
+	}
+	return n
+}
+
+func (l localBackend) list() ([]note, error) {
+	files, err := l.db.AllFiles()
+	if err != nil {
+		return nil, err
+	}
+	notes := make([]note, len(files))
+	for i, f := range files {
+		notes[i] = l.toNote(f, false)
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].path < notes[j].path })
+	return notes, nil
+}
+
+func (l localBackend) load(id uuid.UUID) (note, error) {
+	f, err := l.db.LoadFile(id)
+	if err != nil {
+		return note{}, err
+	}
+	return l.toNote(f, true), nil
+}
+
+func (l localBackend) search(query string) ([]note, error) {
+	files, err := l.db.Search(query, storage.SearchOptions{Limit: searchLimit})
+	if err != nil {
+		return nil, err
+	}
+	notes := make([]note, len(files))
+	for i, f := range files {
+		notes[i] = l.toNote(f, false)
+	}
+	return notes, nil
+}
+
+func (l localBackend) create(p string, content string) (note, error) {
+	f, err := l.db.CreateFile(p, content)
+	if err != nil {
+		return note{}, err
+	}
+	err = l.commit(commitpolicy.OperationCreate, f.Name(), uuid.Nil)
+	if err != nil {
+		return note{}, err
+	}
+	return l.toNote(f, true), nil
+}
+
+func (l localBackend) save(id uuid.UUID, content string) error {
+	f, err := l.db.LoadFile(id)
+	if err != nil {
+		return err
+	}
+	f.Update(content)
+	err = l.db.SaveFile(f)
+	if err != nil {
+		return err
+	}
+	return l.commit(commitpolicy.OperationEdit, f.Name(), f.ID())
+}
+
+func (l localBackend) move(id uuid.UUID, newPath string) (note, error) {
+	f, err := l.db.MoveFile(id, newPath)
+	if err != nil {
+		return note{}, err
+	}
+	err = l.commit(commitpolicy.OperationMove, f.Name(), uuid.Nil)
+	if err != nil {
+		return note{}, err
+	}
+	return l.toNote(f, false), nil
+}
+
+func (l localBackend) remove(id uuid.UUID) error {
+	f, err := l.db.LoadFile(id)
+	if err != nil {
+		return err
+	}
+	err = l.db.DeleteFile(id)
+	if err != nil {
+		return err
+	}
+	return l.commit(commitpolicy.OperationDelete, f.Name(), uuid.Nil)
+}
+
+func (l localBackend) history(limit int) ([]storage.HistoryEntry, error) {
+	return l.db.History(storage.HistoryOptions{Limit: limit})
+}
+
+// The server commits every change itself.
+type remoteBackend struct {
+	c *client.Client
+}
+
+func newRemoteBackend(serverURL string, token string) (backend, error) {
+	c, err := client.NewWithToken(serverURL, token)
+	if err != nil {
+		return nil, err
+	}
+	return remoteBackend{c: c}, nil
+}
+
+// Flattens the tree into the notes in it, with the folders as their path.
+func flattenEntries(folder string, entries []*client.Entry, notes []note) []note {
+	for _, entry := range entries {
+		p := path.Join(folder, entry.Name)
+		if entry.IsNote() {
+			notes = append(notes, note{id: entry.ID, path: p})
+		} else {
+			notes = flattenEntries(p, entry.Contents, notes)
+		}
+	}
+	return notes
+}
+
+func (r remoteBackend) list() ([]note, error) {
+	entries, err := r.c.List()
+	if err != nil {
+		return nil, err
+	}
+	notes := flattenEntries("", entries, nil)
+	sort.Slice(notes, func(i, j int) bool { return notes[i].path < notes[j].path })
+	return notes, nil
+}
+
+func (r remoteBackend) load(id uuid.UUID) (note, error) {
+	n, err := r.c.Load(id)
+	if err != nil {
+		return note{}, err
+	}
+	return note{id: n.ID, path: n.Name, content: n.Content}, nil
+}
+
+func (r remoteBackend) search(query string) ([]note, error) {
+	results, err := r.c.Search(query)
+	if err != nil {
+		return nil, err
+	}
+	// Search results only have names, so look up where they are
+	all, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[uuid.UUID]string, len(all))
+	for _, n := range all {
+		paths[n.id] = n.path
+	}
+	notes := make([]note, len(results))
+	for i, result := range results {
+		notes[i] = note{id: result.ID, path: paths[result.ID]}
+	}
+	return notes, nil
+}
+
+func (r remoteBackend) create(p string, content string) (note, error) {
+	n, err := r.c.Create(p, content)
+	if err != nil {
+		return note{}, err
+	}
+	return note{id: n.ID, path: n.Path, content: n.Content}, nil
+}
+
+func (r remoteBackend) save(id uuid.UUID, content string) error {
+	return r.c.Edit(id, content)
+}
+
+func (r remoteBackend) move(id uuid.UUID, newPath string) (note, error) {
+	n, err := r.c.Move(id, newPath)
+	if err != nil {
+		return note{}, err
+	}
+	return note{id: n.ID, path: n.Path}, nil
+}
+
+func (r remoteBackend) remove(id uuid.UUID) error {
+	return r.c.Delete(id)
+}
+
+func (r remoteBackend) history(limit int) ([]storage.HistoryEntry, error) {
+	entries, err := r.c.History(limit)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]storage.HistoryEntry, len(entries))
+	for i, entry := range entries {
+		history[i] = storage.HistoryEntry(entry)
+	}
+	return history, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"medb/commitpolicy"
+	"medb/storage"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+// Returns a local backend on a new git repo, and a function to clean it up.
+func newTestBackend(t *testing.T, commits commitpolicy.Policy, author *storage.Author) (localBackend, string, func()) {
+	dir, err := ioutil.TempDir("", "medb-tool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "master"},
+		{"config", "user.name", "MeDB Test"},
+		{"config", "user.email", "test@medb.example"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(string(output), err)
+		}
+	}
+	return newLocalBackend(dir, commits, author).(localBackend), dir, func() { os.RemoveAll(dir) }
+}
+
+func TestLocalCommits(t *testing.T) {
+	alice := &storage.Author{Name: "Alice", Email: "alice@example.com"}
+	commits, err := commitpolicy.New("{{.Username}}: {{.Operation}} {{.Title}}", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _, cleanUp := newTestBackend(t, commits, alice)
+	defer cleanUp()
+
+	n, err := l.create("projects/todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Edits to the same note amend each other
+	for _, content := range []string{"milk, eggs", "milk, eggs, bread"} {
+		err = l.save(n.id, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = l.move(n.id, "projects/shopping.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := l.history(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Alice: move shopping.md", "Alice: edit todo.md", "Alice: create todo.md"}
+	if len(entries) != len(expected) {
+		t.Fatal(entries)
+	}
+	for i, entry := range entries {
+		if entry.Message != expected[i] || entry.Author != "Alice" || entry.Email != "alice@example.com" {
+			t.Fatal(i, entry)
+		}
+	}
+	loaded, err := l.load(n.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.content != "milk, eggs, bread" || loaded.path != "projects/shopping.md" {
+		t.Fatal(loaded)
+	}
+}
+
+func TestLocalCommitsWithoutCoalescing(t *testing.T) {
+	commits, err := commitpolicy.New(commitpolicy.DefaultMessageTemplate, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _, cleanUp := newTestBackend(t, commits, nil)
+	defer cleanUp()
+
+	n, err := l.create("todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"milk, eggs", "milk, eggs, bread"} {
+		err = l.save(n.id, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := l.history(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// git's configured identity
+	if len(entries) != 3 || entries[0].Message != "MeDB Sync - edit todo.md" || entries[0].Author != "MeDB Test" {
+		t.Fatal(entries)
+	}
+}
+
+func TestLocalCommitsAreSigned(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "medb-tool-test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+	keyPath := path.Join(keyDir, "signing_key")
+	output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "test@medb.example", "-f", keyPath).CombinedOutput()
+	if err != nil {
+		t.Fatal(string(output), err)
+	}
+	publicKey, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedSigners := path.Join(keyDir, "allowed_signers")
+	err = ioutil.WriteFile(allowedSigners, []byte("test@medb.example "+string(publicKey)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := &storage.SigningKey{Format: storage.SigningFormatSSH, Path: keyPath}
+	commits, err := commitpolicy.New(commitpolicy.DefaultMessageTemplate, time.Hour, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, dir, cleanUp := newTestBackend(t, commits, nil)
+	defer cleanUp()
+	// Defaults to git's identity, so edits are still coalesced
+	l.author = gitAuthor(dir)
+	if *l.author != (storage.Author{Name: "MeDB Test", Email: "test@medb.example"}) {
+		t.Fatal(l.author)
+	}
+
+	n, err := l.create("todo.md", "milk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"milk, eggs", "milk, eggs, bread"} {
+		err = l.save(n.id, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := l.db.History(storage.HistoryOptions{AllowedSignersFile: allowedSigners})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatal(entries)
+	}
+	for _, entry := range entries {
+		if entry.Signature != storage.SignatureValid {
+			t.Fatal(entry)
+		}
+	}
+}
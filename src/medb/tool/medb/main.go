@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"medb/commitpolicy"
+	"medb/storage"
+)
+
+const usage = `Usage: medb (--root=<path> | --server=<url>) <command> [arguments]
+
+Commands:
+  ls                     list every note
+  cat <note>             print a note
+  new <path>             create a note from stdin, or $EDITOR if it's a terminal
+  edit <note>            edit a note in $EDITOR
+  search <query>         find notes by name or content
+  mv <note> <path>       move a note
+  rm <note>              delete a note
+  log [limit]            show the latest commits
+
+A <note> is either its ID or its path. Paths are relative to the root of the
+DB, ones without a folder go in unfiled/. Every change is committed, locally
+like the server would, as --authorName or git's configured identity. Against
+a server, the token comes from --token or $MEDB_TOKEN.
+`
+
+const (
+	// The same as the server's
+	searchLimit     = 5
+	defaultLogLimit = 20
+)
+
+func main() {
+	var rootPath string
+	var serverURL string
+	token := os.Getenv("MEDB_TOKEN")
+	commitMessageText := commitpolicy.DefaultMessageTemplate
+	coalesceWindow := commitpolicy.DefaultCoalesceWindow
+	var authorName string
+	var authorEmail string
+	var signingKeyPath string
+	signingKeyFormat := storage.SigningFormatSSH
+
+	flag.StringVar(&rootPath, "root", rootPath, "path to the root of a local db instance")
+	flag.StringVar(&serverURL, "server", serverURL, "url of a medb server to use instead of a local db")
+	flag.StringVar(&token, "token", token, "personal access token for the server")
+	flag.StringVar(
+		&commitMessageText,
+		"commitMessageTemplate",
+		commitMessageText,
+		"text/template for commit messages of a local db, can use .Operation, .Title and .Username",
+	)
+	flag.DurationVar(
+		&coalesceWindow,
+		"commitCoalesceWindow",
+		coalesceWindow,
+		"unpushed edits to a note within this window amend the last commit, 0 disables",
+	)
+	flag.StringVar(&authorName, "authorName", authorName, "name to commit as, defaults to git's user.name")
+	flag.StringVar(&authorEmail, "authorEmail", authorEmail, "email to commit as, defaults to git's user.email")
+	flag.StringVar(
+		&signingKeyPath,
+		"signingKey",
+		signingKeyPath,
+		"path to an ssh private key, or a GnuPG home dir for openpgp, to sign commits with",
+	)
+	flag.StringVar(&signingKeyFormat, "signingKeyFormat", signingKeyFormat, "either ssh or openpgp")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 || (rootPath == "") == (serverURL == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var b backend
+	if rootPath != "" {
+		var signingKey *storage.SigningKey
+		if signingKeyPath != "" {
+			signingKey = &storage.SigningKey{Format: signingKeyFormat, Path: signingKeyPath}
+			err := signingKey.Validate()
+			if err != nil {
+				panic(err)
+			}
+		}
+		// Edits are only coalesced when we know who made them
+		author := gitAuthor(rootPath)
+		if authorName != "" {
+			author = &storage.Author{Name: authorName, Email: authorEmail}
+		}
+		commits, err := commitpolicy.New(commitMessageText, coalesceWindow, signingKey)
+		if err != nil {
+			panic(err)
+		}
+		b = newLocalBackend(rootPath, commits, author)
+	} else {
+		if token == "" {
+			panic("Must specify a token to use a server!")
+		}
+		var err error
+		b, err = newRemoteBackend(serverURL, token)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err := runCommand(b, args[0], args[1:])
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid usage")
+
+func runCommand(b backend, command string, args []string) error {
+	switch {
+	case command == "ls" && len(args) == 0:
+		notes, err := b.list()
+		if err != nil {
+			return err
+		}
+		return printNotes(notes)
+	case command == "cat" && len(args) == 1:
+		n, err := findNote(b, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Print(n.content)
+	case command == "new" && len(args) == 1:
+		content, err := readNewContent(args[0])
+		if err != nil {
+			return err
+		}
+		n, err := b.create(notePath(args[0]), content)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INFO: Created %s as %s.\n", n.path, n.id)
+	case command == "edit" && len(args) == 1:
+		n, err := findNote(b, args[0])
+		if err != nil {
+			return err
+		}
+		content, err := editContent(path.Base(n.path), n.content)
+		if err != nil {
+			return err
+		}
+		if content == n.content {
+			fmt.Println("INFO: No changes.")
+			return nil
+		}
+		err = b.save(n.id, content)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INFO: Saved %s.\n", n.id)
+	case command == "search" && len(args) > 0:
+		notes, err := b.search(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		return printNotes(notes)
+	case command == "mv" && len(args) == 2:
+		id, err := resolveNote(b, args[0])
+		if err != nil {
+			return err
+		}
+		n, err := b.move(id, notePath(args[1]))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INFO: Moved %s to %s.\n", id, n.path)
+	case command == "rm" && len(args) == 1:
+		id, err := resolveNote(b, args[0])
+		if err != nil {
+			return err
+		}
+		err = b.remove(id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INFO: Deleted %s.\n", id)
+	case command == "log" && len(args) <= 1:
+		limit := defaultLogLimit
+		if len(args) == 1 {
+			_, err := fmt.Sscan(args[0], &limit)
+			if err != nil || limit <= 0 {
+				return errUsage
+			}
+		}
+		entries, err := b.history(limit)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, entry := range entries {
+			hash := entry.Hash
+			if len(hash) > 8 {
+				hash = hash[:8]
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", hash, entry.Time.Local().Format("2006-01-02 15:04"), entry.Author, entry.Message)
+		}
+		return w.Flush()
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func printNotes(notes []note) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, n := range notes {
+		fmt.Fprintf(w, "%s\t%s\n", n.id, n.path)
+	}
+	return w.Flush()
+}
+
+// Like the server, a path without a folder goes in unfiled/.
+func notePath(p string) string {
+	if !strings.Contains(p, "/") {
+		return path.Join("unfiled", p)
+	}
+	return p
+}
+
+// Returns the ID of the note the argument names, either by ID or by path.
+func resolveNote(b backend, idOrPath string) (uuid.UUID, error) {
+	id, err := uuid.Parse(idOrPath)
+	if err == nil {
+		return id, nil
+	}
+	notes, err := b.list()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	p := path.Clean(notePath(idOrPath))
+	for _, n := range notes {
+		if n.path == p {
+			return n.id, nil
+		}
+	}
+	return uuid.Nil, fmt.Errorf("no note at %s", p)
+}
+
+func findNote(b backend, idOrPath string) (note, error) {
+	id, err := resolveNote(b, idOrPath)
+	if err != nil {
+		return note{}, err
+	}
+	return b.load(id)
+}
+
+func readNewContent(p string) (string, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		content, err := ioutil.ReadAll(os.Stdin)
+		return string(content), err
+	}
+	return editContent(path.Base(p), "")
+}
+
+// Opens the content in $EDITOR and returns what it was saved as. The temp
+// file keeps the note's name so editors can tell what it is.
+func editContent(name string, content string) (string, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	dir, err := ioutil.TempDir("", "medb-edit")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	tempPath := path.Join(dir, name)
+	err = ioutil.WriteFile(tempPath, []byte(content), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	// $EDITOR can have arguments of its own, like "code --wait"
+	editorArgs := strings.Fields(editor)
+	cmd := exec.Command(editorArgs[0], append(editorArgs[1:], tempPath)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v", editor, err)
+	}
+	edited, err := ioutil.ReadFile(tempPath)
+	if err != nil {
+		return "", err
+	}
+	return string(edited), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"medb/storage"
+)
+
+func main() {
+	var rootPath string
+	var signingKeyPath string
+	signingKeyFormat := storage.SigningFormatSSH
+	window := 10 * time.Minute
+
+	flag.StringVar(&rootPath, "root", rootPath, "path to the root of the db instance")
+	flag.DurationVar(
+		&window,
+		"window",
+		window,
+		"max time between automatic commits of the same note for them to be squashed together",
+	)
+	flag.StringVar(
+		&signingKeyPath,
+		"signingKey",
+		signingKeyPath,
+		"path to an ssh private key, or a GnuPG home dir for openpgp, to sign the squashed commits with",
+	)
+	flag.StringVar(&signingKeyFormat, "signingKeyFormat", signingKeyFormat, "either ssh or openpgp")
+	flag.Parse()
+
+	if rootPath == "" {
+		panic("Must specify root path!")
+	}
+	var signingKey *storage.SigningKey
+	if signingKeyPath != "" {
+		signingKey = &storage.SigningKey{Format: signingKeyFormat, Path: signingKeyPath}
+		err := signingKey.Validate()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Only unpushed commits are rewritten. Without a key, signed ones are
+	// refused, since the squashed commits couldn't be signed.
+	db := storage.NewDB(rootPath)
+	squashed, err := db.SquashAutoCommits(window, signingKey)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("INFO: Squashed away %d automatic commits.\n", squashed)
+}
@@ -13,13 +13,32 @@ import (
 
 func main() {
 	var rootPath string
+	var signingKeyPath string
+	signingKeyFormat := storage.SigningFormatSSH
+	var mirrorsRaw string
 
 	flag.StringVar(&rootPath, "root", rootPath, "path to the root of the db instance")
+	flag.StringVar(
+		&signingKeyPath,
+		"signingKey",
+		signingKeyPath,
+		"path to an ssh private key, or a GnuPG home dir for openpgp, to sign commits with",
+	)
+	flag.StringVar(&signingKeyFormat, "signingKeyFormat", signingKeyFormat, "either ssh or openpgp")
+	flag.StringVar(&mirrorsRaw, "mirrors", mirrorsRaw, "comma separated git remotes to push to")
 	flag.Parse()
 
 	if rootPath == "" {
 		panic("Must specify root path!")
 	}
+	commitOptions := storage.CommitOptions{}
+	if signingKeyPath != "" {
+		commitOptions.SigningKey = &storage.SigningKey{Format: signingKeyFormat, Path: signingKeyPath}
+		err := commitOptions.SigningKey.Validate()
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	db := storage.NewDB(rootPath)
 	files, err := db.AllFiles()
@@ -55,7 +74,7 @@ func main() {
 		}
 	}
 	// Step 4: Create a new git commit with all the changes + all new files
-	err = db.CommitToGIT(fmt.Sprintf("MeDB Sync - %v", time.Now().Unix()))
+	err = db.CommitWithOptions(fmt.Sprintf("MeDB Sync - %v", time.Now().Unix()), commitOptions)
 	if err != nil {
 		panic(err)
 	}
@@ -69,12 +88,17 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	aheadBehind, err := db.AheadBehindOriginMaster()
+	remotes := []string{"origin"}
+	if mirrorsRaw != "" {
+		remotes = storage.ParseRemotes(mirrorsRaw)
+	}
+	statuses, err := db.RemoteStatuses(remotes)
 	if err != nil {
 		panic(err)
 	}
+	aheadBehind := storage.CombinedAheadBehind(statuses)
 	fmt.Printf(
-		"Last committed %v ago, last pulled %v ago. Origin is ahead by %d and we are ahead by %d\n",
+		"Last committed %v ago, last pulled %v ago. The remotes are ahead by %d and we are ahead by %d\n",
 		time.Since(lastCommitTS),
 		time.Since(lastPullTS),
 		aheadBehind.OriginAheadBy,
@@ -83,10 +107,52 @@ func main() {
 
 	// Step 5: Rebase on new changes?
 	// Step 6: Push out changes
-	if aheadBehind.LocalAheadBy > 0 {
-		err = db.Push()
-		if err != nil {
-			panic(err)
+	if mirrorsRaw == "" {
+		if aheadBehind.LocalAheadBy > 0 {
+			err = db.Push()
+			if err != nil {
+				panic(err)
+			}
+		}
+		return
+	}
+	pushMirrors(db, remotes)
+}
+
+// Pushes to every mirror that is behind, reporting on each of them before
+// failing if any push did.
+func pushMirrors(db storage.DB, mirrors []string) {
+	err := db.Fetch()
+	if err != nil {
+		panic(err)
+	}
+	statuses, err := db.RemoteStatuses(mirrors)
+	if err != nil {
+		panic(err)
+	}
+	toPush := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		// Remotes we aren't tracking yet have never been pushed to
+		if status.AheadBehind == nil || status.AheadBehind.LocalAheadBy > 0 {
+			toPush = append(toPush, status.Remote)
+		} else {
+			fmt.Printf("INFO: %s is up to date.\n", status.Remote)
 		}
 	}
+	results, err := db.PushMirrors(toPush)
+	if err != nil {
+		panic(err)
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Printf("ERROR: Failed to push to %s: %v\n", result.Remote, result.Err)
+			failed++
+		} else {
+			fmt.Printf("INFO: Pushed to %s.\n", result.Remote)
+		}
+	}
+	if failed > 0 {
+		panic(fmt.Errorf("failed to push to %d of %d mirrors", failed, len(results)))
+	}
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"medb/server/user"
+)
+
+const usage = `Usage: users --usersFilePath=<path> <command> [arguments]
+
+Commands:
+  add <username> <pathToDB>   add a user, prompting for their password
+  remove <username>           remove a user
+  passwd <username>           change a user's password, prompting for it
+  list                        list all users and their DBs
+  set-path <username> <path>  change the path of a user's default DB
+  add-db <username> <name> <path>
+                              give a user another DB they can switch to
+  remove-db <username> <name> remove one of a user's DBs
+`
+
+func main() {
+	var userFilePath string
+
+	flag.StringVar(&userFilePath, "usersFilePath", userFilePath, "path to the file with user information")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if userFilePath == "" {
+		panic("Must specify path to the users file!")
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	store := user.NewWritableStore(userFilePath)
+	err := runCommand(store, args[0], args[1:])
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid usage")
+
+func runCommand(store user.WritableStore, command string, args []string) error {
+	switch {
+	case command == "add" && len(args) == 2:
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		err = store.Add(args[0], password, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INFO: Added %s.\n", args[0])
+	case command == "remove" && len(args) == 1:
+		err := store.Remove(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INFO: Removed %s.\n", args[0])
+	case command == "passwd" && len(args) == 1:
+		// Make sure they exist before prompting for anything
+		_, err := store.Lookup(args[0])
+		if err != nil {
+			return err
+		}
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		err = store.SetPassword(args[0], password)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INFO: Changed the password for %s.\n", args[0])
+	case command == "list" && len(args) == 0:
+		users, err := store.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tNAME\tEMAIL\tDB\tPATH")
+		for _, u := range users {
+			for i, db := range u.DBs() {
+				if i == 0 {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", u.Name(), u.DisplayName(), u.Email(), db.Name, db.Path)
+				} else {
+					fmt.Fprintf(w, "\t\t\t%s\t%s\n", db.Name, db.Path)
+				}
+			}
+		}
+		return w.Flush()
+	case command == "set-path" && len(args) == 2:
+		err := store.SetPath(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INFO: %s now uses %s.\n", args[0], args[1])
+	case command == "add-db" && len(args) == 3:
+		err := store.AddDB(args[0], args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INFO: %s can now switch to %s.\n", args[0], args[1])
+	case command == "remove-db" && len(args) == 2:
+		err := store.RemoveDB(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INFO: Removed %s from %s.\n", args[1], args[0])
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func readNewPassword() (string, error) {
+	fmt.Println("Enter password:")
+	passwordBytes, err := terminal.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return "", err
+	}
+	fmt.Println("Confirm password:")
+	confirmBytes, err := terminal.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return "", err
+	}
+	if string(passwordBytes) != string(confirmBytes) {
+		return "", errors.New("passwords don't match")
+	}
+	return string(passwordBytes), nil
+}
@@ -1,18 +1,44 @@
 import $ from 'jquery';
 import {notify} from 'react-notify-toast';
 
+// The server rejects anything that changes state unless it echoes the CSRF
+// cookie back in a header, which other sites can't read.
+function csrfToken() {
+    const match = document.cookie.match(/(?:^|;\s*)medb_csrf=([^;]*)/);
+    return match ? match[1] : "";
+}
+
+$.ajaxPrefilter((options, originalOptions, xhr) => {
+    if (!/^(GET|HEAD|OPTIONS)$/i.test(options.type)) {
+        xhr.setRequestHeader("X-CSRF-Token", csrfToken());
+    }
+});
+
 export function handlePull() {
-    $.get("/api/1/pull", () => {
+    $.post("/api/1/pull", () => {
         notify.show('Pulled successfully.')
     })
 }
 
 export function handlePush() {
-    $.get("/api/1/push", () => {
+    $.post("/api/1/push", () => {
         notify.show('Pushed successfully.')
     })
 }
 
+// Calls handlers[type] with every event of that type from the user's DB, see
+// server/events for the types. Returns a function that stops listening.
+export function subscribeEvents(handlers) {
+    if (typeof EventSource === "undefined") {
+        return () => {}
+    }
+    const source = new EventSource("/api/1/events");
+    Object.keys(handlers).forEach((type) => {
+        source.addEventListener(type, (e) => handlers[type](JSON.parse(e.data)))
+    });
+    return () => source.close()
+}
+
 export function fetchGitInfo(callback) {
     $.get("/api/1/git/info", (info) => {
         callback(JSON.parse(info))
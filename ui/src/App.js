@@ -1,13 +1,14 @@
 import React, { Component } from 'react';
-import Notifications from 'react-notify-toast';
+import Notifications, {notify} from 'react-notify-toast';
 import PagedrawGeneratedPage from './pagedraw/app'
 import $ from 'jquery';
-import {emptyGitInfo, fetchGitInfo, handlePull, handlePush} from './Api'
+import {emptyGitInfo, fetchGitInfo, handlePull, handlePush, subscribeEvents} from './Api'
 
 class App extends Component {
-  constructor() {
+  constructor(props) {
       super();
       this.state = {
+          rootFolderList: props.rootFolderList,
           filename: "",
           content: "",
           searchResultList: [],
@@ -18,11 +19,45 @@ class App extends Component {
       this.populateGitInfo();
   }
 
-  componentWillReceiveProps() {
+  componentDidMount() {
+      // Keep up with changes made anywhere else
+      let refreshList = () => this.refreshFolderList();
+      let refreshGitInfo = () => this.populateGitInfo();
+      this.unsubscribe = subscribeEvents({
+          created: refreshList,
+          moved: refreshList,
+          deleted: refreshList,
+          commit: refreshGitInfo,
+          pull: refreshGitInfo,
+          conflict: (e) => {
+              if (e.conflicts && e.conflicts.length > 0) {
+                  notify.show("Conflicts in " + e.conflicts.join(", "), "error")
+              }
+          },
+      });
+  }
+
+  componentWillUnmount() {
+      this.unsubscribe();
+  }
+
+  componentWillReceiveProps(nextProps) {
+      this.setState({
+          rootFolderList: nextProps.rootFolderList,
+      });
+
       // Kick off populating git info
       this.populateGitInfo();
   }
 
+  refreshFolderList() {
+      $.getJSON('/api/1/list', (data) => {
+          this.setState({
+              rootFolderList: data,
+          })
+      })
+  }
+
   populateGitInfo() {
       fetchGitInfo((newInfo) => {
           this.setState({
@@ -94,7 +129,7 @@ class App extends Component {
       let pathParts = path.split("/");
       // TODO: Remove this horrible hack and instead let there be two handle functions separately
       // for search results / root folder list
-      let curNode = {contents: this.props.rootFolderList.concat(this.state.searchResultList)};
+      let curNode = {contents: this.state.rootFolderList.concat(this.state.searchResultList)};
       for (let i = 1; i < pathParts.length; i++) {
           let target = pathParts[i];
           let found = false;
@@ -127,7 +162,7 @@ class App extends Component {
   render() {
     return <div>
         <PagedrawGeneratedPage
-          rootFolderList={this.props.rootFolderList}
+          rootFolderList={this.state.rootFolderList}
           filename={this.state.filename}
           content={this.state.content}
           searchResultList={this.state.searchResultList}
@@ -0,0 +1,348 @@
+// Editing a note together with everyone else who has it open, see
+// server/collab for the protocol. Ops are arrays where positive numbers
+// retain, negative numbers delete and strings insert. Like the server, they
+// count code points, not the UTF-16 units JS strings are indexed by.
+
+function codePoints(text) {
+    return Array.from(text)
+}
+
+function codePointLength(text) {
+    return codePoints(text).length
+}
+
+function isRetain(c) { return typeof c === "number" && c > 0 }
+function isDelete(c) { return typeof c === "number" && c < 0 }
+function isInsert(c) { return typeof c === "string" }
+
+class OpBuilder {
+    constructor() {
+        this.op = [];
+    }
+
+    last() {
+        return this.op[this.op.length - 1]
+    }
+
+    retain(n) {
+        if (n <= 0) {
+            return this
+        }
+        if (isRetain(this.last())) {
+            this.op[this.op.length - 1] += n
+        } else {
+            this.op.push(n)
+        }
+        return this
+    }
+
+    insert(s) {
+        if (s === "") {
+            return this
+        }
+        if (isInsert(this.last())) {
+            this.op[this.op.length - 1] += s
+        } else {
+            this.op.push(s)
+        }
+        return this
+    }
+
+    delete(n) {
+        if (n <= 0) {
+            return this
+        }
+        if (isDelete(this.last())) {
+            this.op[this.op.length - 1] -= n
+        } else {
+            this.op.push(-n)
+        }
+        return this
+    }
+}
+
+export function isNoop(op) {
+    return op.length === 0 || (op.length === 1 && isRetain(op[0]))
+}
+
+export function apply(op, text) {
+    const chars = codePoints(text);
+    let result = [];
+    let i = 0;
+    op.forEach((c) => {
+        if (isRetain(c)) {
+            result = result.concat(chars.slice(i, i + c));
+            i += c
+        } else if (isInsert(c)) {
+            result = result.concat(codePoints(c))
+        } else {
+            i -= c
+        }
+    });
+    if (i !== chars.length) {
+        throw new Error("The op doesn't apply to the text.")
+    }
+    return result.join("")
+}
+
+// Returns [a', b'] such that applying a then b' is the same as b then a'.
+// Where both insert at the same position, a goes first.
+export function transform(a, b) {
+    const aPrime = new OpBuilder();
+    const bPrime = new OpBuilder();
+    let i = 0;
+    let j = 0;
+    let ac = a[i++];
+    let bc = b[j++];
+    while (ac !== undefined || bc !== undefined) {
+        if (isInsert(ac)) {
+            aPrime.insert(ac);
+            bPrime.retain(codePointLength(ac));
+            ac = a[i++];
+            continue
+        }
+        if (isInsert(bc)) {
+            aPrime.retain(codePointLength(bc));
+            bPrime.insert(bc);
+            bc = b[j++];
+            continue
+        }
+        if (ac === undefined || bc === undefined) {
+            throw new Error("The ops don't apply to the same text.")
+        }
+
+        // Both are retains or deletes now, handle the overlap of the two
+        const n = Math.min(Math.abs(ac), Math.abs(bc));
+        if (isRetain(ac) && isRetain(bc)) {
+            aPrime.retain(n);
+            bPrime.retain(n)
+        } else if (isDelete(ac) && isRetain(bc)) {
+            aPrime.delete(n)
+        } else if (isRetain(ac) && isDelete(bc)) {
+            bPrime.delete(n)
+        }
+        // Deleted by both, there's nothing left to do
+        ac = shorten(ac, n);
+        if (ac === 0) {
+            ac = a[i++]
+        }
+        bc = shorten(bc, n);
+        if (bc === 0) {
+            bc = b[j++]
+        }
+    }
+    return [aPrime.op, bPrime.op]
+}
+
+function shorten(c, n) {
+    return c > 0 ? c - n : c + n
+}
+
+// Moves a position in the text op applies to, in code points, to where it
+// ends up after it.
+export function transformIndex(index, op) {
+    let newIndex = index;
+    for (let k = 0; k < op.length && index >= 0; k++) {
+        const c = op[k];
+        if (isRetain(c)) {
+            index -= c
+        } else if (isInsert(c)) {
+            newIndex += codePointLength(c)
+        } else {
+            newIndex -= Math.min(index, -c);
+            index += c
+        }
+    }
+    return newIndex
+}
+
+// Returns the op that turns oldText into newText, assuming the change is in
+// one place, like typing or pasting.
+export function diff(oldText, newText) {
+    const before = codePoints(oldText);
+    const after = codePoints(newText);
+    let prefix = 0;
+    while (prefix < before.length && prefix < after.length && before[prefix] === after[prefix]) {
+        prefix++
+    }
+    let suffix = 0;
+    while (suffix < before.length - prefix && suffix < after.length - prefix &&
+           before[before.length - 1 - suffix] === after[after.length - 1 - suffix]) {
+        suffix++
+    }
+    return new OpBuilder()
+        .retain(prefix)
+        .delete(before.length - prefix - suffix)
+        .insert(after.slice(prefix, after.length - suffix).join(""))
+        .retain(suffix)
+        .op
+}
+
+function toCodePoints(text, index) {
+    return codePointLength(text.slice(0, index))
+}
+
+function fromCodePoints(text, index) {
+    return codePoints(text).slice(0, index).join("").length
+}
+
+// A connection to the session for a note. handlers are called with:
+//   content(text, moveIndex) when the text changes, moveIndex takes a UTF-16
+//     index in the old text to the new one
+//   participants(list) with everyone else who's editing
+//   saved(error) when a save asked for with save() is done, error is empty
+//     if it worked
+//   error(message) when the server rejects something, the session ends
+//   closed() once the session is over
+export class CollabSession {
+    constructor(fileID, handlers) {
+        this.handlers = handlers;
+        this.content = null;
+        this.revision = 0;
+        this.clientID = "";
+        // The op waiting for an ack, and the ones made since
+        this.outstanding = null;
+        this.buffer = [];
+        this.cursor = null;
+        // Whether a save is waiting for our edits to get to the server
+        this.saveWanted = false;
+
+        const scheme = window.location.protocol === "https:" ? "wss:" : "ws:";
+        this.socket = new WebSocket(
+            `${scheme}//${window.location.host}/api/1/collab?fileID=${encodeURIComponent(fileID)}`
+        );
+        this.socket.onmessage = (e) => this.receive(JSON.parse(e.data));
+        this.socket.onclose = () => this.handlers.closed()
+    }
+
+    close() {
+        this.socket.close()
+    }
+
+    send(msg) {
+        if (this.socket.readyState === WebSocket.OPEN) {
+            this.socket.send(JSON.stringify(msg))
+        }
+    }
+
+    receive(msg) {
+        switch (msg.type) {
+            case "init":
+                this.content = msg.content;
+                this.revision = msg.revision;
+                this.clientID = msg.clientID;
+                this.handlers.content(this.content, () => 0);
+                this.handleParticipants(msg.participants);
+                break;
+            case "ack":
+                this.revision = msg.revision;
+                this.outstanding = this.buffer.shift() || null;
+                if (this.outstanding) {
+                    this.sendOp(this.outstanding)
+                } else {
+                    this.sendCursor();
+                    this.sendSave()
+                }
+                break;
+            case "op":
+                this.revision = msg.revision;
+                this.applyRemote(msg.op);
+                break;
+            case "presence":
+                this.handleParticipants(msg.participants);
+                break;
+            case "saved":
+                this.handlers.saved(msg.error || "");
+                break;
+            case "error":
+                this.handlers.error(msg.error);
+                this.close();
+                break;
+            default:
+        }
+    }
+
+    handleParticipants(participants) {
+        this.handlers.participants((participants || []).filter((p) => p.clientID !== this.clientID))
+    }
+
+    applyRemote(op) {
+        if (this.outstanding) {
+            [this.outstanding, op] = transform(this.outstanding, op)
+        }
+        this.buffer = this.buffer.map((buffered) => {
+            let transformed;
+            [transformed, op] = transform(buffered, op);
+            return transformed
+        });
+        if (this.cursor) {
+            this.cursor = {
+                position: transformIndex(this.cursor.position, op),
+                selectionEnd: transformIndex(this.cursor.selectionEnd, op),
+            }
+        }
+        const oldContent = this.content;
+        this.content = apply(op, oldContent);
+        this.handlers.content(this.content, (index) => fromCodePoints(
+            this.content,
+            transformIndex(toCodePoints(oldContent, index), op),
+        ))
+    }
+
+    sendOp(op) {
+        this.send({type: "op", revision: this.revision, op: op})
+    }
+
+    // Sends the local change that turned the text into newText.
+    edit(newText) {
+        if (this.content === null) {
+            return
+        }
+        const op = diff(this.content, newText);
+        if (isNoop(op)) {
+            return
+        }
+        this.content = newText;
+        if (this.outstanding) {
+            this.buffer.push(op)
+        } else {
+            this.outstanding = op;
+            this.sendOp(op)
+        }
+    }
+
+    // Shares the selection, in UTF-16 indexes into the current text.
+    moveCursor(start, end) {
+        if (this.content === null) {
+            return
+        }
+        this.cursor = {
+            position: toCodePoints(this.content, start),
+            selectionEnd: toCodePoints(this.content, end),
+        };
+        this.sendCursor()
+    }
+
+    // The server only knows the revision it acked, so cursors wait until
+    // the text here matches it.
+    sendCursor() {
+        if (this.cursor && !this.outstanding) {
+            this.send({type: "cursor", revision: this.revision, cursor: this.cursor});
+            this.cursor = null
+        }
+    }
+
+    // Asks the server to save and commit the text, once it has every edit
+    // made here.
+    save() {
+        this.saveWanted = true;
+        this.sendSave()
+    }
+
+    sendSave() {
+        if (this.saveWanted && !this.outstanding) {
+            this.send({type: "save", revision: this.revision});
+            this.saveWanted = false
+        }
+    }
+}
@@ -2,7 +2,8 @@ import React, { Component } from 'react';
 import Notifications, {notify} from 'react-notify-toast';
 import PagedrawGeneratedPage from './pagedraw/editfile'
 import $ from 'jquery';
-import {emptyGitInfo, fetchGitInfo, handlePull, handlePush} from './Api'
+import {emptyGitInfo, fetchGitInfo, handlePull, handlePush, subscribeEvents} from './Api'
+import {CollabSession} from './Collab'
 
 class EditFile extends Component {
   constructor(props) {
@@ -11,16 +12,125 @@ class EditFile extends Component {
           fileContent: props.file.content,
           viewState: "viewing",
           gitInfo: emptyGitInfo(),
+          // Everyone else editing the note with us
+          participants: [],
       };
+      this.collab = null;
+      this.reportCursor = this.reportCursor.bind(this);
 
       // Kick off populating git info
       this.populateGitInfo();
   }
 
+  componentDidMount() {
+      let refreshGitInfo = () => this.populateGitInfo();
+      this.unsubscribe = subscribeEvents({
+          updated: (e) => {
+              if (e.fileID === this.props.file.id) {
+                  this.handleChangedElsewhere()
+              }
+          },
+          deleted: (e) => {
+              if (e.fileID === this.props.file.id) {
+                  notify.show("This note was deleted.", "error")
+              }
+          },
+          commit: refreshGitInfo,
+          pull: refreshGitInfo,
+      });
+      document.addEventListener("selectionchange", this.reportCursor);
+  }
+
+  componentWillUnmount() {
+      this.unsubscribe();
+      document.removeEventListener("selectionchange", this.reportCursor);
+      this.stopCollab();
+  }
+
+  // Edits go to everyone else with the note open as they're typed, and the
+  // server saves them.
+  startCollab(fileID) {
+      if (typeof WebSocket === "undefined") {
+          return
+      }
+      let session = new CollabSession(fileID, {
+          content: (content, moveIndex) => this.handleCollabContent(content, moveIndex),
+          participants: (participants) => this.setState({participants: participants}),
+          saved: (error) => this.handleCommitted(error),
+          error: (message) => notify.show(message, "error"),
+          closed: () => {
+              if (this.collab === session) {
+                  this.collab = null;
+                  this.setState({participants: []})
+              }
+          },
+      });
+      this.collab = session
+  }
+
+  stopCollab() {
+      if (this.collab) {
+          this.collab.close();
+          this.collab = null;
+          this.setState({participants: []})
+      }
+  }
+
+  // Shows the text from the session, keeping our selection where it was.
+  handleCollabContent(content, moveIndex) {
+      let textarea = this.focusedTextarea();
+      let start = textarea && moveIndex(textarea.selectionStart);
+      let end = textarea && moveIndex(textarea.selectionEnd);
+      this.setState({
+          fileContent: content,
+      }, () => {
+          if (textarea) {
+              textarea.setSelectionRange(start, end)
+          }
+      })
+  }
+
+  focusedTextarea() {
+      let element = document.activeElement;
+      return (element && element.tagName === "TEXTAREA") ? element : null
+  }
+
+  reportCursor() {
+      let textarea = this.focusedTextarea();
+      if (this.collab && textarea) {
+          this.collab.moveCursor(textarea.selectionStart, textarea.selectionEnd)
+      }
+  }
+
+  // Shows the new content, unless that would throw away an edit in progress
+  handleChangedElsewhere() {
+      if (this.collab) {
+          // The session already has the change
+          return
+      }
+      $.post("/api/1/load", {fileID: this.props.file.id}, (fileRaw) => {
+          let content = JSON.parse(fileRaw).content;
+          if (content === this.state.fileContent) {
+              return
+          }
+          if (this.state.viewState === "viewing") {
+              this.setState({
+                  fileContent: content,
+              })
+          } else {
+              notify.show("This note was changed somewhere else.", "warning")
+          }
+      })
+  }
+
   componentWillReceiveProps(nextProps) {
       this.setState({
           fileContent: nextProps.file.content,
       });
+      if (this.collab && nextProps.file.id !== this.props.file.id) {
+          this.stopCollab();
+          this.startCollab(nextProps.file.id)
+      }
 
       // Kick off populating git info
       this.populateGitInfo();
@@ -37,24 +147,43 @@ class EditFile extends Component {
   handleContentChange(e) {
       this.setState({
           fileContent: e.target.value,
-      })
+      });
+      if (this.collab) {
+          this.collab.edit(e.target.value)
+      }
   }
 
   handleCommit() {
+      if (this.collab) {
+          // The server refuses edits to a note that's being edited together
+          this.collab.save();
+          return
+      }
       $.post("/api/1/edit", {
           fileID: this.props.file.id,
           fileContent: this.state.fileContent,
-      }).done(() => {
-          notify.show("Committed successfully.");
-          this.populateGitInfo()
-      })
+      }).done(() => this.handleCommitted("")).fail((xhr) => this.handleCommitted(xhr.responseText))
+  }
+
+  handleCommitted(error) {
+      if (error) {
+          notify.show(error, "error");
+          return
+      }
+      notify.show("Committed successfully.");
+      this.populateGitInfo()
   }
 
   handleViewStateChange() {
       let newViewState = (this.state.viewState === "viewing") ? "editing" : "viewing";
       this.setState({
           viewState: newViewState,
-      })
+      });
+      if (newViewState === "editing") {
+          this.startCollab(this.props.file.id)
+      } else {
+          this.stopCollab()
+      }
   }
 
   render() {
@@ -74,6 +203,10 @@ class EditFile extends Component {
               remoteAheadBy={this.state.gitInfo.remoteAheadBy}
               localAheadBy={this.state.gitInfo.localAheadBy}
           />
+          {this.state.participants.length > 0 &&
+              <div className="collab-participants">
+                  Also editing: {this.state.participants.map((p) => p.name || p.username).join(", ")}
+              </div>}
           <Notifications />
       </div>;
   }